@@ -38,16 +38,25 @@ func GetTaskStateAndLags(cfg *config.Config) (stateLags map[string]StateLag, err
 
 	stateLags = make(map[string]StateLag, len(cfg.Tasks))
 	for _, taskCfg := range cfg.Tasks {
+		if taskCfg.Input.Type != "" && taskCfg.Input.Type != config.InputKafka {
+			continue
+		}
 		var state string
-		var totalLags int64
-		if state, totalLags, err = getStateAndLag(theAdm, taskCfg.Topic, taskCfg.ConsumerGroup); err != nil {
+		var lags map[string]int64
+		if state, lags, err = getStateAndLag(theAdm, taskCfg); err != nil {
 			// skip this task for now, wait next assign cycle
 			util.Logger.Error("retrieve lag failed", zap.String("task", taskCfg.Name), zap.Error(err))
-			statistics.ConsumeLags.WithLabelValues(taskCfg.ConsumerGroup, taskCfg.Topic, taskCfg.Name).Set(float64(-1))
+			for _, topic := range taskCfg.Topics {
+				statistics.ConsumeLags.WithLabelValues(taskCfg.ConsumerGroup, topic, taskCfg.Name).Set(float64(-1))
+			}
 			continue
 		}
+		var totalLags int64
+		for topic, lag := range lags {
+			totalLags += lag
+			statistics.ConsumeLags.WithLabelValues(taskCfg.ConsumerGroup, topic, taskCfg.Name).Set(float64(lag))
+		}
 		stateLags[taskCfg.Name] = StateLag{State: state, Lag: totalLags}
-		statistics.ConsumeLags.WithLabelValues(taskCfg.ConsumerGroup, taskCfg.Topic, taskCfg.Name).Set(float64(totalLags))
 	}
 	return
 }
@@ -78,8 +87,25 @@ func newClient(cfg config.KafkaConfig) (err error) {
 }
 
 // getStateAndLag is inspired by https://github.com/cloudhut/kminion/blob/1ffd02ba94a5edc26d4f11e57191ed3479d8a111/prometheus/collect_consumer_group_lags.go
-func getStateAndLag(adm *kadm.Client, topic, group string) (state string, totalLags int64, err error) {
+// It returns the lag of each topic consumed by the task, including the ones matching TopicPattern.
+func getStateAndLag(adm *kadm.Client, taskCfg *config.TaskConfig) (state string, lags map[string]int64, err error) {
 	ctx := context.Background()
+	group := taskCfg.ConsumerGroup
+	topics := taskCfg.Topics
+	if taskCfg.TopicPattern != "" {
+		var details kadm.TopicDetails
+		if details, err = adm.ListTopics(ctx); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		matchTopic := taskCfg.TopicMatcher()
+		topics = nil
+		for _, topic := range details.Names() {
+			if matchTopic(topic) {
+				topics = append(topics, topic)
+			}
+		}
+	}
 	var ok bool
 	var descGroups kadm.DescribedGroups
 	var descGroup kadm.DescribedGroup
@@ -98,15 +124,23 @@ func getStateAndLag(adm *kadm.Client, topic, group string) (state string, totalL
 		return
 	}
 	var offsets kadm.ListedOffsets
-	if offsets, err = adm.ListEndOffsets(ctx, topic); err != nil {
+	if len(topics) == 0 {
+		// ListEndOffsets lists all topics if none is given
+		return
+	}
+	if offsets, err = adm.ListEndOffsets(ctx, topics...); err != nil {
 		err = errors.Wrapf(err, "")
 		return
 	}
 	grpLag := kadm.CalculateGroupLag(descGroup, commit, offsets)
-	if topLag, ok := grpLag[topic]; ok {
-		for _, grpMemberLag := range topLag {
-			if grpMemberLag.Lag >= 0 {
-				totalLags += grpMemberLag.Lag
+	lags = make(map[string]int64, len(topics))
+	for _, topic := range topics {
+		lags[topic] = 0
+		if topLag, ok := grpLag[topic]; ok {
+			for _, grpMemberLag := range topLag {
+				if grpMemberLag.Lag >= 0 {
+					lags[topic] += grpMemberLag.Lag
+				}
 			}
 		}
 	}
@@ -0,0 +1,267 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+// Stdin is the file name standing for the standard input
+const Stdin = "-"
+
+// FileInput implements input.Inputer, it reads newline-delimited messages from files or stdin.
+// The partition of a message is the index of its file, and the offset is the position of the line in the file.
+type FileInput struct {
+	cfg       *config.Config
+	grpConfig *config.GroupConfig
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wgRun     sync.WaitGroup
+	fetch     chan Fetches
+	cleanupFn CleanupFn
+	offsetsFn OffsetsFn
+
+	files       []string
+	topic       string
+	ckMux       sync.Mutex
+	checkpoints map[string]int64 // file -> position of the last committed line
+}
+
+// NewFileInput get instance of file reader
+func NewFileInput() *FileInput {
+	return &FileInput{}
+}
+
+// Init Initialise the file input with configuration
+func (f *FileInput) Init(cfg *config.Config, gCfg *config.GroupConfig, fetch chan Fetches, cleanupFn CleanupFn, offsetsFn OffsetsFn) (err error) {
+	f.cfg = cfg
+	f.grpConfig = gCfg
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.fetch = fetch
+	f.cleanupFn = cleanupFn
+	f.offsetsFn = offsetsFn
+	f.files = gCfg.Input.Files
+	// messages are routed to tasks by topic, and the group reading files has a single one
+	f.topic = gCfg.Topics[0]
+	f.checkpoints = make(map[string]int64)
+	if ckFile := gCfg.Input.CheckpointFile; ckFile != "" {
+		var b []byte
+		if b, err = os.ReadFile(ckFile); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "")
+		}
+		if err = json.Unmarshal(b, &f.checkpoints); err != nil {
+			return errors.Wrapf(err, "invalid checkpoint file %s", ckFile)
+		}
+	}
+	return
+}
+
+// Run reads the files one by one, and waits for Stop after all of them reach EOF
+func (f *FileInput) Run() {
+	f.wgRun.Add(1)
+	defer f.wgRun.Done()
+	var next map[int32]int64
+	if f.offsetsFn != nil {
+		next = f.offsetsFn(map[string][]int32{f.topic: f.partitions()})[f.topic]
+	}
+	for i, path := range f.files {
+		// resume after the line at position "after", -1 means from the beginning
+		after := int64(-1)
+		f.ckMux.Lock()
+		if pos, ok := f.checkpoints[path]; ok {
+			after = pos
+		}
+		f.ckMux.Unlock()
+		if pos, ok := next[int32(i)]; ok && pos-1 > after {
+			after = pos - 1
+		}
+		if err := f.readFile(i, path, after); err != nil {
+			if errors.Is(err, context.Canceled) {
+				break
+			}
+			util.Logger.Fatal("FileInput.Run failed", zap.String("consumer group", f.grpConfig.Name), zap.String("file", path), zap.Error(err))
+		}
+	}
+	select {
+	case <-f.ctx.Done():
+	default:
+		util.Logger.Info("all files have been consumed", zap.String("consumer group", f.grpConfig.Name), zap.Strings("files", f.files))
+		<-f.ctx.Done()
+	}
+	f.cleanupFn(map[string][]int32{f.topic: f.partitions()})
+	util.Logger.Info("FileInput.Run quit due to context has been canceled", zap.String("consumer group", f.grpConfig.Name))
+}
+
+func (f *FileInput) readFile(partition int, path string, after int64) (err error) {
+	var rd io.Reader
+	var pos int64
+	if path == Stdin {
+		rd = os.Stdin
+	} else {
+		var fp *os.File
+		if fp, err = os.Open(path); err != nil {
+			return errors.Wrapf(err, "")
+		}
+		defer fp.Close()
+		if after >= 0 {
+			if _, err = fp.Seek(after, io.SeekStart); err != nil {
+				return errors.Wrapf(err, "")
+			}
+			pos = after
+		}
+		rd = fp
+	}
+	br := bufio.NewReader(rd)
+	if after >= 0 && path != Stdin {
+		// skip the line which has been committed
+		var line []byte
+		line, err = br.ReadBytes('\n')
+		pos += int64(len(line))
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "")
+		}
+	}
+	util.Logger.Info("reading file", zap.String("consumer group", f.grpConfig.Name), zap.String("file", path), zap.Int64("position", pos))
+
+	var eof bool
+	for !eof {
+		var blocked time.Duration
+		blocked, err = util.Rs.Wait(f.ctx)
+		if blocked > 0 {
+			statistics.BackpressureBlockedSeconds.WithLabelValues(f.grpConfig.Name).Add(blocked.Seconds())
+		}
+		if err != nil {
+			return context.Canceled
+		}
+		traceId := util.GenTraceId()
+		util.LogTrace(traceId, util.TraceKindFetchStart, zap.String("consumer group", f.grpConfig.Name), zap.Int("buffersize", f.grpConfig.MaxFetchSize))
+		now := time.Now()
+		msgs := make([]*model.InputMessage, 0, f.grpConfig.MaxFetchSize)
+		for len(msgs) < f.grpConfig.MaxFetchSize {
+			var line []byte
+			line, err = br.ReadBytes('\n')
+			begin := pos
+			pos += int64(len(line))
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return errors.Wrapf(err, "")
+			}
+			if line = bytes.TrimRight(line, "\r\n"); len(line) != 0 {
+				msgs = append(msgs, &model.InputMessage{
+					Topic:     f.topic,
+					Partition: partition,
+					Value:     line,
+					Offset:    begin,
+					Timestamp: &now,
+				})
+			}
+			if eof {
+				break
+			}
+		}
+		err = nil
+		if len(msgs) == 0 {
+			continue
+		}
+		util.Rs.Inc(int64(len(msgs)), MessagesBytes(msgs))
+		util.LogTrace(traceId, util.TraceKindFetchEnd, zap.String("consumer group", f.grpConfig.Name), zap.Int64("records", int64(len(msgs))))
+		select {
+		case f.fetch <- Fetches{TraceId: traceId, Messages: msgs}:
+		case <-f.ctx.Done():
+			return context.Canceled
+		}
+	}
+	return
+}
+
+func (f *FileInput) partitions() []int32 {
+	parts := make([]int32, len(f.files))
+	for i := range f.files {
+		parts[i] = int32(i)
+	}
+	return parts
+}
+
+// CommitMessages records the position of msg to the checkpoint file
+func (f *FileInput) CommitMessages(msg *model.InputMessage) (err error) {
+	ckFile := f.grpConfig.Input.CheckpointFile
+	if ckFile == "" || msg.Partition >= len(f.files) || f.files[msg.Partition] == Stdin {
+		return
+	}
+	f.ckMux.Lock()
+	defer f.ckMux.Unlock()
+	f.checkpoints[f.files[msg.Partition]] = msg.Offset
+	var b []byte
+	if b, err = json.Marshal(f.checkpoints); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	// write to a temporary file then rename, so that the checkpoint file is never partially written
+	tmpFile := ckFile + ".tmp"
+	if err = os.WriteFile(tmpFile, b, 0644); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	if err = os.Rename(tmpFile, ckFile); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	return
+}
+
+// Stop file input and close all files
+func (f *FileInput) Stop() {
+	f.cancel()
+
+	// prevent the block of f.Run
+	quit := make(chan struct{})
+	go func() {
+		select {
+		case <-f.fetch:
+		case <-quit:
+		}
+	}()
+
+	f.wgRun.Wait()
+	select {
+	case quit <- struct{}{}:
+	default:
+	}
+}
+
+// Description of this file input, consumer group name
+func (f *FileInput) Description() string {
+	return fmt.Sprint("file input of consumer group ", f.grpConfig.Name)
+}
@@ -0,0 +1,63 @@
+package input
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+func readAll(t *testing.T, gCfg *config.GroupConfig, num int) (msgs []*model.InputMessage, f *FileInput) {
+	fetch := make(chan Fetches)
+	f = NewFileInput()
+	require.Nil(t, f.Init(&config.Config{}, gCfg, fetch, func(map[string][]int32) {}, nil))
+	go f.Run()
+	for len(msgs) < num {
+		fetches := <-fetch
+		msgs = append(msgs, fetches.Messages...)
+		for _, msg := range fetches.Messages {
+			util.Rs.Dec(1, int64(len(msg.Value)))
+		}
+	}
+	return
+}
+
+func TestFileInput(t *testing.T) {
+	util.InitLogger([]string{"stdout"})
+	util.Rs.SetPoolSize(1 << 20)
+	dir := t.TempDir()
+	file1 := filepath.Join(dir, "1.ndjson")
+	file2 := filepath.Join(dir, "2.ndjson")
+	require.Nil(t, os.WriteFile(file1, []byte("{\"a\":1}\n\n{\"a\":2}\r\n{\"a\":3}"), 0644))
+	require.Nil(t, os.WriteFile(file2, []byte("{\"b\":1}\n"), 0644))
+	gCfg := &config.GroupConfig{
+		Name:         "test",
+		Topics:       []string{"topic1"},
+		MaxFetchSize: 2,
+		Input: config.InputConfig{
+			Type:           config.InputFile,
+			Files:          []string{file1, file2},
+			CheckpointFile: filepath.Join(dir, "checkpoint.json"),
+		},
+	}
+
+	msgs, f := readAll(t, gCfg, 4)
+	require.Equal(t, []string{`{"a":1}`, `{"a":2}`, `{"a":3}`, `{"b":1}`},
+		[]string{string(msgs[0].Value), string(msgs[1].Value), string(msgs[2].Value), string(msgs[3].Value)})
+	require.Equal(t, "topic1", msgs[0].Topic)
+	require.Equal(t, []int{0, 0, 0, 1}, []int{msgs[0].Partition, msgs[1].Partition, msgs[2].Partition, msgs[3].Partition})
+	require.Equal(t, []int64{0, 9, 18, 0}, []int64{msgs[0].Offset, msgs[1].Offset, msgs[2].Offset, msgs[3].Offset})
+	require.Nil(t, f.CommitMessages(msgs[1]))
+	f.Stop()
+
+	// resume after the committed line
+	msgs, f = readAll(t, gCfg, 2)
+	require.Equal(t, `{"a":3}`, string(msgs[0].Value))
+	require.Equal(t, `{"b":1}`, string(msgs[1].Value))
+	f.Stop()
+}
@@ -0,0 +1,78 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package input
+
+import (
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+// Fetches is a batch of messages polled from an input, messages of the same partition are in order
+type Fetches struct {
+	Messages []*model.InputMessage
+	TraceId  string
+}
+
+// MessagesBytes returns the total size of message values, which is accounted by util.Rs
+func MessagesBytes(msgs []*model.InputMessage) (bytes int64) {
+	for _, msg := range msgs {
+		bytes += int64(len(msg.Value))
+	}
+	return
+}
+
+// CleanupFn is called before partitions are revoked, it shall persist messages of the revoked partitions and commit them
+type CleanupFn func(revoked map[string][]int32)
+
+// OffsetsFn returns the offsets to resume consuming from for the assigned partitions
+type OffsetsFn func(assigned map[string][]int32) map[string]map[int32]int64
+
+// Inputer is the source of messages of a consumer group
+type Inputer interface {
+	// Init prepares the inputer, fetched messages are sent to f.
+	// cleanupFn is called before partitions are revoked, offsetsFn is optional.
+	Init(cfg *config.Config, gCfg *config.GroupConfig, f chan Fetches, cleanupFn CleanupFn, offsetsFn OffsetsFn) error
+	// Run is the main loop of fetching, it returns after Stop
+	Run()
+	// CommitMessages records the position of msg as consumed
+	CommitMessages(msg *model.InputMessage) error
+	Stop()
+	Description() string
+}
+
+// Pauser is implemented by inputers which are able to pause partitions without leaving the consumer group
+type Pauser interface {
+	// Pause stops fetching the partitions, they will be consumed from the given offsets once resumed.
+	// Messages fetched before Pause may still be delivered.
+	Pause(offsets map[string]map[int32]int64)
+	Resume(parts map[string][]int32)
+}
+
+// Completer is implemented by inputers which stop consuming at a bound, e.g. StopAt
+type Completer interface {
+	// Completed is closed once all assigned partitions reach the bound
+	Completed() <-chan struct{}
+}
+
+// NewInputer creates an inputer of the given type
+func NewInputer(typ string) Inputer {
+	switch typ {
+	case config.InputFile:
+		return NewFileInput()
+	default:
+		return NewKafkaFranz()
+	}
+}
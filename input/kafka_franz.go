@@ -19,6 +19,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -28,6 +29,7 @@ import (
 	krb5config "github.com/jcmturner/gokrb5/v8/config"
 	"github.com/jcmturner/gokrb5/v8/keytab"
 	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kadm"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"github.com/twmb/franz-go/pkg/sasl"
 	"github.com/twmb/franz-go/pkg/sasl/plain"
@@ -37,6 +39,7 @@ import (
 
 	"github.com/housepower/clickhouse_sinker/config"
 	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
 	"github.com/housepower/clickhouse_sinker/util"
 )
 
@@ -45,11 +48,18 @@ const (
 	CommitRetries  = 6
 	RetryBackoff   = 5 * time.Second
 	processTimeOut = 10
+	// stopAtGrace is how long after a timestamp StopAt the records before it are taken as all produced
+	stopAtGrace = 10 * time.Second
 )
 
-type Fetches struct {
-	Fetch   *kgo.Fetches
-	TraceId string
+// startApplied records the partitions whose StartFrom or StartOffsets have been applied since sinker starts
+var startApplied sync.Map
+
+type startKey struct {
+	group     string
+	start     string // StartFrom and StartOffsets, they are applied again once changed
+	topic     string
+	partition int32
 }
 
 // KafkaFranz implements input.Inputer
@@ -63,7 +73,29 @@ type KafkaFranz struct {
 	cancel     context.CancelFunc
 	wgRun      sync.WaitGroup
 	fetch      chan Fetches
-	cleanupFn  func()
+	cleanupFn  CleanupFn
+	offsetsFn  OffsetsFn
+	// handOffTimeout bounds how long a fetch blocks rebalances while the consumer is busy
+	handOffTimeout time.Duration
+
+	// StopAt bound, stopOffset is -1 if it's a timestamp
+	stopAt     bool
+	stopOffset int64
+	stopTs     time.Time
+	stopMux    sync.Mutex
+	assigned   map[string]map[int32]bool
+	stopped    map[string]map[int32]bool
+	// stopEnds are the offsets of the first records after a timestamp StopAt, resolved once it has passed.
+	// positions are the offsets to fetch next of the assigned partitions, if known.
+	stopEnds         map[string]map[int32]int64
+	positions        map[string]map[int32]int64
+	listOffsetsAfter func(ctx context.Context, millisecond int64, topics ...string) (kadm.ListedOffsets, error)
+	reachedAll       bool
+	completed        chan struct{}
+	complete         sync.Once
+	// cancelPoll wakes up Run once all partitions reached StopAt
+	cancelPoll context.CancelFunc
+	pollMux    sync.Mutex
 }
 
 // NewKafkaFranz get instance of kafka reader
@@ -71,23 +103,50 @@ func NewKafkaFranz() *KafkaFranz {
 	return &KafkaFranz{}
 }
 
-// Init Initialise the kafka instance with configuration
-func (k *KafkaFranz) Init(cfg *config.Config, gCfg *config.GroupConfig, f chan Fetches, cleanupFn func()) (err error) {
+// Init Initialise the kafka instance with configuration.
+// offsetsFn is optional, it returns the offsets to resume consuming from for the assigned partitions.
+func (k *KafkaFranz) Init(cfg *config.Config, gCfg *config.GroupConfig, f chan Fetches, cleanupFn CleanupFn, offsetsFn OffsetsFn) (err error) {
 	k.cfg = cfg
 	k.grpConfig = gCfg
 	k.ctx, k.cancel = context.WithCancel(context.Background())
 	k.fetch = f
 	k.cleanupFn = cleanupFn
+	k.offsetsFn = offsetsFn
+	k.assigned = make(map[string]map[int32]bool)
+	k.stopped = make(map[string]map[int32]bool)
+	k.stopEnds = make(map[string]map[int32]int64)
+	k.positions = make(map[string]map[int32]int64)
+	k.completed = make(chan struct{})
+	k.handOffTimeout = time.Duration(cfg.Kafka.Properties.RebalanceTimeout) * time.Millisecond / 4
+	if gCfg.StopAt != "" {
+		k.stopAt = true
+		if k.stopOffset, k.stopTs, err = config.ParseStopAt(gCfg.StopAt); err != nil {
+			return
+		}
+		for name := range gCfg.Configs {
+			statistics.TaskCompleted.WithLabelValues(name).Set(0)
+		}
+	}
 	kfkCfg := &cfg.Kafka
 	var opts []kgo.Opt
 	if opts, err = GetFranzConfig(kfkCfg); err != nil {
 		return
 	}
 	opts = append(opts,
-		kgo.ConsumeTopics(k.grpConfig.Topics...),
 		kgo.ConsumerGroup(k.grpConfig.Name),
 		kgo.DisableAutoCommit(),
 	)
+	if len(k.grpConfig.TopicPatterns) == 0 {
+		opts = append(opts, kgo.ConsumeTopics(k.grpConfig.Topics...))
+	} else {
+		// all topics are regexps once regex consuming is enabled, new topics matching them are picked up at metadata refreshing
+		patterns := make([]string, 0, len(k.grpConfig.Topics)+len(k.grpConfig.TopicPatterns))
+		for _, topic := range k.grpConfig.Topics {
+			patterns = append(patterns, "^"+regexp.QuoteMeta(topic)+"$")
+		}
+		patterns = append(patterns, k.grpConfig.TopicPatterns...)
+		opts = append(opts, kgo.ConsumeTopics(patterns...), kgo.ConsumeRegex())
+	}
 
 	maxPartBytes := int32(1 << (util.GetShift(100*k.grpConfig.MaxFetchSize) - 1))
 	//https://github.com/twmb/franz-go/blob/a09f0e71de43cd994fa774beaeb31bb05f9c34cc/pkg/kgo/config.go#L280
@@ -106,19 +165,39 @@ func (k *KafkaFranz) Init(cfg *config.Config, gCfg *config.GroupConfig, f chan F
 		kgo.BrokerMaxReadBytes(10*maxPartBytes),
 		kgo.OnPartitionsRevoked(k.onPartitionRevoked),
 		kgo.OnPartitionsAssigned(k.onPartitionAssigned),
+		// records handed over to the consumer are always processed before partitions get revoked, see handOff
+		kgo.BlockRebalanceOnPoll(),
 		kgo.RebalanceTimeout(time.Millisecond*time.Duration(cfg.Kafka.Properties.RebalanceTimeout)),
 		kgo.SessionTimeout(time.Millisecond*time.Duration(cfg.Kafka.Properties.SessionTimeout)),
 		kgo.HeartbeatInterval(time.Millisecond*time.Duration(cfg.Kafka.Properties.HeartbeatInterval)),
 		kgo.RequestTimeoutOverhead(time.Millisecond*time.Duration(cfg.Kafka.Properties.RequestTimeoutOverhead)),
 	)
+	if balancer := cfg.Kafka.Properties.PartitionAssignmentStrategy; balancer != "" {
+		var b kgo.GroupBalancer
+		switch balancer {
+		case config.AssignCooperativeSticky:
+			b = kgo.CooperativeStickyBalancer()
+		case config.AssignSticky:
+			b = kgo.StickyBalancer()
+		case config.AssignRange:
+			b = kgo.RangeBalancer()
+		case config.AssignRoundRobin:
+			b = kgo.RoundRobinBalancer()
+		}
+		opts = append(opts, kgo.Balancers(b))
+	}
 	if !k.grpConfig.Earliest {
 		opts = append(opts, kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()))
 	}
+	if k.offsetsFn != nil || k.grpConfig.StartFrom != "" || len(k.grpConfig.StartOffsets) != 0 || k.stopAt {
+		opts = append(opts, kgo.AdjustFetchOffsetsFn(k.adjustOffsets))
+	}
 
 	if k.cl, err = kgo.NewClient(opts...); err != nil {
 		err = errors.Wrapf(err, "")
 		return
 	}
+	k.listOffsetsAfter = kadm.NewClient(k.cl).ListOffsetsAfterMilli
 	return nil
 }
 
@@ -190,52 +269,304 @@ func GetFranzConfig(kfkCfg *config.KafkaConfig) (opts []kgo.Opt, err error) {
 func (k *KafkaFranz) Run() {
 	k.wgRun.Add(1)
 	defer k.wgRun.Done()
+	if k.stopAt && k.stopOffset < 0 {
+		if d := time.Until(k.stopTs.Add(stopAtGrace)); d > 0 {
+			t := time.AfterFunc(d, k.onStopTsPassed)
+			defer t.Stop()
+		}
+	}
 LOOP:
 	for {
-		if !util.Rs.Allow() {
-			select {
-			case <-k.ctx.Done():
-				break LOOP
-			default:
-			}
-			continue
+		// block until the record pool has room
+		blocked, err := util.Rs.Wait(k.ctx)
+		if blocked > 0 {
+			statistics.BackpressureBlockedSeconds.WithLabelValues(k.grpConfig.Name).Add(blocked.Seconds())
+		}
+		if err != nil {
+			break
+		}
+		pollCtx, cancelPoll := context.WithCancel(k.ctx)
+		k.pollMux.Lock()
+		k.cancelPoll = cancelPoll
+		k.pollMux.Unlock()
+		// it's checked after cancelPoll is set, otherwise the wakeup by markReached may be missed.
+		// The messages up to StopAt have been handed over to the consumer by now.
+		if k.isReachedAll() {
+			k.complete.Do(func() { close(k.completed) })
 		}
 		traceId := util.GenTraceId()
 		util.LogTrace(traceId, util.TraceKindFetchStart, zap.String("consumer group", k.grpConfig.Name), zap.Int("buffersize", k.grpConfig.MaxFetchSize))
-		fetches := k.cl.PollRecords(k.ctx, k.grpConfig.MaxFetchSize)
-		err := fetches.Err()
-		if fetches == nil || fetches.IsClientClosed() || errors.Is(err, context.Canceled) {
+		fetches := k.cl.PollRecords(pollCtx, k.grpConfig.MaxFetchSize)
+		cancelPoll()
+		err = fetches.Err()
+		if fetches == nil || fetches.IsClientClosed() || k.ctx.Err() != nil {
 			break
 		}
+		if errors.Is(err, context.Canceled) && fetches.NumRecords() == 0 {
+			// woken up by markReached
+			continue
+		}
 		if err != nil {
 			err = errors.Wrapf(err, "")
 			util.Logger.Info("kgo.Client.PollFetchs() got an error", zap.Error(err))
 		}
 		OnConsumerPoll(k.consumerId)
-		fetchRecords := fetches.NumRecords()
-		util.Rs.Inc(int64(fetchRecords))
+		msgs := k.toMessages(fetches)
+		fetchRecords := len(msgs)
+		util.Rs.Inc(int64(fetchRecords), MessagesBytes(msgs))
 		util.LogTrace(traceId, util.TraceKindFetchEnd, zap.String("consumer group", k.grpConfig.Name), zap.Int64("records", int64(fetchRecords)))
-		// Automatically end the program if it remains inactive for a specific duration of time.
-		timeout := processTimeOut * time.Minute
-		if processTimeOut < time.Duration(k.cfg.Kafka.Properties.RebalanceTimeout)*time.Millisecond {
-			timeout = time.Duration(k.cfg.Kafka.Properties.RebalanceTimeout) * time.Millisecond
+		if !k.handOff(traceId, msgs) {
+			break LOOP
 		}
-		t := time.NewTimer(timeout)
+	}
+	k.cl.Close() // will trigger k.onPartitionRevoked
+	util.Logger.Info("KafkaFranz.Run quit due to context has been canceled", zap.String("consumer group", k.grpConfig.Name))
+}
+
+// handOff sends the messages to the consumer, rebalances are blocked until then so that the consumer always processes them
+// before their partitions get revoked. If the consumer is still busy after handOffTimeout, e.g. flushing to a slow ClickHouse,
+// the messages are dropped and their partitions rewound, so that a pending rebalance isn't blocked up to rebalance.timeout.ms.
+// The rewound partitions are resumed once the consumer is ready. It returns false if the inputer is stopped.
+func (k *KafkaFranz) handOff(traceId string, msgs []*model.InputMessage) bool {
+	defer k.cl.AllowRebalance()
+	// Automatically end the program if it remains inactive for a specific duration of time.
+	timeout := processTimeOut * time.Minute
+	if processTimeOut < time.Duration(k.cfg.Kafka.Properties.RebalanceTimeout)*time.Millisecond {
+		timeout = time.Duration(k.cfg.Kafka.Properties.RebalanceTimeout) * time.Millisecond
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	h := time.NewTimer(k.handOffTimeout)
+	defer h.Stop()
+	fetches := Fetches{TraceId: traceId, Messages: msgs}
+	var rewound map[string][]int32
+	for {
 		select {
-		case k.fetch <- Fetches{
-			TraceId: traceId,
-			Fetch:   &fetches,
-		}:
-			t.Stop()
+		case k.fetch <- fetches:
+			if rewound != nil {
+				k.Resume(rewound)
+			}
+			return true
 		case <-k.ctx.Done():
-			t.Stop()
-			break LOOP
+			return false
+		case <-h.C:
+			if len(msgs) != 0 {
+				util.Logger.Warn("the consumer is busy, rewind the fetched partitions to let rebalances go on",
+					zap.String("consumer group", k.grpConfig.Name), zap.Duration("timeout", k.handOffTimeout))
+				rewound = k.rewind(msgs)
+				util.Rs.Dec(int64(len(msgs)), MessagesBytes(msgs))
+			}
+			k.cl.AllowRebalance()
+			// an empty fetch tells when the consumer is ready
+			fetches = Fetches{TraceId: traceId}
 		case <-t.C:
 			util.Logger.Fatal(fmt.Sprintf("Sinker abort because group %s was not processing in last %d minutes", k.grpConfig.Name, timeout/time.Minute))
 		}
 	}
-	k.cl.Close() // will trigger k.onPartitionRevoked
-	util.Logger.Info("KafkaFranz.Run quit due to context has been canceled", zap.String("consumer group", k.grpConfig.Name))
+}
+
+// rewind pauses the partitions of msgs and rewinds them to the first offsets of msgs, it returns the partitions
+func (k *KafkaFranz) rewind(msgs []*model.InputMessage) (parts map[string][]int32) {
+	from := make(map[string]map[int32]int64)
+	for _, msg := range msgs {
+		if from[msg.Topic] == nil {
+			from[msg.Topic] = make(map[int32]int64)
+		}
+		if off, ok := from[msg.Topic][int32(msg.Partition)]; !ok || msg.Offset < off {
+			from[msg.Topic][int32(msg.Partition)] = msg.Offset
+		}
+	}
+	parts = make(map[string][]int32, len(from))
+	k.stopMux.Lock()
+	for topic, offsets := range from {
+		for partition := range offsets {
+			parts[topic] = append(parts[topic], partition)
+			// it will reach StopAt again
+			if k.stopped[topic][partition] {
+				delete(k.stopped[topic], partition)
+				k.reachedAll = false
+			}
+		}
+	}
+	k.stopMux.Unlock()
+	k.Pause(from)
+	return
+}
+
+// toMessages converts the records, dropping the ones beyond StopAt
+func (k *KafkaFranz) toMessages(fetches kgo.Fetches) []*model.InputMessage {
+	msgs := make([]*model.InputMessage, 0, fetches.NumRecords())
+	var reached map[string][]int32
+	if k.stopAt {
+		k.stopMux.Lock()
+	}
+	fetches.EachRecord(func(rec *kgo.Record) {
+		if k.stopAt {
+			var beyond, done bool
+			if k.stopOffset >= 0 {
+				beyond, done = rec.Offset > k.stopOffset, rec.Offset >= k.stopOffset
+			} else if end, ok := k.stopEnds[rec.Topic][rec.Partition]; ok {
+				beyond, done = rec.Offset >= end, rec.Offset >= end-1
+			} else {
+				beyond = rec.Timestamp.After(k.stopTs)
+				done = beyond
+			}
+			if done {
+				if reached == nil {
+					reached = make(map[string][]int32)
+				}
+				reached[rec.Topic] = append(reached[rec.Topic], rec.Partition)
+			}
+			if beyond {
+				return
+			}
+			setOffset(k.positions, rec.Topic, rec.Partition, rec.Offset+1)
+		}
+		msg := &model.InputMessage{
+			Topic:     rec.Topic,
+			Partition: int(rec.Partition),
+			Key:       rec.Key,
+			Value:     rec.Value,
+			Offset:    rec.Offset,
+			Timestamp: &rec.Timestamp,
+		}
+		if len(rec.Headers) > 0 {
+			msg.Headers = make([]model.MsgHeader, 0, len(rec.Headers))
+			for _, h := range rec.Headers {
+				msg.Headers = append(msg.Headers, model.MsgHeader{Key: h.Key, Value: h.Value})
+			}
+		}
+		msgs = append(msgs, msg)
+	})
+	if k.stopAt {
+		k.stopMux.Unlock()
+	}
+	if reached != nil {
+		k.onStopAtReached(reached)
+	}
+	return msgs
+}
+
+// onStopAtReached pauses the partitions which reached StopAt
+func (k *KafkaFranz) onStopAtReached(reached map[string][]int32) {
+	k.cl.PauseFetchPartitions(reached)
+	k.markReached(reached)
+}
+
+// markReached records the partitions which reached StopAt, and wakes up Run once all assigned partitions do
+func (k *KafkaFranz) markReached(reached map[string][]int32) {
+	k.stopMux.Lock()
+	defer k.stopMux.Unlock()
+	for topic, parts := range reached {
+		if k.stopped[topic] == nil {
+			k.stopped[topic] = make(map[int32]bool)
+		}
+		for _, partition := range parts {
+			k.stopped[topic][partition] = true
+		}
+	}
+	for topic, parts := range k.assigned {
+		for partition := range parts {
+			if !k.stopped[topic][partition] {
+				return
+			}
+		}
+	}
+	if !k.reachedAll {
+		k.reachedAll = true
+		util.Logger.Info("all assigned partitions reached StopAt",
+			zap.String("consumer group", k.grpConfig.Name), zap.String("stopAt", k.grpConfig.StopAt))
+	}
+	k.pollMux.Lock()
+	if k.cancelPoll != nil {
+		k.cancelPoll()
+	}
+	k.pollMux.Unlock()
+}
+
+func (k *KafkaFranz) isReachedAll() bool {
+	k.stopMux.Lock()
+	defer k.stopMux.Unlock()
+	return k.reachedAll
+}
+
+// onStopTsPassed marks the assigned partitions which reached the timestamp StopAt once it has passed, including the idle ones
+func (k *KafkaFranz) onStopTsPassed() {
+	parts := make(map[string][]int32)
+	k.stopMux.Lock()
+	for topic, partitions := range k.assigned {
+		for partition := range partitions {
+			parts[topic] = append(parts[topic], partition)
+		}
+	}
+	k.stopMux.Unlock()
+	if reached := k.resolveStopEnds(parts); reached != nil {
+		k.onStopAtReached(reached)
+	}
+}
+
+// resolveStopEnds turns the timestamp StopAt into the end offsets of parts once it has passed, and returns the partitions
+// whose positions are already at their ends. An end is the offset of the first record after StopAt, or the log end offset
+// if there's none, so that a partition reaches StopAt even if nothing after it is produced.
+func (k *KafkaFranz) resolveStopEnds(parts map[string][]int32) (reached map[string][]int32) {
+	if !k.stopAt || k.stopOffset >= 0 || time.Now().Before(k.stopTs.Add(stopAtGrace)) {
+		return
+	}
+	var topics []string
+	k.stopMux.Lock()
+	for topic, partitions := range parts {
+		for _, partition := range partitions {
+			if _, ok := k.stopEnds[topic][partition]; !ok {
+				topics = append(topics, topic)
+				break
+			}
+		}
+	}
+	k.stopMux.Unlock()
+	if len(topics) != 0 {
+		// it may list a part of partitions along with an error
+		listed, err := k.listOffsetsAfter(k.ctx, k.stopTs.UnixMilli()+1, topics...)
+		if err != nil {
+			util.Logger.Warn("failed to list offsets after StopAt, the partitions not listed reach it by timestamps of records",
+				zap.String("consumer group", k.grpConfig.Name), zap.Error(err))
+		}
+		k.stopMux.Lock()
+		listed.Each(func(lo kadm.ListedOffset) {
+			if lo.Err == nil && lo.Offset >= 0 {
+				setOffset(k.stopEnds, lo.Topic, lo.Partition, lo.Offset)
+			}
+		})
+		k.stopMux.Unlock()
+	}
+	k.stopMux.Lock()
+	defer k.stopMux.Unlock()
+	for topic, partitions := range parts {
+		for _, partition := range partitions {
+			end, ok := k.stopEnds[topic][partition]
+			if !ok {
+				continue
+			}
+			if pos, ok := k.positions[topic][partition]; end == 0 || (ok && pos >= end) {
+				if reached == nil {
+					reached = make(map[string][]int32)
+				}
+				reached[topic] = append(reached[topic], partition)
+			}
+		}
+	}
+	return
+}
+
+func setOffset(m map[string]map[int32]int64, topic string, partition int32, offset int64) {
+	if m[topic] == nil {
+		m[topic] = make(map[int32]int64)
+	}
+	m[topic][partition] = offset
+}
+
+// Completed is closed once all assigned partitions reach StopAt, and the messages up to it have been sent to the consumer
+func (k *KafkaFranz) Completed() <-chan struct{} {
+	return k.completed
 }
 
 func (k *KafkaFranz) CommitMessages(msg *model.InputMessage) error {
@@ -258,6 +589,7 @@ func (k *KafkaFranz) CommitMessages(msg *model.InputMessage) error {
 // Stop kafka consumer and close all connections
 func (k *KafkaFranz) Stop() {
 	k.cancel()
+	Leave(k.consumerId)
 
 	// prevent the block of k.Run
 	quit := make(chan struct{})
@@ -280,15 +612,181 @@ func (k *KafkaFranz) Description() string {
 	return fmt.Sprint("kafka consumer group ", k.grpConfig.Name)
 }
 
-func (k *KafkaFranz) onPartitionRevoked(_ context.Context, _ *kgo.Client, _ map[string][]int32) {
+func (k *KafkaFranz) onPartitionRevoked(_ context.Context, _ *kgo.Client, revoked map[string][]int32) {
+	k.stopMux.Lock()
+	for topic, parts := range revoked {
+		for _, partition := range parts {
+			delete(k.assigned[topic], partition)
+			delete(k.positions[topic], partition)
+		}
+	}
+	k.stopMux.Unlock()
+	if len(revoked) == 0 {
+		// cooperative consumers get notified at the end of every session even though nothing is revoked
+		return
+	}
 	begin := time.Now()
-	k.cleanupFn()
+	k.cleanupFn(revoked)
 	util.Logger.Info("consumer group cleanup",
 		zap.String("consumer group", k.grpConfig.Name),
+		zap.Reflect("revoked", revoked),
 		zap.Duration("cost", time.Since(begin)))
 }
 
-func (k *KafkaFranz) onPartitionAssigned(_ context.Context, _ *kgo.Client, _ map[string][]int32) {
+// Pause stops fetching the partitions and rewinds them to the given offsets
+func (k *KafkaFranz) Pause(offsets map[string]map[int32]int64) {
+	parts := make(map[string][]int32, len(offsets))
+	epochOffsets := make(map[string]map[int32]kgo.EpochOffset, len(offsets))
+	for topic, partOffsets := range offsets {
+		epochOffsets[topic] = make(map[int32]kgo.EpochOffset, len(partOffsets))
+		for partition, offset := range partOffsets {
+			parts[topic] = append(parts[topic], partition)
+			epochOffsets[topic][partition] = kgo.EpochOffset{Epoch: -1, Offset: offset}
+		}
+	}
+	k.stopMux.Lock()
+	for topic, partOffsets := range offsets {
+		for partition, offset := range partOffsets {
+			setOffset(k.positions, topic, partition, offset)
+		}
+	}
+	k.stopMux.Unlock()
+	k.cl.PauseFetchPartitions(parts)
+	k.cl.SetOffsets(epochOffsets)
+	util.Logger.Info("paused partitions", zap.String("consumer group", k.grpConfig.Name), zap.Reflect("offsets", offsets))
+}
+
+// Resume continues fetching the partitions
+func (k *KafkaFranz) Resume(parts map[string][]int32) {
+	k.cl.ResumeFetchPartitions(parts)
+	util.Logger.Info("resumed partitions", zap.String("consumer group", k.grpConfig.Name), zap.Reflect("partitions", parts))
+}
+
+// applyStartFrom overrides the committed offsets with StartFrom and StartOffsets, once per partition since sinker starts.
+// It returns the partitions whose offsets are overridden.
+func (k *KafkaFranz) applyStartFrom(offsets map[string]map[int32]kgo.Offset) (started map[string]map[int32]bool) {
+	gCfg := k.grpConfig
+	if gCfg.StartFrom == "" && len(gCfg.StartOffsets) == 0 {
+		return
+	}
+	start := fmt.Sprintf("%s|%v", gCfg.StartFrom, gCfg.StartOffsets)
+	for topic, parts := range offsets {
+		for partition := range parts {
+			var offset kgo.Offset
+			if at, ok := gCfg.StartOffsets[topic][partition]; ok {
+				offset = kgo.NewOffset().At(at)
+			} else {
+				switch gCfg.StartFrom {
+				case "":
+					continue
+				case config.StartFromEarliest:
+					offset = kgo.NewOffset().AtStart()
+				case config.StartFromLatest:
+					offset = kgo.NewOffset().AtEnd()
+				default:
+					// validated by config
+					ts, _ := time.Parse(time.RFC3339, gCfg.StartFrom)
+					offset = kgo.NewOffset().AfterMilli(ts.UnixMilli())
+				}
+			}
+			if _, loaded := startApplied.LoadOrStore(startKey{gCfg.Name, start, topic, partition}, nil); loaded {
+				continue
+			}
+			offsets[topic][partition] = offset.WithEpoch(-1)
+			if started == nil {
+				started = make(map[string]map[int32]bool)
+			}
+			if started[topic] == nil {
+				started[topic] = make(map[int32]bool)
+			}
+			started[topic][partition] = true
+			util.Logger.Info("start from the given position",
+				zap.String("consumer group", gCfg.Name),
+				zap.String("topic", topic),
+				zap.Int32("partition", partition),
+				zap.String("offset", offset.String()))
+		}
+	}
+	return
+}
+
+// adjustOffsets applies StartFrom to partitions assigned for the first time, and moves the fetch position of the others forward
+// if the committed offset is behind the one given by offsetsFn. Partitions already beyond StopAt are marked as reached.
+func (k *KafkaFranz) adjustOffsets(_ context.Context, offsets map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+	var next map[string]map[int32]int64
+	if k.offsetsFn != nil {
+		assigned := make(map[string][]int32)
+		for topic, parts := range offsets {
+			for partition := range parts {
+				assigned[topic] = append(assigned[topic], partition)
+			}
+		}
+		// it also loads the offsets written by ExactlyOnce tasks, which skip the messages having been written wherever consuming starts
+		next = k.offsetsFn(assigned)
+	}
+	started := k.applyStartFrom(offsets)
+	for topic, parts := range next {
+		for partition, n := range parts {
+			cur, ok := offsets[topic][partition]
+			if !ok || started[topic][partition] || cur.EpochOffset().Offset >= n {
+				continue
+			}
+			offsets[topic][partition] = kgo.NewOffset().At(n).WithEpoch(-1)
+			util.Logger.Info("adjusted fetch offset",
+				zap.String("consumer group", k.grpConfig.Name),
+				zap.String("topic", topic),
+				zap.Int32("partition", partition),
+				zap.Int64("from", cur.EpochOffset().Offset),
+				zap.Int64("to", n))
+		}
+	}
+	if k.stopAt {
+		// e.g. partitions consumed up to StopAt by another member, nothing at StopAt will be fetched again
+		var beyond map[string][]int32
+		parts := make(map[string][]int32, len(offsets))
+		k.stopMux.Lock()
+		for topic, partOffsets := range offsets {
+			for partition, offset := range partOffsets {
+				parts[topic] = append(parts[topic], partition)
+				// relative offsets, e.g. the start or end of the log, are unknown positions
+				if at := offset.EpochOffset().Offset; at >= 0 {
+					setOffset(k.positions, topic, partition, at)
+				} else {
+					delete(k.positions[topic], partition)
+				}
+				if k.stopOffset >= 0 && offset.EpochOffset().Offset > k.stopOffset {
+					if beyond == nil {
+						beyond = make(map[string][]int32)
+					}
+					beyond[topic] = append(beyond[topic], partition)
+				}
+			}
+		}
+		k.stopMux.Unlock()
+		if k.stopOffset < 0 {
+			beyond = k.resolveStopEnds(parts)
+		}
+		if beyond != nil {
+			k.markReached(beyond)
+		}
+	}
+	return offsets, nil
+}
+
+func (k *KafkaFranz) onPartitionAssigned(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+	k.stopMux.Lock()
+	for topic, parts := range assigned {
+		if k.assigned[topic] == nil {
+			k.assigned[topic] = make(map[int32]bool)
+		}
+		for _, partition := range parts {
+			k.assigned[topic][partition] = true
+			if !k.stopped[topic][partition] {
+				k.reachedAll = false
+			}
+		}
+	}
+	k.stopMux.Unlock()
 	memberId, _ := k.cl.GroupMetadata()
 	k.consumerId = memberId
 	NewConsumerPoller(k.consumerId, k.grpConfig.Name, k.cl)
@@ -0,0 +1,222 @@
+package input
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+func newTestKafkaFranz(t *testing.T, gCfg *config.GroupConfig) *KafkaFranz {
+	util.InitLogger([]string{"stdout"})
+	k := NewKafkaFranz()
+	k.cfg = &config.Config{}
+	k.cfg.Kafka.Properties.RebalanceTimeout = 60000
+	k.grpConfig = gCfg
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	t.Cleanup(k.cancel)
+	k.fetch = make(chan Fetches)
+	k.handOffTimeout = time.Minute
+	k.assigned = make(map[string]map[int32]bool)
+	k.stopped = make(map[string]map[int32]bool)
+	k.stopEnds = make(map[string]map[int32]int64)
+	k.positions = make(map[string]map[int32]int64)
+	k.completed = make(chan struct{})
+	if gCfg.StopAt != "" {
+		var err error
+		k.stopAt = true
+		k.stopOffset, k.stopTs, err = config.ParseStopAt(gCfg.StopAt)
+		require.Nil(t, err)
+	}
+	// the client never connects, pausing partitions is local
+	cl, err := kgo.NewClient(kgo.SeedBrokers("127.0.0.1:1"))
+	require.Nil(t, err)
+	t.Cleanup(cl.Close)
+	k.cl = cl
+	t.Cleanup(func() { startApplied.Clear() })
+	return k
+}
+
+func committed(parts map[string][]int32, offset int64) map[string]map[int32]kgo.Offset {
+	offsets := make(map[string]map[int32]kgo.Offset)
+	for topic, partitions := range parts {
+		offsets[topic] = make(map[int32]kgo.Offset)
+		for _, partition := range partitions {
+			offsets[topic][partition] = kgo.NewOffset().At(offset)
+		}
+	}
+	return offsets
+}
+
+func TestApplyStartFromPerPartition(t *testing.T) {
+	k := newTestKafkaFranz(t, &config.GroupConfig{
+		Name:         "test_start_from_per_partition",
+		StartFrom:    config.StartFromEarliest,
+		StartOffsets: map[string]map[int32]int64{"topic2": {0: 100}},
+	})
+	offsets := committed(map[string][]int32{"topic1": {0}, "topic2": {0}}, 10)
+	started := k.applyStartFrom(offsets)
+	require.Equal(t, map[string]map[int32]bool{"topic1": {0: true}, "topic2": {0: true}}, started)
+	require.Equal(t, int64(-2), offsets["topic1"][0].EpochOffset().Offset)
+	require.Equal(t, int64(100), offsets["topic2"][0].EpochOffset().Offset)
+
+	// a partition assigned later still starts from the given position, the ones already started don't
+	offsets = committed(map[string][]int32{"topic1": {0, 1}, "topic2": {0, 1}}, 10)
+	started = k.applyStartFrom(offsets)
+	require.Equal(t, map[string]map[int32]bool{"topic1": {1: true}, "topic2": {1: true}}, started)
+	require.Equal(t, int64(10), offsets["topic1"][0].EpochOffset().Offset)
+	require.Equal(t, int64(-2), offsets["topic1"][1].EpochOffset().Offset)
+	require.Equal(t, int64(10), offsets["topic2"][0].EpochOffset().Offset)
+	require.Equal(t, int64(-2), offsets["topic2"][1].EpochOffset().Offset)
+}
+
+func TestAdjustOffsetsWithStartFrom(t *testing.T) {
+	k := newTestKafkaFranz(t, &config.GroupConfig{
+		Name:         "test_adjust_offsets_with_start_from",
+		StartOffsets: map[string]map[int32]int64{"topic1": {0: 5}},
+	})
+	var loaded map[string][]int32
+	k.offsetsFn = func(assigned map[string][]int32) map[string]map[int32]int64 {
+		loaded = assigned
+		return map[string]map[int32]int64{"topic1": {0: 50, 1: 50}}
+	}
+	offsets, err := k.adjustOffsets(context.Background(), committed(map[string][]int32{"topic1": {0, 1}}, 10))
+	require.Nil(t, err)
+	// the written offsets are loaded even though StartOffsets apply
+	slices.Sort(loaded["topic1"])
+	require.Equal(t, map[string][]int32{"topic1": {0, 1}}, loaded)
+	require.Equal(t, int64(5), offsets["topic1"][0].EpochOffset().Offset)
+	require.Equal(t, int64(50), offsets["topic1"][1].EpochOffset().Offset)
+}
+
+func TestStopAtCompleted(t *testing.T) {
+	k := newTestKafkaFranz(t, &config.GroupConfig{Name: "test_stop_at_completed", StopAt: "10"})
+	k.onPartitionAssigned(context.Background(), k.cl, map[string][]int32{"topic1": {0, 1}})
+	fetches := kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic: "topic1",
+		Partitions: []kgo.FetchPartition{{
+			Partition: 0,
+			Records: []*kgo.Record{
+				{Topic: "topic1", Partition: 0, Offset: 9},
+				{Topic: "topic1", Partition: 0, Offset: 10},
+				{Topic: "topic1", Partition: 0, Offset: 11},
+			},
+		}, {
+			Partition: 1,
+			Records:   []*kgo.Record{{Topic: "topic1", Partition: 1, Offset: 3}},
+		}},
+	}}}}
+	msgs := k.toMessages(fetches)
+	require.Len(t, msgs, 3)
+	require.Equal(t, int64(10), msgs[1].Offset)
+	require.Equal(t, int64(3), msgs[2].Offset)
+	require.False(t, k.isReachedAll())
+
+	// a partition assigned later is covered as well
+	k.onPartitionAssigned(context.Background(), k.cl, map[string][]int32{"topic2": {0}})
+	fetches = kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "topic1",
+		Partitions: []kgo.FetchPartition{{Partition: 1, Records: []*kgo.Record{{Topic: "topic1", Partition: 1, Offset: 10}}}},
+	}}}}
+	require.Len(t, k.toMessages(fetches), 1)
+	require.False(t, k.isReachedAll())
+
+	// the committed offset of topic2 partition 0 is beyond StopAt already
+	_, err := k.adjustOffsets(context.Background(), committed(map[string][]int32{"topic2": {0}}, 20))
+	require.Nil(t, err)
+	require.True(t, k.isReachedAll())
+
+	// Run closes Completed once the messages have been handed over
+	go k.Run()
+	select {
+	case <-k.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Completed isn't closed")
+	}
+	k.cancel()
+}
+
+func TestStopAtTimestamp(t *testing.T) {
+	k := newTestKafkaFranz(t, &config.GroupConfig{Name: "test_stop_at_timestamp", StopAt: "2020-01-01T00:00:00Z"})
+	ends := map[int32]int64{0: 5, 1: 0, 2: 8}
+	k.listOffsetsAfter = func(_ context.Context, millisecond int64, topics ...string) (kadm.ListedOffsets, error) {
+		require.Equal(t, k.stopTs.UnixMilli()+1, millisecond)
+		listed := kadm.ListedOffsets{}
+		for _, topic := range topics {
+			listed[topic] = make(map[int32]kadm.ListedOffset)
+			for partition, end := range ends {
+				listed[topic][partition] = kadm.ListedOffset{Topic: topic, Partition: partition, Offset: end}
+			}
+		}
+		return listed, nil
+	}
+	k.onPartitionAssigned(context.Background(), k.cl, map[string][]int32{"topic1": {0, 1, 2}})
+
+	// partition 1 is empty before StopAt, and partition 2 has been consumed up to StopAt, both are idle since then
+	_, err := k.adjustOffsets(context.Background(), committed(map[string][]int32{"topic1": {0, 1}}, 3))
+	require.Nil(t, err)
+	_, err = k.adjustOffsets(context.Background(), committed(map[string][]int32{"topic1": {2}}, 8))
+	require.Nil(t, err)
+	require.True(t, k.stopped["topic1"][1])
+	require.True(t, k.stopped["topic1"][2])
+	require.False(t, k.isReachedAll())
+
+	// records after StopAt are dropped by offset regardless of their timestamps
+	fetches := kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic: "topic1",
+		Partitions: []kgo.FetchPartition{{
+			Partition: 0,
+			Records: []*kgo.Record{
+				{Topic: "topic1", Partition: 0, Offset: 3},
+				{Topic: "topic1", Partition: 0, Offset: 4},
+				{Topic: "topic1", Partition: 0, Offset: 5},
+			},
+		}},
+	}}}}
+	require.Len(t, k.toMessages(fetches), 2)
+	require.True(t, k.isReachedAll())
+}
+
+func TestHandOff(t *testing.T) {
+	k := newTestKafkaFranz(t, &config.GroupConfig{Name: "test_hand_off", StopAt: "1"})
+	k.onPartitionAssigned(context.Background(), k.cl, map[string][]int32{"topic1": {0}})
+	msgs := []*model.InputMessage{
+		{Topic: "topic1", Partition: 0, Offset: 0, Value: []byte("{}")},
+		{Topic: "topic1", Partition: 0, Offset: 1, Value: []byte("{}")},
+	}
+	k.markReached(map[string][]int32{"topic1": {0}})
+	require.True(t, k.isReachedAll())
+
+	// the consumer takes the fetch in time
+	done := make(chan bool)
+	go func() { done <- k.handOff("trace1", msgs) }()
+	fetches := <-k.fetch
+	require.Equal(t, msgs, fetches.Messages)
+	require.True(t, <-done)
+
+	// the consumer is busy, the fetch is dropped to let rebalances go on
+	k.handOffTimeout = 10 * time.Millisecond
+	count, bytes := util.Rs.Get(), util.Rs.GetBytes()
+	util.Rs.Inc(int64(len(msgs)), MessagesBytes(msgs))
+	go func() { done <- k.handOff("trace2", msgs) }()
+	time.Sleep(100 * time.Millisecond)
+	fetches = <-k.fetch
+	require.Empty(t, fetches.Messages)
+	require.True(t, <-done)
+	require.Equal(t, count, util.Rs.Get())
+	require.Equal(t, bytes, util.Rs.GetBytes())
+	// the rewound partition will reach StopAt again
+	require.False(t, k.isReachedAll())
+
+	// it quits once stopped
+	k.cancel()
+	require.False(t, k.handOff("trace3", msgs))
+}
@@ -51,8 +51,9 @@ func Walk(maxPollInterval int) string {
 		if time.Since(poller.active) > time.Duration(maxPollInterval)*time.Millisecond {
 			util.Logger.Warn("consumer group expired", zap.String("consumerId", k.(string)), zap.String("consumerName", poller.consumerName))
 			consumerName = poller.consumerName
-			//poller.client.LeaveGroup()
-			Leave(k.(string))
+			// it's reported again if it still doesn't poll, a stopped consumer leaves by itself
+			poller.active = time.Now()
+			consumerPoller.Store(k, poller)
 		}
 		return true
 	})
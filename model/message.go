@@ -1,8 +1,14 @@
 package model
 
 import (
+	"math/big"
 	"sync"
 	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/chcol"
+	"github.com/shopspring/decimal"
+
+	"github.com/housepower/clickhouse_sinker/util"
 )
 
 // MsgWithMeta abstract messages
@@ -14,15 +20,134 @@ type InputMessage struct {
 	Value     []byte
 	Offset    int64
 	Timestamp *time.Time
+	Headers   []MsgHeader
+}
+
+// MsgHeader is a key-value pair attached to a message
+type MsgHeader struct {
+	Key   string
+	Value []byte
 }
 
 type Row []interface{}
 type Rows []*Row
 
+// EstimateSize estimates the bytes occupied by values of the row
+func (row *Row) EstimateSize() (size int64) {
+	for _, val := range *row {
+		size += estimateSize(val)
+	}
+	return
+}
+
+// estimateSize switches on the types of values produced by parsers, values of other types are accounted as a word
+func estimateSize(val interface{}) int64 {
+	const ifaceSize = 16
+	const sliceSize = 24
+	switch v := val.(type) {
+	case nil:
+		return ifaceSize
+	case string:
+		return ifaceSize + 16 + int64(len(v))
+	case []byte:
+		return ifaceSize + sliceSize + int64(len(v))
+	case time.Time:
+		return ifaceSize + 24
+	case int64, uint64, float64, int32, uint32, float32, int16, uint16, int8, uint8, bool:
+		return ifaceSize + 8
+	case decimal.Decimal:
+		return ifaceSize + 16 + bigIntSize(v.Coefficient())
+	case *big.Int:
+		return ifaceSize + bigIntSize(v)
+	case chcol.Variant:
+		return ifaceSize + 16 + estimateSize(v.Any())
+	case *OrderedMap:
+		if v == nil {
+			return ifaceSize
+		}
+		size := int64(ifaceSize + sliceSize + 48)
+		for key, value := range v.values {
+			// the key is held by both keys and values
+			size += 2*estimateSize(key) + estimateSize(value)
+		}
+		return size
+	case map[string]interface{}:
+		size := int64(ifaceSize + 48)
+		for key, value := range v {
+			size += 16 + int64(len(key)) + estimateSize(value)
+		}
+		return size
+	case []interface{}:
+		size := int64(ifaceSize + sliceSize)
+		for _, e := range v {
+			size += estimateSize(e)
+		}
+		return size
+	case []map[string]interface{}:
+		size := int64(ifaceSize + sliceSize)
+		for _, e := range v {
+			size += estimateSize(e) - ifaceSize + 8
+		}
+		return size
+	case []string:
+		size := int64(ifaceSize + sliceSize)
+		for _, e := range v {
+			size += 16 + int64(len(e))
+		}
+		return size
+	case []time.Time:
+		return ifaceSize + sliceSize + 24*int64(len(v))
+	case []decimal.Decimal:
+		size := int64(ifaceSize + sliceSize)
+		for _, e := range v {
+			size += 16 + bigIntSize(e.Coefficient())
+		}
+		return size
+	case []*big.Int:
+		size := int64(ifaceSize + sliceSize)
+		for _, e := range v {
+			size += bigIntSize(e)
+		}
+		return size
+	case []bool:
+		return ifaceSize + sliceSize + int64(len(v))
+	case []int8:
+		return ifaceSize + sliceSize + int64(len(v))
+	case []int16:
+		return ifaceSize + sliceSize + 2*int64(len(v))
+	case []uint16:
+		return ifaceSize + sliceSize + 2*int64(len(v))
+	case []int32:
+		return ifaceSize + sliceSize + 4*int64(len(v))
+	case []uint32:
+		return ifaceSize + sliceSize + 4*int64(len(v))
+	case []float32:
+		return ifaceSize + sliceSize + 4*int64(len(v))
+	case []int64:
+		return ifaceSize + sliceSize + 8*int64(len(v))
+	case []uint64:
+		return ifaceSize + sliceSize + 8*int64(len(v))
+	case []float64:
+		return ifaceSize + sliceSize + 8*int64(len(v))
+	default:
+		return ifaceSize + 8
+	}
+}
+
+// bigIntSize returns the bytes occupied by a big.Int and its words
+func bigIntSize(i *big.Int) int64 {
+	if i == nil {
+		return 8
+	}
+	return 8 + 32 + int64(len(i.Bits()))*8
+}
+
 type MsgRow struct {
 	Msg   *InputMessage
 	Row   *Row
 	Shard int
+	// Seq is the index of the row among those exploded from Msg. Only the first row accounts for the bytes of Msg.
+	Seq int
 }
 
 type Batch struct {
@@ -30,6 +155,14 @@ type Batch struct {
 	BatchIdx int64
 	GroupId  string
 	RealSize int
+	// Bytes is the estimated size of messages and rows, which is released from util.Rs and Budget once the batch is done
+	Bytes int64
+	// Budget is the memory budget of the task, nil means unlimited
+	Budget *util.RecordSize
+	// Offsets are the ranges of messages flushed with this batch, set only if the task is ExactlyOnce
+	Offsets RecordMap
+	// DedupToken is derived from the task, shard and offset ranges, so that a retried insert is discarded by ClickHouse
+	DedupToken string
 
 	Wg *sync.WaitGroup
 }
@@ -38,6 +171,14 @@ func (b *Batch) Size() int {
 	return len(*b.Rows)
 }
 
+// Release returns the records and bytes of the batch to the record pool and the budget of the task
+func (b *Batch) Release() {
+	util.Rs.Dec(int64(b.RealSize), b.Bytes)
+	if b.Budget != nil {
+		b.Budget.Dec(int64(b.RealSize), b.Bytes)
+	}
+}
+
 type BatchRange struct {
 	Begin int64
 	End   int64
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/chcol"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateSize(t *testing.T) {
+	om := NewOrderedMap()
+	om.Put("k", int64(1))
+	testCases := []struct {
+		name string
+		val  interface{}
+		size int64
+	}{
+		{"nil", nil, 16},
+		{"int64", int64(1), 24},
+		{"bool", true, 24},
+		{"string", "abc", 16 + 16 + 3},
+		{"bytes", []byte("abc"), 16 + 24 + 3},
+		{"time", time.Now(), 16 + 24},
+		{"decimal", decimal.NewFromInt(1), 16 + 16 + 8 + 32 + 8},
+		{"bigint", big.NewInt(1), 16 + 8 + 32 + 8},
+		{"variant", chcol.NewVariantWithType(int64(1), "Int64"), 16 + 16 + 24},
+		{"ordered map", om, 16 + 24 + 48 + 2*(16+16+1) + 24},
+		{"object", map[string]interface{}{"k": "v"}, 16 + 48 + 16 + 1 + 16 + 16 + 1},
+		{"array", []interface{}{int64(1), nil}, 16 + 24 + 24 + 16},
+		{"array of objects", []map[string]interface{}{{"k": int64(1)}}, 16 + 24 + 8 + 48 + 16 + 1 + 24},
+		{"array of strings", []string{"a", "bc"}, 16 + 24 + 16 + 1 + 16 + 2},
+		{"array of int8", []int8{1, 2}, 16 + 24 + 2},
+		{"array of int32", []int32{1, 2}, 16 + 24 + 8},
+		{"array of float64", []float64{1, 2}, 16 + 24 + 16},
+		{"array of time", []time.Time{{}, {}}, 16 + 24 + 48},
+		{"array of bigint", []*big.Int{big.NewInt(1), nil}, 16 + 24 + 8 + 32 + 8 + 8},
+		{"unknown", struct{ a, b int64 }{}, 16 + 8},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.size, estimateSize(tc.val), tc.name)
+	}
+
+	row := Row{int64(1), "abc", []int64{1, 2}}
+	require.Equal(t, int64(24+35+16+24+16), row.EstimateSize())
+}
@@ -36,13 +36,27 @@ type Metric interface {
 	GetFloat64(key string, nullable bool) (val interface{})
 	GetDecimal(key string, nullable bool) (val interface{})
 	GetDateTime(key string, nullable bool) (val interface{})
+	// GetTime returns a value of Date, Date32, DateTime or DateTime64 column typeinfo.
+	// Unlike GetDateTime, it respects the precision, timezone and range of the column.
+	GetTime(key string, typeinfo *TypeInfo) (val interface{})
+	// GetBigInt returns a value of Int128, Int256, UInt128 or UInt256 column typeinfo as *big.Int
+	GetBigInt(key string, typeinfo *TypeInfo) (val interface{})
 	GetString(key string, nullable bool) (val interface{})
 	GetObject(key string, nullable bool) (val interface{})
 	GetMap(key string, typeinfo *TypeInfo) (val interface{})
-	GetArray(key string, t int) (val interface{})
+	// GetTuple returns a Tuple as []interface{}
+	GetTuple(key string, typeinfo *TypeInfo) (val interface{})
+	// GetArray returns an array of typeinfo, it's a typed slice such as []int64 for arrays of basic types, otherwise []interface{}
+	GetArray(key string, typeinfo *TypeInfo) (val interface{})
+	// GetJSON returns the object of a JSON column as its text, which ClickHouse parses
+	GetJSON(key string, nullable bool) (val interface{})
+	// GetVariant returns a value of Variant or Dynamic column typeinfo, it's nil for nulls and values no Variant member accepts
+	GetVariant(key string, typeinfo *TypeInfo) (val interface{})
 	GetIPv4(key string, nullable bool) (val interface{})
 	GetIPv6(key string, nullable bool) (val interface{})
 	GetNewKeys(knownKeys, newKeys, warnKeys *sync.Map, white, black *regexp.Regexp, partition int, offset int64) bool
+	// GetRest returns the top-level members whose keys aren't in columns, and pass white and black lists, as the text of a JSON object
+	GetRest(columns map[string]struct{}, white, black *regexp.Regexp) (val interface{})
 }
 
 // DimMetrics
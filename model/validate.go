@@ -0,0 +1,191 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package model
+
+import (
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+// what to do with values longer than FixedString(N)
+const (
+	FixedStringReject   = "reject"
+	FixedStringTruncate = "truncate"
+)
+
+// how Decimal values with more fractional digits than the scale are rounded
+const (
+	RoundTruncate = "truncate"  // towards zero, which is what clickhouse-go does
+	RoundHalfUp   = "half_up"   // half away from zero
+	RoundHalfEven = "half_even" // half to even
+	RoundReject   = "reject"
+)
+
+// ZeroUUID is the value of UUID columns whose fields are absent
+const ZeroUUID = "00000000-0000-0000-0000-000000000000"
+
+// Validator checks values against the constraints of column types, which would otherwise fail appending rows to batches,
+// i.e. Enum values, FixedString lengths, Decimal precisions and UUID syntax.
+type Validator struct {
+	FixedString     string // one of FixedString*, empty means FixedStringReject
+	DecimalRounding string // one of Round*, empty means RoundTruncate
+}
+
+// Constrained reports whether values of the type, or its elements, are subject to Validator
+func (ti *TypeInfo) Constrained() bool {
+	if ti.Enum != nil || ti.Length > 0 || ti.UUID || (ti.Type == Decimal && ti.Precision > 0) {
+		return true
+	}
+	if ti.Array {
+		return ti.ElemType().Constrained()
+	}
+	if ti.Type == Map {
+		return ti.MapKey.Constrained() || ti.MapValue.Constrained()
+	}
+	for _, typ := range ti.TupleTypes {
+		if typ.Constrained() {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns val, a value of typeinfo got by GetValueByType, adjusted to fit typeinfo.
+// Enum values given as numbers are replaced with the names, and absent UUIDs with ZeroUUID.
+func (v *Validator) Validate(val interface{}, typeinfo *TypeInfo) (_ interface{}, err error) {
+	switch x := val.(type) {
+	case string:
+		if !typeinfo.Array && typeinfo.Type == String {
+			return v.validateString(x, typeinfo)
+		}
+	case decimal.Decimal:
+		if !typeinfo.Array && typeinfo.Type == Decimal {
+			return v.validateDecimal(x, typeinfo)
+		}
+	case []string:
+		elem := typeinfo.ElemType()
+		arr := make([]string, len(x))
+		for i, e := range x {
+			if arr[i], err = v.validateString(e, elem); err != nil {
+				return
+			}
+		}
+		return arr, nil
+	case []decimal.Decimal:
+		elem := typeinfo.ElemType()
+		arr := make([]decimal.Decimal, len(x))
+		for i, e := range x {
+			if arr[i], err = v.validateDecimal(e, elem); err != nil {
+				return
+			}
+		}
+		return arr, nil
+	case []interface{}:
+		arr := make([]interface{}, len(x))
+		elem := typeinfo.ElemType()
+		for i, e := range x {
+			typ := elem
+			if !typeinfo.Array {
+				// elements of Tuple
+				if typeinfo.Type != Tuple || i >= len(typeinfo.TupleTypes) {
+					return val, nil
+				}
+				typ = typeinfo.TupleTypes[i]
+			}
+			if arr[i], err = v.Validate(e, typ); err != nil {
+				return
+			}
+		}
+		return arr, nil
+	case *OrderedMap:
+		if typeinfo.Type != Map {
+			break
+		}
+		m := NewOrderedMap()
+		for _, k := range x.keys {
+			var key, value interface{}
+			if key, err = v.Validate(k, typeinfo.MapKey); err != nil {
+				return
+			}
+			if value, err = v.Validate(x.values[k], typeinfo.MapValue); err != nil {
+				return
+			}
+			m.Put(key, value)
+		}
+		return m, nil
+	}
+	return val, nil
+}
+
+func (v *Validator) validateString(s string, typeinfo *TypeInfo) (string, error) {
+	switch {
+	case typeinfo.Enum != nil:
+		if _, ok := typeinfo.Enum[s]; ok {
+			return s, nil
+		}
+		if n, err := strconv.Atoi(s); err == nil {
+			for name, value := range typeinfo.Enum {
+				if value == n {
+					return name, nil
+				}
+			}
+		}
+		return s, errors.Newf("%q isn't an element of Enum", s)
+	case typeinfo.Length > 0:
+		if len(s) > typeinfo.Length {
+			if v.FixedString != FixedStringTruncate {
+				return s, errors.Newf("%q is longer than FixedString(%d)", s, typeinfo.Length)
+			}
+			s = s[:typeinfo.Length]
+		}
+	case typeinfo.UUID:
+		if s == "" {
+			return ZeroUUID, nil
+		}
+		if _, err := uuid.Parse(s); err != nil {
+			return s, errors.Wrapf(err, "%q isn't a UUID", s)
+		}
+	}
+	return s, nil
+}
+
+func (v *Validator) validateDecimal(d decimal.Decimal, typeinfo *TypeInfo) (decimal.Decimal, error) {
+	if typeinfo.Precision == 0 {
+		// not parsed by WhichType
+		return d, nil
+	}
+	scale := int32(typeinfo.Scale)
+	if r := d.Truncate(scale); !r.Equal(d) {
+		switch v.DecimalRounding {
+		case RoundHalfUp:
+			d = d.Round(scale)
+		case RoundHalfEven:
+			d = d.RoundBank(scale)
+		case RoundReject:
+			return d, errors.Newf("%s has more than %d fractional digits", d, scale)
+		default:
+			d = r
+		}
+	}
+	// the integral part has at most precision-scale digits
+	if d.Abs().GreaterThanOrEqual(decimal.New(1, int32(typeinfo.Precision)-scale)) {
+		return d, errors.Newf("%s overflows Decimal(%d, %d)", d, typeinfo.Precision, scale)
+	}
+	return d, nil
+}
@@ -18,9 +18,12 @@ package model
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/housepower/clickhouse_sinker/util"
+	"go.uber.org/zap"
 )
 
 const (
@@ -43,21 +46,92 @@ const (
 	Map
 	IPv4
 	IPv6
+	Tuple
+	Int128
+	Int256
+	UInt128
+	UInt256
+	JSON
+	Variant
+	Dynamic
 )
 
 type TypeInfo struct {
 	Type     int
 	Nullable bool
 	Array    bool
+	// Elem is the type of array elements, such as Array(String) of Array(Array(String)).
+	// Other properties of an array are copied from Elem, so that Type of Array(T) is the one of T.
+	Elem     *TypeInfo
 	MapKey   *TypeInfo
 	MapValue *TypeInfo
+	// element names and types of Tuple, names are empty for unnamed tuples.
+	// Nested(a T1, b T2) is Array(Tuple(a T1, b T2)).
+	TupleNames []string
+	TupleTypes []*TypeInfo
+	// member names and types of Variant, the names are the ones the driver selects members with.
+	VariantNames []string
+	VariantTypes []*TypeInfo
+	// Precision is the digits of fractional seconds of DateTime64, it's 0 for Date and DateTime.
+	// Location is the timezone declared by DateTime and DateTime64, nil means the task's timezone.
+	Precision        int
+	Location         *time.Location
+	minTime, maxTime time.Time
+	// Precision and Scale are also the total and fractional digits of Decimal.
+	Scale int
+	// constraints of String values, see Validator: names to values of Enum8 and Enum16, the length of FixedString, and UUID.
+	Enum   map[string]int
+	Length int
+	UUID   bool
 }
 
 var (
 	typeInfo             map[string]*TypeInfo
 	lowCardinalityRegexp = regexp.MustCompile(`^LowCardinality\((.+)\)`)
+
+	// ranges of values accepted by clickhouse-go
+	minDateTime   = time.Unix(0, 0).UTC()
+	maxDate       = time.Date(2106, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxDateTime   = time.Date(2105, 12, 31, 23, 59, 59, 0, time.UTC)
+	minDate32     = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxDate32     = time.Date(2299, 12, 31, 0, 0, 0, 0, time.UTC)
+	maxDateTime64 = time.Date(2262, 4, 11, 23, 47, 16, 0, time.UTC)
 )
 
+// ElemType returns the type of array elements, it's derived from the array if Elem isn't set.
+func (ti *TypeInfo) ElemType() *TypeInfo {
+	if ti.Elem != nil || !ti.Array {
+		return ti.Elem
+	}
+	elem := *ti
+	elem.Array = false
+	return &elem
+}
+
+// IsBasic reports whether the type is a non-nullable scalar, i.e. neither Nullable, Array, Map, Tuple nor a semi-structured one
+func (ti *TypeInfo) IsBasic() bool {
+	switch ti.Type {
+	case Map, Tuple, JSON, Variant, Dynamic:
+		return false
+	}
+	return !ti.Nullable && !ti.Array
+}
+
+// arrayOf returns the type of arrays of elem
+func arrayOf(elem *TypeInfo) *TypeInfo {
+	ti := *elem
+	ti.Nullable, ti.Array, ti.Elem = false, true, elem
+	return &ti
+}
+
+// TimeRange returns the range of Date, Date32, DateTime and DateTime64 values, it's the one of DateTime if the type isn't parsed by WhichType.
+func (ti *TypeInfo) TimeRange() (min, max time.Time) {
+	if ti.maxTime.IsZero() {
+		return minDateTime, maxDateTime
+	}
+	return ti.minTime, ti.maxTime
+}
+
 // GetTypeName returns the column type in ClickHouse
 func GetTypeName(typ int) (name string) {
 	switch typ {
@@ -97,6 +171,22 @@ func GetTypeName(typ int) (name string) {
 		name = "IPv4"
 	case IPv6:
 		name = "IPv6"
+	case Tuple:
+		name = "Tuple"
+	case Int128:
+		name = "Int128"
+	case Int256:
+		name = "Int256"
+	case UInt128:
+		name = "UInt128"
+	case UInt256:
+		name = "UInt256"
+	case JSON:
+		name = "JSON"
+	case Variant:
+		name = "Variant"
+	case Dynamic:
+		name = "Dynamic"
 	default:
 		name = "Unknown"
 	}
@@ -106,7 +196,9 @@ func GetTypeName(typ int) (name string) {
 func GetValueByType(metric Metric, cwt *ColumnWithType) (val interface{}) {
 	name := cwt.SourceName
 	if cwt.Type.Array {
-		val = metric.GetArray(name, cwt.Type.Type)
+		val = metric.GetArray(name, cwt.Type)
+	} else if cwt.Type.Type == Tuple {
+		val = metric.GetTuple(name, cwt.Type)
 	} else {
 		switch cwt.Type.Type {
 		case Bool:
@@ -134,7 +226,7 @@ func GetValueByType(metric Metric, cwt *ColumnWithType) (val interface{}) {
 		case Decimal:
 			val = metric.GetDecimal(name, cwt.Type.Nullable)
 		case DateTime:
-			val = metric.GetDateTime(name, cwt.Type.Nullable)
+			val = metric.GetTime(name, cwt.Type)
 		case String:
 			val = metric.GetString(name, cwt.Type.Nullable)
 		case Map:
@@ -145,6 +237,12 @@ func GetValueByType(metric Metric, cwt *ColumnWithType) (val interface{}) {
 			val = metric.GetIPv4(name, cwt.Type.Nullable)
 		case IPv6:
 			val = metric.GetIPv6(name, cwt.Type.Nullable)
+		case Int128, Int256, UInt128, UInt256:
+			val = metric.GetBigInt(name, cwt.Type)
+		case JSON:
+			val = metric.GetJSON(name, cwt.Type.Nullable)
+		case Variant, Dynamic:
+			val = metric.GetVariant(name, cwt.Type)
 		default:
 			util.Logger.Fatal("LOGIC ERROR: reached switch default condition")
 		}
@@ -160,58 +258,246 @@ func WhichType(typ string) (ti *TypeInfo) {
 		return ti
 	}
 	origTyp := typ
+	if strings.HasPrefix(typ, "Array(") {
+		ti = arrayOf(WhichType(typ[len("Array(") : len(typ)-1]))
+		typeInfo[origTyp] = ti
+		return ti
+	} else if strings.HasPrefix(typ, "Nested(") {
+		// Nested(a T1, b T2) is Array(Tuple(a T1, b T2))
+		ti = arrayOf(WhichType("Tuple(" + typ[len("Nested("):]))
+		typeInfo[origTyp] = ti
+		return ti
+	}
 	nullable := strings.HasPrefix(typ, "Nullable(")
-	array := strings.HasPrefix(typ, "Array(")
 	var dataType int
 	if nullable {
 		typ = typ[len("Nullable(") : len(typ)-1]
-	} else if array {
-		typ = typ[len("Array(") : len(typ)-1]
 	}
-	if strings.HasPrefix(typ, "DateTime64") {
-		dataType = DateTime
+	if strings.HasPrefix(typ, "DateTime64(") || strings.HasPrefix(typ, "DateTime(") {
+		ti = &TypeInfo{Type: DateTime, Nullable: nullable, minTime: minDateTime, maxTime: maxDateTime}
+		args := splitTypeArgs(typ[strings.IndexByte(typ, '(')+1 : len(typ)-1])
+		if strings.HasPrefix(typ, "DateTime64(") {
+			if len(args) == 0 {
+				util.Logger.Fatal(fmt.Sprintf("ClickHouse column type %v has no precision", origTyp))
+			}
+			var err error
+			if ti.Precision, err = strconv.Atoi(args[0]); err != nil || ti.Precision < 0 || ti.Precision > 9 {
+				util.Logger.Fatal(fmt.Sprintf("ClickHouse column type %v has an invalid precision", origTyp))
+			}
+			ti.minTime, ti.maxTime = minDate32, maxDateTime64
+			args = args[1:]
+		}
+		if len(args) != 0 {
+			tz := strings.Trim(args[0], "'")
+			if loc, err := time.LoadLocation(tz); err != nil {
+				util.Logger.Warn("unknown timezone of column type, the task's timezone is used instead", zap.String("type", origTyp), zap.Error(err))
+			} else {
+				ti.Location = loc
+			}
+		}
+		typeInfo[origTyp] = ti
+		return ti
+	} else if typ == "JSON" || strings.HasPrefix(typ, "JSON(") {
+		// type hints and settings of paths, e.g. JSON(max_dynamic_paths=16, a.b UInt32, SKIP a.c), are left to ClickHouse
+		dataType = JSON
+	} else if typ == "Dynamic" || strings.HasPrefix(typ, "Dynamic(") {
+		dataType = Dynamic
+	} else if strings.HasPrefix(typ, "Variant(") {
+		ti = &TypeInfo{Type: Variant, Nullable: nullable}
+		for _, arg := range splitTypeArgs(typ[len("Variant(") : len(typ)-1]) {
+			ti.VariantNames = append(ti.VariantNames, arg)
+			ti.VariantTypes = append(ti.VariantTypes, WhichType(arg))
+		}
+		typeInfo[origTyp] = ti
+		return ti
 	} else if strings.HasPrefix(typ, "Decimal") {
-		dataType = Decimal
-	} else if strings.HasPrefix(typ, "FixedString") {
-		dataType = String
-	} else if strings.HasPrefix(typ, "Enum8(") {
-		dataType = String
-	} else if strings.HasPrefix(typ, "Enum16(") {
-		dataType = String
-	} else if strings.HasPrefix(typ, "Map") {
-		dataType = Map
-		idx := strings.Index(typ, ", ")
+		ti = &TypeInfo{Type: Decimal, Nullable: nullable}
+		var ok bool
+		if ti.Precision, ti.Scale, ok = parseDecimal(typ); !ok {
+			util.Logger.Fatal(fmt.Sprintf("ClickHouse column type %v is not a valid Decimal", origTyp))
+		}
+		typeInfo[origTyp] = ti
+		return ti
+	} else if strings.HasPrefix(typ, "FixedString(") {
+		ti = &TypeInfo{Type: String, Nullable: nullable}
+		var err error
+		if ti.Length, err = strconv.Atoi(strings.TrimSpace(typ[len("FixedString(") : len(typ)-1])); err != nil || ti.Length <= 0 {
+			util.Logger.Fatal(fmt.Sprintf("ClickHouse column type %v is not a valid FixedString", origTyp))
+		}
+		typeInfo[origTyp] = ti
+		return ti
+	} else if strings.HasPrefix(typ, "Enum8(") || strings.HasPrefix(typ, "Enum16(") {
+		ti = &TypeInfo{Type: String, Nullable: nullable}
+		var ok bool
+		if ti.Enum, ok = parseEnum(splitTypeArgs(typ[strings.IndexByte(typ, '(')+1 : len(typ)-1])); !ok {
+			util.Logger.Fatal(fmt.Sprintf("ClickHouse column type %v is not a valid Enum", origTyp))
+		}
+		typeInfo[origTyp] = ti
+		return ti
+	} else if strings.HasPrefix(typ, "Map(") {
+		args := splitTypeArgs(typ[len("Map(") : len(typ)-1])
+		if len(args) != 2 {
+			util.Logger.Fatal(fmt.Sprintf("ClickHouse column type %v is not a valid Map", origTyp))
+		}
 		ti = &TypeInfo{
-			Type:     dataType,
+			Type:     Map,
 			Nullable: nullable,
-			Array:    array,
-			MapKey:   WhichType(typ[len("Map("):idx]),
-			MapValue: WhichType(typ[idx+2 : len(typ)-1]),
+			MapKey:   WhichType(args[0]),
+			MapValue: WhichType(args[1]),
+		}
+		typeInfo[origTyp] = ti
+		return ti
+	} else if strings.HasPrefix(typ, "Tuple(") {
+		ti = &TypeInfo{Type: Tuple, Nullable: nullable}
+		args := splitTypeArgs(typ[strings.IndexByte(typ, '(')+1 : len(typ)-1])
+		for _, arg := range args {
+			name, elemTyp := splitTupleElement(arg)
+			if name != "" {
+				ti.TupleNames = append(ti.TupleNames, name)
+			}
+			ti.TupleTypes = append(ti.TupleTypes, WhichType(elemTyp))
+		}
+		if len(ti.TupleNames) != 0 && len(ti.TupleNames) != len(ti.TupleTypes) {
+			util.Logger.Fatal(fmt.Sprintf("ClickHouse column type %v mixes named and unnamed elements", origTyp))
 		}
 		typeInfo[origTyp] = ti
 		return ti
 	} else {
 		util.Logger.Fatal(fmt.Sprintf("ClickHouse column type %v is not inside supported ones(case-sensitive): %v", origTyp, typeInfo))
 	}
-	ti = &TypeInfo{Type: dataType, Nullable: nullable, Array: array}
+	ti = &TypeInfo{Type: dataType, Nullable: nullable}
 	typeInfo[origTyp] = ti
 	return ti
 }
 
+// splitTypeArgs splits the arguments of a parametric type, e.g. "a String, b Map(String, Int64)", by top-level commas
+func splitTypeArgs(s string) (args []string) {
+	var depth, start int
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '`' || c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if arg := strings.TrimSpace(s[start:]); arg != "" {
+		args = append(args, arg)
+	}
+	return
+}
+
+// decimalPrecisions are the precisions of Decimal32(S), Decimal64(S), Decimal128(S) and Decimal256(S)
+var decimalPrecisions = map[string]int{"Decimal32": 9, "Decimal64": 18, "Decimal128": 38, "Decimal256": 76}
+
+// parseDecimal parses the precision and scale of Decimal(P, S), Decimal(P), Decimal32(S) and so on
+func parseDecimal(typ string) (precision, scale int, ok bool) {
+	i := strings.IndexByte(typ, '(')
+	if i < 0 || !strings.HasSuffix(typ, ")") {
+		return
+	}
+	args := splitTypeArgs(typ[i+1 : len(typ)-1])
+	var err error
+	if p, fixed := decimalPrecisions[typ[:i]]; fixed {
+		if len(args) != 1 {
+			return
+		}
+		precision = p
+		scale, err = strconv.Atoi(args[0])
+	} else if typ[:i] == "Decimal" && (len(args) == 1 || len(args) == 2) {
+		if precision, err = strconv.Atoi(args[0]); err == nil && len(args) == 2 {
+			scale, err = strconv.Atoi(args[1])
+		}
+	} else {
+		return
+	}
+	ok = err == nil && precision > 0 && precision <= 76 && scale >= 0 && scale <= precision
+	return
+}
+
+// parseEnum parses the elements of Enum8 and Enum16, e.g. 'a' = 1, 'b' = 2. Omitted values follow the previous one, starting from 1.
+func parseEnum(args []string) (enum map[string]int, ok bool) {
+	enum = make(map[string]int, len(args))
+	next := 1
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "'") {
+			return
+		}
+		var name strings.Builder
+		end := -1
+		for i := 1; i < len(arg); i++ {
+			if arg[i] == '\\' && i+1 < len(arg) {
+				i++
+			} else if arg[i] == '\'' {
+				end = i
+				break
+			}
+			name.WriteByte(arg[i])
+		}
+		if end < 0 {
+			return
+		}
+		value := next
+		if rest := strings.TrimSpace(arg[end+1:]); rest != "" {
+			var err error
+			if !strings.HasPrefix(rest, "=") {
+				return
+			}
+			if value, err = strconv.Atoi(strings.TrimSpace(rest[1:])); err != nil {
+				return
+			}
+		}
+		enum[name.String()] = value
+		next = value + 1
+	}
+	return enum, len(enum) != 0
+}
+
+// splitTupleElement splits a tuple element into the name, which is empty for unnamed ones, and the type
+func splitTupleElement(arg string) (name, typ string) {
+	if strings.HasPrefix(arg, "`") {
+		if end := strings.IndexByte(arg[1:], '`'); end >= 0 {
+			return arg[1 : end+1], strings.TrimSpace(arg[end+2:])
+		}
+	}
+	// a space before any parenthesis separates the name and the type
+	if i := strings.IndexByte(arg, ' '); i > 0 && !strings.ContainsAny(arg[:i], "(,") {
+		return arg[:i], strings.TrimSpace(arg[i+1:])
+	}
+	return "", arg
+}
+
 func init() {
 	typeInfo = make(map[string]*TypeInfo)
-	for _, t := range []int{Bool, Int8, Int16, Int32, Int64, UInt8, UInt16, UInt32, UInt64, Float32, Float64, DateTime, String, Object, IPv4, IPv6} {
+	for _, t := range []int{Bool, Int8, Int16, Int32, Int64, UInt8, UInt16, UInt32, UInt64, Float32, Float64, DateTime, String, Object, IPv4, IPv6,
+		Int128, Int256, UInt128, UInt256} {
 		tn := GetTypeName(t)
 		typeInfo[tn] = &TypeInfo{Type: t}
 		nullTn := fmt.Sprintf("Nullable(%s)", tn)
 		typeInfo[nullTn] = &TypeInfo{Type: t, Nullable: true}
 		arrTn := fmt.Sprintf("Array(%s)", tn)
-		typeInfo[arrTn] = &TypeInfo{Type: t, Array: true}
-	}
-	typeInfo["UUID"] = &TypeInfo{Type: String}
-	typeInfo["Nullable(UUID)"] = &TypeInfo{Type: String, Nullable: true}
-	typeInfo["Array(UUID)"] = &TypeInfo{Type: String, Array: true}
-	typeInfo["Date"] = &TypeInfo{Type: DateTime}
-	typeInfo["Nullable(Date)"] = &TypeInfo{Type: DateTime, Nullable: true}
-	typeInfo["Array(Date)"] = &TypeInfo{Type: DateTime, Array: true}
+		typeInfo[arrTn] = arrayOf(typeInfo[tn])
+	}
+	typeInfo["UUID"] = &TypeInfo{Type: String, UUID: true}
+	typeInfo["Nullable(UUID)"] = &TypeInfo{Type: String, Nullable: true, UUID: true}
+	typeInfo["Array(UUID)"] = arrayOf(typeInfo["UUID"])
+	typeInfo["Date"] = &TypeInfo{Type: DateTime, minTime: minDateTime, maxTime: maxDate}
+	typeInfo["Nullable(Date)"] = &TypeInfo{Type: DateTime, Nullable: true, minTime: minDateTime, maxTime: maxDate}
+	typeInfo["Array(Date)"] = arrayOf(typeInfo["Date"])
+	typeInfo["Date32"] = &TypeInfo{Type: DateTime, minTime: minDate32, maxTime: maxDate32}
+	typeInfo["Nullable(Date32)"] = &TypeInfo{Type: DateTime, Nullable: true, minTime: minDate32, maxTime: maxDate32}
+	typeInfo["Array(Date32)"] = arrayOf(typeInfo["Date32"])
 }
@@ -57,6 +57,8 @@ WHERE
     AND
     current_col.table = '%s';`
 	wrSeriesQuota int = 16384
+	// times of sending a batch to the dead letter before dropping it
+	deadLetterAttempts uint = 3
 
 	SeriesQuotas sync.Map
 )
@@ -75,6 +77,10 @@ type ClickHouse struct {
 	prepareSQL string
 	promSerSQL string
 	seriesTbl  string
+	offsetsSQL string
+
+	// whether the server supports insert_deduplication_token
+	dedupSupported bool
 
 	distMetricTbls []string
 	distSeriesTbls []string
@@ -87,6 +93,8 @@ type ClickHouse struct {
 	mux         sync.Mutex
 	taskDone    *sync.Cond
 	SortingKeys []*model.ColumnWithType
+
+	deadLetter *DeadLetter
 }
 
 type DistTblInfo struct {
@@ -118,6 +126,11 @@ func NewClickHouse(cfg *config.Config, taskCfg *config.TaskConfig) *ClickHouse {
 	return ck
 }
 
+// SetDeadLetter sets where batches go to when WriteFailurePolicy is "deadletter"
+func (c *ClickHouse) SetDeadLetter(dl *DeadLetter) {
+	c.deadLetter = dl
+}
+
 // Init the clickhouse intance
 func (c *ClickHouse) Init() (err error) {
 	return c.initSchema()
@@ -150,7 +163,7 @@ func (c *ClickHouse) Send(batch *model.Batch, traceId string) {
 		statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Dec()
 	}); err != nil {
 		batch.Wg.Done()
-		util.Rs.Dec(int64(batch.RealSize))
+		batch.Release()
 		return
 	}
 
@@ -203,7 +216,7 @@ func (c *ClickHouse) writeSeries(rows model.Rows, conn *pool.Conn) (err error) {
 	if len(seriesRows) != 0 {
 		begin := time.Now()
 		var numBad int
-		if numBad, err = writeRows(c.promSerSQL, seriesRows, c.IdxSerID, c.NumDims, conn); err != nil {
+		if numBad, err = writeRows(c.promSerSQL, seriesRows, c.IdxSerID, c.NumDims, conn, ""); err != nil {
 			return
 		}
 		// update c.bmSeries **after** writing series
@@ -229,7 +242,7 @@ func (c *ClickHouse) writeSeries(rows model.Rows, conn *pool.Conn) (err error) {
 
 // Write a batch to clickhouse
 func (c *ClickHouse) write(batch *model.Batch, sc *pool.ShardConn, dbVer *int) (err error) {
-	if len(*batch.Rows) == 0 {
+	if len(*batch.Rows) == 0 && batch.Offsets == nil {
 		return
 	}
 	var conn *pool.Conn
@@ -238,6 +251,20 @@ func (c *ClickHouse) write(batch *model.Batch, sc *pool.ShardConn, dbVer *int) (
 	}
 	util.Logger.Debug("writing batch", zap.String("task", c.taskCfg.Name), zap.String("replica", sc.GetReplica()), zap.Int("dbVer", *dbVer))
 
+	if len(*batch.Rows) != 0 {
+		if err = c.writeBatch(batch, conn); err != nil {
+			return
+		}
+	}
+	if batch.Offsets != nil {
+		// offsets are written after the data, a crash in between replays the batch instead of losing it
+		err = c.writeOffsets(batch, conn)
+	}
+	return
+}
+
+// writeBatch writes the rows to the metric table, and to the series table if PrometheusSchema is enabled
+func (c *ClickHouse) writeBatch(batch *model.Batch, conn *pool.Conn) (err error) {
 	//row[:c.IdxSerID+1] is for metric table
 	//row[c.IdxSerID:] is for series table
 	numDims := c.NumDims
@@ -249,7 +276,11 @@ func (c *ClickHouse) write(batch *model.Batch, sc *pool.ShardConn, dbVer *int) (
 	}
 	begin := time.Now()
 	var numBad int
-	if numBad, err = writeRows(c.prepareSQL, *batch.Rows, 0, numDims, conn); err != nil {
+	var dedupToken string
+	if c.dedupSupported {
+		dedupToken = batch.DedupToken
+	}
+	if numBad, err = writeRows(c.prepareSQL, *batch.Rows, 0, numDims, conn, dedupToken); err != nil {
 		return
 	}
 	statistics.WritingDurations.WithLabelValues(c.taskCfg.Name, c.TableName).Observe(time.Since(begin).Seconds())
@@ -267,7 +298,7 @@ func (c *ClickHouse) loopWrite(batch *model.Batch, sc *pool.ShardConn, traceId s
 
 	util.LogTrace(traceId, util.TraceKindWriteStart, zap.Int("realsize", batch.RealSize))
 	defer func() {
-		util.Rs.Dec(int64(batch.RealSize))
+		batch.Release()
 		util.LogTrace(traceId, util.TraceKindWriteEnd, zap.Int("success", batch.RealSize))
 	}()
 	times := c.cfg.Clickhouse.RetryTimes
@@ -290,10 +321,45 @@ func (c *ClickHouse) loopWrite(batch *model.Batch, sc *pool.ShardConn, traceId s
 			statistics.FlushMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(batch.RealSize))
 		}),
 	); err != nil {
+		c.handleWriteFailure(batch, err)
+	}
+}
+
+// handleWriteFailure applies the task's WriteFailurePolicy to a batch which couldn't be written after all retries
+func (c *ClickHouse) handleWriteFailure(batch *model.Batch, err error) {
+	policy := c.taskCfg.WriteFailurePolicy
+	numRows := float64(len(*batch.Rows))
+	switch policy {
+	case config.WriteFailureSkip:
+		statistics.WriteFailureRowsTotal.WithLabelValues(c.taskCfg.Name, policy).Add(numRows)
+		util.Logger.Error("ClickHouse.loopWrite failed, skipped the batch", zap.String("task", c.taskCfg.Name), zap.Int("rows", len(*batch.Rows)), zap.Error(err))
+	case config.WriteFailureDeadLetter:
+		if errDL := retry.Do(
+			func() error { return c.deadLetter.ProduceBatch(batch, c.rowDims, err) },
+			retry.LastErrorOnly(true),
+			retry.Attempts(deadLetterAttempts),
+			retry.Delay(10*time.Second),
+		); errDL != nil {
+			// the dead letter is unavailable as well, exit before the offsets of the batch get committed
+			statistics.WriteFailureRowsTotal.WithLabelValues(c.taskCfg.Name, config.WriteFailureFatal).Add(numRows)
+			util.Logger.Fatal("ClickHouse.loopWrite failed and dead letter failed", zap.String("task", c.taskCfg.Name), zap.Int("rows", len(*batch.Rows)), zap.Error(err), zap.NamedError("deadletter", errDL))
+		}
+		statistics.WriteFailureRowsTotal.WithLabelValues(c.taskCfg.Name, policy).Add(numRows)
+		util.Logger.Error("ClickHouse.loopWrite failed, sent the batch to dead letter", zap.String("task", c.taskCfg.Name), zap.Int("rows", len(*batch.Rows)), zap.Error(err))
+	default:
+		statistics.WriteFailureRowsTotal.WithLabelValues(c.taskCfg.Name, config.WriteFailureFatal).Add(numRows)
 		util.Logger.Fatal("ClickHouse.loopWrite failed", zap.String("task", c.taskCfg.Name), zap.Error(err))
 	}
 }
 
+// rowDims returns the columns of a row. With PrometheusSchema, only rows of new series carry the columns of the series table.
+func (c *ClickHouse) rowDims(row *model.Row) []*model.ColumnWithType {
+	if c.taskCfg.PrometheusSchema && len(*row) != c.NumDims {
+		return c.Dims[:c.IdxSerID+1]
+	}
+	return c.Dims
+}
+
 func (c *ClickHouse) getSeriesDims(dims []*model.ColumnWithType, conn *pool.Conn) {
 	for _, dim := range dims {
 		if strings.Contains(dim.Name, "series_id") {
@@ -469,6 +535,12 @@ func (c *ClickHouse) initSchema() (err error) {
 	if err = c.ensureShardingkey(conn, c.TableName, c.taskCfg.Parser); err != nil {
 		return
 	}
+	var version string
+	if err = conn.QueryRow("SELECT version()").Scan(&version); err != nil {
+		err = errors.Wrapf(err, "failed to get the version of clickhouse")
+		return
+	}
+	c.dedupSupported = util.CompareClickHouseVersion(version, "22.2") >= 0
 	if c.taskCfg.AutoSchema {
 		if c.Dims, err = getDims(c.dbName, c.TableName, c.taskCfg.ExcludeColumns, c.taskCfg.Parser, conn); err != nil {
 			return
@@ -524,6 +596,14 @@ func (c *ClickHouse) initSchema() (err error) {
 			strings.Join(quotedDms, ","))
 	}
 	util.Logger.Info(fmt.Sprintf("Prepare sql=> %s", c.prepareSQL), zap.String("task", c.taskCfg.Name))
+	if c.taskCfg.ExactlyOnce {
+		if err = c.checkDeduplication(conn); err != nil {
+			return
+		}
+		if err = c.initOffsetsTable(); err != nil {
+			return
+		}
+	}
 
 	// // Check distributed metric table
 	// if chCfg := &c.cfg.Clickhouse; chCfg.Cluster != "" {
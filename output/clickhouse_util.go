@@ -10,8 +10,8 @@ import (
 	"github.com/thanos-io/thanos/pkg/errors"
 )
 
-func writeRows(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, conn *pool.Conn) (numBad int, err error) {
-	return conn.Write(prepareSQL, rows, idxBegin, idxEnd)
+func writeRows(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, conn *pool.Conn, dedupToken string) (numBad int, err error) {
+	return conn.Write(prepareSQL, rows, idxBegin, idxEnd, dedupToken)
 }
 
 func getDims(database, table string, excludedColumns []string, parser string, conn *pool.Conn) (dims []*model.ColumnWithType, err error) {
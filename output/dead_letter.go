@@ -0,0 +1,277 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/input"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+// the stage at which a message failed to be processed
+const (
+	StageParse   = "parse"
+	StageConvert = "convert"
+	StageWrite   = "write"
+)
+
+// headers appended to each dead letter record, the original headers are kept
+const (
+	HeaderDLTask      = "__dlq_task"
+	HeaderDLError     = "__dlq_error"
+	HeaderDLTopic     = "__dlq_topic"
+	HeaderDLPartition = "__dlq_partition"
+	HeaderDLOffset    = "__dlq_offset"
+	HeaderDLStage     = "__dlq_stage"
+)
+
+// DeadLetter produces the messages which can't be processed to a Kafka topic,
+// or appends them to a local spool file, so that they can be inspected or replayed later.
+// It's shared by the clones of a task, each of them shall Retain it and Close it when being dropped.
+type DeadLetter struct {
+	taskCfg *config.TaskConfig
+	topic   string
+	cl      *kgo.Client
+	refs    atomic.Int32
+
+	spoolPath string
+	spoolMux  sync.Mutex
+	closed    bool
+}
+
+// spooledMsg is the line appended to the spool file for a message failed at parsing or converting
+type spooledMsg struct {
+	Task      string `json:"task"`
+	Error     string `json:"error"`
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Stage     string `json:"stage"`
+	Key       []byte `json:"key,omitempty"`
+	Value     []byte `json:"value"`
+}
+
+// NewDeadLetter creates a dead letter producer for the given task
+func NewDeadLetter(cfg *config.Config, taskCfg *config.TaskConfig) (dl *DeadLetter, err error) {
+	dl = &DeadLetter{
+		taskCfg: taskCfg,
+		topic:   taskCfg.DeadLetter.Topic,
+	}
+	dl.refs.Store(1)
+	if dl.topic == "" {
+		if err = os.MkdirAll(taskCfg.DeadLetter.SpoolDir, 0755); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		dl.spoolPath = filepath.Join(taskCfg.DeadLetter.SpoolDir, taskCfg.Name+".ndjson")
+		return
+	}
+	var opts []kgo.Opt
+	if opts, err = input.GetFranzConfig(&cfg.Kafka); err != nil {
+		return
+	}
+	opts = append(opts, kgo.DefaultProduceTopic(dl.topic))
+	if dl.cl, err = kgo.NewClient(opts...); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return
+}
+
+// Produce sends the original message along with the failure details asynchronously
+func (dl *DeadLetter) Produce(msg *model.InputMessage, stage string, cause error) {
+	if dl.cl == nil {
+		sm := spooledMsg{
+			Task:      dl.taskCfg.Name,
+			Topic:     msg.Topic,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+			Stage:     stage,
+			Key:       msg.Key,
+			Value:     msg.Value,
+		}
+		if cause != nil {
+			sm.Error = cause.Error()
+		}
+		line, _ := json.Marshal(sm)
+		if err := dl.spool([][]byte{line}); err != nil {
+			statistics.DeadLetterErrorTotal.WithLabelValues(dl.taskCfg.Name).Inc()
+			util.Logger.Error("failed to spool dead letter", zap.String("task", dl.taskCfg.Name), zap.Error(err))
+			return
+		}
+		statistics.DeadLetterMsgsTotal.WithLabelValues(dl.taskCfg.Name, stage).Inc()
+		return
+	}
+	headers := make([]kgo.RecordHeader, 0, len(msg.Headers)+6)
+	for _, h := range msg.Headers {
+		headers = append(headers, kgo.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	var errText string
+	if cause != nil {
+		errText = cause.Error()
+	}
+	headers = append(headers,
+		kgo.RecordHeader{Key: HeaderDLTask, Value: []byte(dl.taskCfg.Name)},
+		kgo.RecordHeader{Key: HeaderDLError, Value: []byte(errText)},
+		kgo.RecordHeader{Key: HeaderDLTopic, Value: []byte(msg.Topic)},
+		kgo.RecordHeader{Key: HeaderDLPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kgo.RecordHeader{Key: HeaderDLOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kgo.RecordHeader{Key: HeaderDLStage, Value: []byte(stage)},
+	)
+	rec := &kgo.Record{
+		Topic:   dl.topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+	dl.cl.Produce(context.Background(), rec, func(r *kgo.Record, err error) {
+		if err != nil {
+			statistics.DeadLetterErrorTotal.WithLabelValues(dl.taskCfg.Name).Inc()
+			util.Logger.Error("failed to produce dead letter",
+				zap.String("task", dl.taskCfg.Name),
+				zap.String("topic", msg.Topic),
+				zap.Int("partition", msg.Partition),
+				zap.Int64("offset", msg.Offset),
+				zap.Error(err))
+			return
+		}
+		statistics.DeadLetterMsgsTotal.WithLabelValues(dl.taskCfg.Name, stage).Inc()
+	})
+}
+
+// ProduceBatch synchronously sends the rows of a batch which ClickHouse refused, one JSON object per row keyed by column name.
+// rowDims tells the columns of each row, which differ between rows of the same batch with PrometheusSchema.
+func (dl *DeadLetter) ProduceBatch(batch *model.Batch, rowDims func(*model.Row) []*model.ColumnWithType, cause error) (err error) {
+	errText := cause.Error()
+	lines := make([][]byte, 0, len(*batch.Rows))
+	for _, row := range *batch.Rows {
+		lines = append(lines, rowToJSON(row, rowDims(row)))
+	}
+	if dl.cl == nil {
+		err = dl.spool(lines)
+	} else {
+		recs := make([]*kgo.Record, 0, len(lines))
+		for _, line := range lines {
+			recs = append(recs, &kgo.Record{
+				Topic: dl.topic,
+				Value: line,
+				Headers: []kgo.RecordHeader{
+					{Key: HeaderDLTask, Value: []byte(dl.taskCfg.Name)},
+					{Key: HeaderDLError, Value: []byte(errText)},
+					{Key: HeaderDLStage, Value: []byte(StageWrite)},
+				},
+			})
+		}
+		err = dl.cl.ProduceSync(context.Background(), recs...).FirstErr()
+	}
+	if err != nil {
+		statistics.DeadLetterErrorTotal.WithLabelValues(dl.taskCfg.Name).Add(float64(len(lines)))
+		return errors.Wrapf(err, "")
+	}
+	statistics.DeadLetterMsgsTotal.WithLabelValues(dl.taskCfg.Name, StageWrite).Add(float64(len(lines)))
+	return
+}
+
+func rowToJSON(row *model.Row, dims []*model.ColumnWithType) []byte {
+	obj := make(map[string]interface{}, len(dims))
+	for i, val := range *row {
+		if i >= len(dims) {
+			break
+		}
+		obj[dims[i].Name] = val
+	}
+	line, err := json.Marshal(obj)
+	if err != nil {
+		// values such as NaN are not representable in JSON, fall back to their text form
+		for k, v := range obj {
+			if v != nil {
+				obj[k] = fmt.Sprintf("%v", v)
+			}
+		}
+		line, _ = json.Marshal(obj)
+	}
+	return line
+}
+
+func (dl *DeadLetter) spool(lines [][]byte) (err error) {
+	dl.spoolMux.Lock()
+	defer dl.spoolMux.Unlock()
+	if dl.closed {
+		return errors.Newf("dead letter of task %s has been closed", dl.taskCfg.Name)
+	}
+	var f *os.File
+	if f, err = os.OpenFile(dl.spoolPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err = f.Write(append(line, '\n')); err != nil {
+			return
+		}
+	}
+	return f.Sync()
+}
+
+// Flush waits until all buffered dead letters have been acknowledged
+func (dl *DeadLetter) Flush() {
+	if dl.cl == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := dl.cl.Flush(ctx); err != nil {
+		util.Logger.Error("failed to flush dead letters", zap.String("task", dl.taskCfg.Name), zap.Error(err))
+	}
+}
+
+// Retain adds a reference to dl, which is released by Close
+func (dl *DeadLetter) Retain() *DeadLetter {
+	if dl != nil {
+		dl.refs.Add(1)
+	}
+	return dl
+}
+
+// Close releases a reference to dl. The last one flushes the buffered dead letters and closes the producer.
+func (dl *DeadLetter) Close() {
+	if dl.refs.Add(-1) > 0 {
+		return
+	}
+	if dl.cl == nil {
+		dl.spoolMux.Lock()
+		dl.closed = true
+		dl.spoolMux.Unlock()
+		return
+	}
+	dl.Flush()
+	dl.cl.Close()
+}
@@ -0,0 +1,86 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+func spooledLines(t *testing.T, path string) (lines []spooledMsg) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	require.Nil(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var sm spooledMsg
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &sm))
+		lines = append(lines, sm)
+	}
+	require.Nil(t, scanner.Err())
+	return
+}
+
+func TestDeadLetterRefCount(t *testing.T) {
+	util.InitLogger([]string{"stdout"})
+	taskCfg := &config.TaskConfig{Name: "test_dead_letter"}
+	taskCfg.DeadLetter.SpoolDir = t.TempDir()
+	dl, err := NewDeadLetter(&config.Config{}, taskCfg)
+	require.Nil(t, err)
+	path := filepath.Join(taskCfg.DeadLetter.SpoolDir, taskCfg.Name+".ndjson")
+
+	// a clone of the task keeps the dead letter open after the original one is dropped
+	clone := dl.Retain()
+	dl.Close()
+	clone.Produce(&model.InputMessage{Topic: "topic1", Partition: 1, Offset: 10, Value: []byte("bad")}, StageParse, nil)
+	lines := spooledLines(t, path)
+	require.Len(t, lines, 1)
+	require.Equal(t, spooledMsg{Task: taskCfg.Name, Topic: "topic1", Partition: 1, Offset: 10, Stage: StageParse, Value: []byte("bad")}, lines[0])
+
+	// the last reference closes it
+	clone.Close()
+	clone.Produce(&model.InputMessage{Topic: "topic1", Partition: 1, Offset: 11, Value: []byte("bad")}, StageParse, nil)
+	require.Len(t, spooledLines(t, path), 1)
+}
+
+func TestDeadLetterPrometheusRows(t *testing.T) {
+	util.InitLogger([]string{"stdout"})
+	taskCfg := &config.TaskConfig{Name: "test_dead_letter_prom", PrometheusSchema: true}
+	taskCfg.DeadLetter.SpoolDir = t.TempDir()
+	dl, err := NewDeadLetter(&config.Config{}, taskCfg)
+	require.Nil(t, err)
+	defer dl.Close()
+	// metric table (timestamp, value, __series_id__), series table (__series_id__, __mgmt_id__, labels, __name__)
+	c := &ClickHouse{
+		taskCfg: taskCfg,
+		Dims: []*model.ColumnWithType{
+			{Name: "timestamp"}, {Name: "value"}, {Name: "__series_id__"},
+			{Name: "__mgmt_id__"}, {Name: "labels"}, {Name: "__name__"},
+		},
+		IdxSerID: 2,
+		NumDims:  6,
+	}
+	rows := model.Rows{
+		{int64(1), 1.5, int64(100), int64(200), `{"__name__": "up"}`, "up"}, // new series
+		{int64(2), 2.5, int64(100)},
+	}
+	batch := &model.Batch{Rows: &rows}
+	require.Nil(t, dl.ProduceBatch(batch, c.rowDims, errors.New("refused")))
+
+	f, err := os.ReadFile(filepath.Join(taskCfg.DeadLetter.SpoolDir, taskCfg.Name+".ndjson"))
+	require.Nil(t, err)
+	require.Equal(t, `{"__mgmt_id__":200,"__name__":"up","__series_id__":100,"labels":"{\"__name__\": \"up\"}","timestamp":1,"value":1.5}
+{"__series_id__":100,"timestamp":2,"value":2.5}
+`, string(f))
+}
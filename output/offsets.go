@@ -0,0 +1,176 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// The offsets table is created on each shard if it doesn't exist. It's not replicated, so the offsets are only
+// visible on the replica they were written to, LoadOffsets reads all replicas of the shard.
+const (
+	createOffsetsSQLTemplate = "CREATE TABLE IF NOT EXISTS `%s`.`%s` (" +
+		"`consumer_group` String, `task_name` String, `topic` String, `partition` Int32, `shard` Int32, `offset` Int64, `ts` DateTime64(3)" +
+		") ENGINE = ReplacingMergeTree(ts) ORDER BY (consumer_group, task_name, topic, partition, shard)"
+	selectOffsetsSQLTemplate = "SELECT topic, partition, shard, argMax(offset, ts) FROM `%s`.`%s` " +
+		"WHERE consumer_group = ? AND task_name = ? GROUP BY topic, partition, shard"
+	offsetsColumns = "`consumer_group`,`task_name`,`topic`,`partition`,`shard`,`offset`,`ts`"
+
+	selectEngineSQL      = "SELECT engine, engine_full FROM system.tables WHERE database = ? AND name = ?"
+	selectDedupWindowSQL = "SELECT value FROM system.merge_tree_settings WHERE name = 'non_replicated_deduplication_window'"
+)
+
+var dedupWindowRegexp = regexp.MustCompile(`non_replicated_deduplication_window\s*=\s*(\d+)`)
+
+func (c *ClickHouse) offsetsTable() (db, tbl string) {
+	tbl = c.cfg.Clickhouse.OffsetsTable
+	if idx := strings.Index(tbl, "."); idx > 0 {
+		return tbl[0:idx], tbl[idx+1:]
+	}
+	return c.cfg.Clickhouse.DB, tbl
+}
+
+// initOffsetsTable ensures the offsets table exists on every shard
+func (c *ClickHouse) initOffsetsTable() (err error) {
+	db, tbl := c.offsetsTable()
+	if c.cfg.Clickhouse.Protocol == clickhouse.HTTP.String() {
+		c.offsetsSQL = fmt.Sprintf("INSERT INTO `%s`.`%s` (%s) VALUES (?,?,?,?,?,?,?)", db, tbl, offsetsColumns)
+	} else {
+		c.offsetsSQL = fmt.Sprintf("INSERT INTO `%s`.`%s` (%s)", db, tbl, offsetsColumns)
+	}
+	query := fmt.Sprintf(createOffsetsSQLTemplate, db, tbl)
+	for i := 0; i < pool.NumShard(); i++ {
+		var conn *pool.Conn
+		if conn, _, err = pool.GetShardConn(int64(i)).NextGoodReplica(c.cfg.Clickhouse.Ctx, 0); err != nil {
+			return
+		}
+		if err = conn.Exec(query); err != nil {
+			err = errors.Wrapf(err, "%s", query)
+			return
+		}
+	}
+	return
+}
+
+// checkDeduplication makes sure the table discards a batch inserted again with the same insert_deduplication_token.
+// Data and offsets are written by separate INSERTs, a batch is written again if the process crashes in between.
+func (c *ClickHouse) checkDeduplication(conn *pool.Conn) (err error) {
+	if !c.dedupSupported {
+		return errors.Newf("ExactlyOnce requires ClickHouse 22.2 or later which supports insert_deduplication_token")
+	}
+	var engine, engineFull string
+	if err = conn.QueryRow(selectEngineSQL, c.dbName, c.TableName).Scan(&engine, &engineFull); err != nil {
+		return errors.Wrapf(err, "%s", selectEngineSQL)
+	}
+	if strings.HasPrefix(engine, "Replicated") {
+		return
+	}
+	window := "0"
+	if m := dedupWindowRegexp.FindStringSubmatch(engineFull); m != nil {
+		window = m[1]
+	} else if err = conn.QueryRow(selectDedupWindowSQL).Scan(&window); err != nil {
+		return errors.Wrapf(err, "%s", selectDedupWindowSQL)
+	}
+	if window == "0" {
+		return errors.Newf("ExactlyOnce is unsupported for table %s.%s: data and offsets are written by two separate INSERTs, "+
+			"so a batch is written again if the process crashes in between, and only deduplication can discard it. "+
+			"ClickHouse deduplicates inserts only for Replicated*MergeTree tables or tables with non_replicated_deduplication_window set", c.dbName, c.TableName)
+	}
+	return
+}
+
+// writeOffsets records the end offset of each partition flushed with the batch to the shard
+func (c *ClickHouse) writeOffsets(batch *model.Batch, conn *pool.Conn) (err error) {
+	now := time.Now()
+	var rows model.Rows
+	for topic, parts := range batch.Offsets {
+		for partition, rng := range parts {
+			row := model.Row{c.taskCfg.ConsumerGroup, c.taskCfg.Name, topic, partition, int32(batch.BatchIdx), rng.End, now}
+			rows = append(rows, &row)
+		}
+	}
+	if len(rows) == 0 {
+		return
+	}
+	var numBad int
+	if numBad, err = conn.Write(c.offsetsSQL, rows, 0, len(*rows[0]), ""); err != nil {
+		return
+	}
+	if numBad != 0 {
+		err = errors.Newf("failed to write %d offsets of %d to %s", numBad, len(rows), c.cfg.Clickhouse.OffsetsTable)
+	}
+	return
+}
+
+// LoadOffsets returns the last offset written to each shard for every topic partition of the task.
+// The offset is -1 if nothing of the partition has been written to the shard. Every replica is read since
+// the offsets table isn't replicated, or replication may lag behind. Replicas which can't be read are skipped,
+// so the offset is the largest one among the others, or -1 if no replica of the shard can be read.
+func (c *ClickHouse) LoadOffsets() (offsets map[string]map[int32][]int64) {
+	db, tbl := c.offsetsTable()
+	query := fmt.Sprintf(selectOffsetsSQLTemplate, db, tbl)
+	numShards := pool.NumShard()
+	offsets = make(map[string]map[int32][]int64)
+	for i := 0; i < numShards; i++ {
+		errs := pool.GetShardConn(int64(i)).EachReplica(c.cfg.Clickhouse.Ctx, func(replica string, conn *pool.Conn) (err error) {
+			var rs *pool.Rows
+			if rs, err = conn.Query(query, c.taskCfg.ConsumerGroup, c.taskCfg.Name); err != nil {
+				return errors.Wrapf(err, "%s", query)
+			}
+			defer rs.Close()
+			for rs.Next() {
+				var topic string
+				var partition, shard int32
+				var offset int64
+				if err = rs.Scan(&topic, &partition, &shard, &offset); err != nil {
+					return errors.Wrapf(err, "failed to scan offsets")
+				}
+				if int(shard) != i {
+					util.Logger.Warn("ignored offsets of unexpected shard, was the number of shards changed?",
+						zap.String("task", c.taskCfg.Name), zap.String("replica", replica), zap.Int32("shard", shard), zap.Int("expected", i))
+					continue
+				}
+				if offsets[topic] == nil {
+					offsets[topic] = make(map[int32][]int64)
+				}
+				ends, ok := offsets[topic][partition]
+				if !ok {
+					ends = make([]int64, numShards)
+					for j := range ends {
+						ends[j] = -1
+					}
+					offsets[topic][partition] = ends
+				}
+				ends[i] = max(ends[i], offset)
+			}
+			return
+		})
+		for _, err := range errs {
+			util.Logger.Warn("skipped offsets of unreadable replica", zap.String("task", c.taskCfg.Name), zap.Int("shard", i), zap.Error(err))
+		}
+	}
+	return
+}
@@ -0,0 +1,262 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/linkedin/goavro/v2"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+var _ Parser = (*AvroParser)(nil)
+
+func init() {
+	Register("avro", func(pp *Pool) (Parser, error) {
+		if pp.registry == nil {
+			return nil, errors.Newf("avro parser requires a schema registry")
+		}
+		fields, err := parseFields(pp.fields)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+			return nil, err
+		}
+		return &AvroParser{pp: pp, fields: fields}, nil
+	}, CapDynamicSchema, Validator(func(taskCfg *config.TaskConfig) error {
+		if taskCfg.SchemaRegistry == "" {
+			return errors.Newf("Parser %s requires SchemaRegistry", taskCfg.Parser)
+		}
+		return nil
+	}))
+}
+
+// AvroParser decodes Confluent framed Avro messages: a magic byte, a 4-byte schema ID, then the Avro binary body.
+// Writer schemas are fetched from the schema registry and cached by ID.
+type AvroParser struct {
+	pp     *Pool
+	fields map[string]interface{}
+}
+
+// avroSchema is a compiled writer schema
+type avroSchema struct {
+	codec *goavro.Codec
+	root  interface{}
+	names map[string]interface{} // named types by full name
+}
+
+func (p *AvroParser) Parse(bs []byte) (metric model.Metric, err error) {
+	var id int32
+	var payload []byte
+	if id, payload, err = splitConfluent(bs); err != nil {
+		return
+	}
+	var v interface{}
+	if v, err = p.pp.registry.Get(id, compileAvro); err != nil {
+		return
+	}
+	schema := v.(*avroSchema)
+	var native interface{}
+	if native, _, err = schema.codec.NativeFromBinary(payload); err != nil {
+		err = errors.Wrapf(err, "schema %d", id)
+		return
+	}
+	values, ok := schema.unwrap(schema.root, "", native).(map[string]interface{})
+	if !ok {
+		err = errors.Newf("schema %d isn't an Avro record", id)
+		return
+	}
+	metric = newNativeMetric(p.pp, values, p.fields)
+	return
+}
+
+func compileAvro(text string) (v interface{}, err error) {
+	schema := &avroSchema{names: make(map[string]interface{})}
+	if schema.codec, err = goavro.NewCodec(text); err != nil {
+		err = errors.Wrapf(err, "failed to compile avro schema")
+		return
+	}
+	if err = json.Unmarshal([]byte(text), &schema.root); err != nil {
+		// a primitive type may be specified as a bare name
+		schema.root = text
+		err = nil
+	}
+	schema.collectNames(schema.root, "")
+	v = schema
+	return
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true,
+}
+
+func avroFullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// collectNames registers the named types, so that references to them can be resolved by unwrap
+func (s *avroSchema) collectNames(node interface{}, namespace string) {
+	switch node := node.(type) {
+	case []interface{}:
+		for _, branch := range node {
+			s.collectNames(branch, namespace)
+		}
+	case map[string]interface{}:
+		typ, _ := node["type"].(string)
+		switch typ {
+		case "record", "error", "enum", "fixed":
+			if ns, ok := node["namespace"].(string); ok {
+				namespace = ns
+			}
+			name, _ := node["name"].(string)
+			fullName := avroFullName(name, namespace)
+			s.names[fullName] = node
+			if i := strings.LastIndexByte(fullName, '.'); i >= 0 {
+				namespace = fullName[:i]
+			}
+			fields, _ := node["fields"].([]interface{})
+			for _, f := range fields {
+				if field, ok := f.(map[string]interface{}); ok {
+					s.collectNames(field["type"], namespace)
+				}
+			}
+		case "array":
+			s.collectNames(node["items"], namespace)
+		case "map":
+			s.collectNames(node["values"], namespace)
+		default:
+			s.collectNames(node["type"], namespace)
+		}
+	}
+}
+
+// typeNames returns names goavro may use to label a union branch
+func (s *avroSchema) typeNames(node interface{}, namespace string) (names []string) {
+	switch node := node.(type) {
+	case string:
+		names = append(names, node)
+		if !avroPrimitives[node] {
+			names = append(names, avroFullName(node, namespace))
+		}
+	case map[string]interface{}:
+		typ, _ := node["type"].(string)
+		switch typ {
+		case "record", "error", "enum", "fixed":
+			name, _ := node["name"].(string)
+			if ns, ok := node["namespace"].(string); ok {
+				namespace = ns
+			}
+			names = append(names, name, avroFullName(name, namespace))
+		case "":
+			names = s.typeNames(node["type"], namespace)
+		default:
+			names = append(names, typ)
+			if lt, ok := node["logicalType"].(string); ok {
+				names = append(names, typ+"."+lt)
+			}
+		}
+	}
+	return
+}
+
+// unwrap strips the single-key maps with which goavro labels union values, guided by the writer schema
+func (s *avroSchema) unwrap(node interface{}, namespace string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch node := node.(type) {
+	case string:
+		if avroPrimitives[node] {
+			return v
+		}
+		if named, ok := s.names[avroFullName(node, namespace)]; ok {
+			return s.unwrap(named, namespace, v)
+		}
+		if named, ok := s.names[node]; ok {
+			return s.unwrap(named, namespace, v)
+		}
+		return v
+	case []interface{}:
+		m, ok := v.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return v
+		}
+		for label, inner := range m {
+			for _, branch := range node {
+				for _, name := range s.typeNames(branch, namespace) {
+					if name == label || strings.HasSuffix(label, "."+name) {
+						return s.unwrap(branch, namespace, inner)
+					}
+				}
+			}
+			return inner
+		}
+	case map[string]interface{}:
+		typ, _ := node["type"].(string)
+		switch typ {
+		case "record", "error":
+			rec, ok := v.(map[string]interface{})
+			if !ok {
+				return v
+			}
+			name, _ := node["name"].(string)
+			if ns, ok := node["namespace"].(string); ok {
+				namespace = ns
+			}
+			if i := strings.LastIndexByte(avroFullName(name, namespace), '.'); i >= 0 {
+				namespace = avroFullName(name, namespace)[:i]
+			}
+			fields, _ := node["fields"].([]interface{})
+			for _, f := range fields {
+				field, ok := f.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				fname, _ := field["name"].(string)
+				if fv, ok := rec[fname]; ok {
+					rec[fname] = s.unwrap(field["type"], namespace, fv)
+				}
+			}
+			return rec
+		case "array":
+			arr, ok := v.([]interface{})
+			if !ok {
+				return v
+			}
+			for i := range arr {
+				arr[i] = s.unwrap(node["items"], namespace, arr[i])
+			}
+			return arr
+		case "map":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return v
+			}
+			for k := range m {
+				m[k] = s.unwrap(node["values"], namespace, m[k])
+			}
+			return m
+		case "":
+			return s.unwrap(node["type"], namespace, v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,200 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+var _ Parser = (*CanalParser)(nil)
+var _ Splitter = (*CanalParser)(nil)
+
+func init() {
+	Register("canal", func(pp *Pool) (Parser, error) {
+		fields, err := parseFields(pp.fields)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+			return nil, err
+		}
+		p := &CanalParser{pp: pp, opts: pp.cdc, fields: fields}
+		if p.opts == nil {
+			p.opts = &cdcOptions{}
+		}
+		return p, nil
+	}, CapDynamicSchema, Configurer(configureCdc))
+}
+
+// CanalParser parses the flat JSON messages of Alibaba Canal, such as
+// {"data":[{"id":"1","name":"a"}],"old":[{"name":"b"}],"mysqlType":{"id":"int(11)","name":"varchar(32)"},"type":"UPDATE","isDdl":false,"es":1589373560000,...}.
+// Values, which Canal serializes as strings, are cast according to mysqlType.
+// Fields CdcOp and CdcTsMs are added to the row, and columns set by LoadCdc are filled, the version is "es".
+type CanalParser struct {
+	pp     *Pool
+	opts   *cdcOptions
+	fields map[string]interface{}
+}
+
+// Split splits a message of multiple rows into messages of one row each, "old" is split accordingly. DDLs have no rows.
+func (p *CanalParser) Split(bs []byte) (elems [][]byte, err error) {
+	if !gjson.ValidBytes(bs) {
+		err = errors.Newf("message is not a valid JSON")
+		return
+	}
+	root := gjson.ParseBytes(bs)
+	if root.Get("isDdl").Bool() {
+		return
+	}
+	rows := root.Get("data").Array()
+	if len(rows) <= 1 {
+		return [][]byte{bs}, nil
+	}
+	olds := root.Get("old").Array()
+	var pairs []string
+	root.ForEach(func(k, v gjson.Result) bool {
+		if k.Str != "data" && k.Str != "old" {
+			pairs = append(pairs, k.Raw+":"+v.Raw)
+		}
+		return true
+	})
+	common := strings.Join(pairs, ",")
+	for i, row := range rows {
+		var sb strings.Builder
+		sb.WriteString("{")
+		if common != "" {
+			sb.WriteString(common)
+			sb.WriteString(",")
+		}
+		sb.WriteString(`"data":[` + row.Raw + "]")
+		if i < len(olds) {
+			sb.WriteString(`,"old":[` + olds[i].Raw + "]")
+		}
+		sb.WriteString("}")
+		elems = append(elems, []byte(sb.String()))
+	}
+	return
+}
+
+func (p *CanalParser) Parse(bs []byte) (metric model.Metric, err error) {
+	if !gjson.ValidBytes(bs) {
+		err = errors.Newf("message is not a valid JSON")
+		return
+	}
+	root := gjson.ParseBytes(bs)
+	if root.Get("isDdl").Bool() {
+		err = ErrSkipped
+		return
+	}
+	var op string
+	switch typ := root.Get("type").Str; typ {
+	case "INSERT":
+		op = "c"
+	case "UPDATE":
+		op = "u"
+	case "DELETE":
+		op = "d"
+	case "":
+		err = errors.Newf("message isn't a Canal change event")
+		return
+	default:
+		err = errors.Newf("unsupported Canal type %q", typ)
+		return
+	}
+	rows := root.Get("data").Array()
+	if len(rows) != 1 || !rows[0].IsObject() {
+		err = errors.Newf("Canal change event shall have one row, got %d", len(rows))
+		return
+	}
+	types := root.Get("mysqlType").Map()
+	values := make(map[string]interface{})
+	rows[0].ForEach(func(k, v gjson.Result) bool {
+		values[k.Str] = canalValue(v, types[k.Str].Str, p.pp.timeZone)
+		return true
+	})
+	values[CdcOp] = op
+	if es := root.Get("es"); es.Exists() {
+		values[CdcTsMs] = es.Int()
+		if p.opts.versionColumn != "" {
+			values[p.opts.versionColumn] = es.Uint()
+		}
+	}
+	p.opts.setNative(values, op == "d")
+	metric = newNativeMetric(p.pp, values, p.fields)
+	return
+}
+
+func canalValue(v gjson.Result, mysqlType string, loc *time.Location) interface{} {
+	switch v.Type {
+	case gjson.Null:
+		return nil
+	case gjson.String:
+		return castMysql(v.Str, mysqlType, loc)
+	case gjson.Number:
+		return json.Number(v.Raw)
+	case gjson.True, gjson.False:
+		return v.Bool()
+	default:
+		return v.Raw
+	}
+}
+
+// castMysql casts s according to the MySQL column type such as "bigint(20) unsigned", s is returned as it is if the type is unknown or the cast fails.
+// DATETIME and TIMESTAMP are in loc.
+func castMysql(s, mysqlType string, loc *time.Location) interface{} {
+	typ := strings.ToLower(mysqlType)
+	unsigned := strings.Contains(typ, "unsigned")
+	if i := strings.IndexAny(typ, "( "); i >= 0 {
+		typ = typ[:i]
+	}
+	switch typ {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year":
+		if unsigned {
+			if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return u
+			}
+		} else if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+	case "bit":
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return u
+		}
+	case "float", "double", "real":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case "decimal", "numeric", "dec", "fixed":
+		// keep the precision
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case "datetime", "timestamp":
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", s, loc); err == nil {
+			return t
+		}
+	case "date":
+		if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+			return t
+		}
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/valyala/fastjson"
+)
+
+const (
+	// CdcOp is the field of the change operation of CDC parsers: "c", "r", "u" or "d"
+	CdcOp = "__op"
+	// CdcTsMs is the field of the time in milliseconds of the change
+	CdcTsMs = "__ts_ms"
+)
+
+// cdcOptions are set by LoadCdc
+type cdcOptions struct {
+	signColumn       string
+	deletedColumn    string
+	versionColumn    string
+	ignoreTombstones bool
+}
+
+// LoadCdc sets the columns derived from change events by the debezium, canal and maxwell parsers.
+// signColumn is -1 for deletes and 1 otherwise, as CollapsingMergeTree expects.
+// deletedColumn is 1 for deletes and 0 otherwise, as ReplacingMergeTree expects.
+// versionColumn is the position of the change in the source database, which depends on the format.
+// Empty columns aren't filled. Tombstones (messages with nil value) of Debezium become deletes of the key unless ignoreTombstones is true,
+// or they follow delete events of the key.
+func (pp *Pool) LoadCdc(signColumn, deletedColumn, versionColumn string, ignoreTombstones bool) {
+	pp.cdc = &cdcOptions{signColumn, deletedColumn, versionColumn, ignoreTombstones}
+}
+
+// configureCdc is the Configurer of the debezium, canal and maxwell parsers
+func configureCdc(pp *Pool, taskCfg *config.TaskConfig) error {
+	pp.LoadCdc(taskCfg.Cdc.SignColumn, taskCfg.Cdc.DeletedColumn, taskCfg.Cdc.VersionColumn, taskCfg.Cdc.IgnoreTombstones)
+	return nil
+}
+
+// setFastjson fills the sign and deleted columns of row
+func (opts *cdcOptions) setFastjson(row *fastjson.Value, arena *fastjson.Arena, deleted bool) {
+	if opts.signColumn != "" {
+		sign := 1
+		if deleted {
+			sign = -1
+		}
+		row.Set(opts.signColumn, arena.NewNumberInt(sign))
+	}
+	if opts.deletedColumn != "" {
+		isDeleted := 0
+		if deleted {
+			isDeleted = 1
+		}
+		row.Set(opts.deletedColumn, arena.NewNumberInt(isDeleted))
+	}
+}
+
+// setNative fills the sign and deleted columns of row
+func (opts *cdcOptions) setNative(row map[string]interface{}, deleted bool) {
+	if opts.signColumn != "" {
+		sign := int64(1)
+		if deleted {
+			sign = -1
+		}
+		row[opts.signColumn] = sign
+	}
+	if opts.deletedColumn != "" {
+		isDeleted := int64(0)
+		if deleted {
+			isDeleted = 1
+		}
+		row[opts.deletedColumn] = isDeleted
+	}
+}
+
+// maxCdcDeletes bounds the delete events remembered by cdcDeletes, which are forgotten all at once beyond it
+const maxCdcDeletes = 1 << 16
+
+// cdcDeletes remembers the offsets of Debezium delete events by partition and key until the tombstones following them arrive.
+type cdcDeletes struct {
+	mux     sync.Mutex
+	offsets map[string]int64
+}
+
+func cdcDeleteKey(msg *model.InputMessage) string {
+	return msg.Topic + "\x00" + strconv.Itoa(msg.Partition) + "\x00" + string(msg.Key)
+}
+
+// add remembers the delete event msg
+func (d *cdcDeletes) add(msg *model.InputMessage) {
+	d.mux.Lock()
+	if d.offsets == nil || len(d.offsets) >= maxCdcDeletes {
+		d.offsets = make(map[string]int64)
+	}
+	d.offsets[cdcDeleteKey(msg)] = msg.Offset
+	d.mux.Unlock()
+}
+
+// follows tells whether the tombstone msg follows a delete event of the same key, which is forgotten then
+func (d *cdcDeletes) follows(msg *model.InputMessage) (ok bool) {
+	key := cdcDeleteKey(msg)
+	d.mux.Lock()
+	var offset int64
+	if offset, ok = d.offsets[key]; ok {
+		delete(d.offsets, key)
+		ok = offset < msg.Offset
+	}
+	d.mux.Unlock()
+	return
+}
+
+// binlogVersion returns the MySQL binlog position as binlog file sequence << 32 | position, e.g. mysql-bin.000003 and 154
+func binlogVersion(file string, pos uint64) (version uint64, ok bool) {
+	seq, err := strconv.ParseUint(file[strings.LastIndexByte(file, '.')+1:], 10, 32)
+	if err != nil || pos > 0xffffffff {
+		return
+	}
+	return seq<<32 | pos, true
+}
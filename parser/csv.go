@@ -18,16 +18,20 @@ package parser
 import (
 	"bytes"
 	"encoding/csv"
-	"fmt"
+	"encoding/json"
+	"io"
 	"math"
+	"math/big"
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/housepower/clickhouse_sinker/config"
 	"github.com/housepower/clickhouse_sinker/model"
-	"github.com/housepower/clickhouse_sinker/util"
 	"github.com/shopspring/decimal"
 	"github.com/thanos-io/thanos/pkg/errors"
 	"github.com/tidwall/gjson"
@@ -36,58 +40,286 @@ import (
 )
 
 var _ Parser = (*CsvParser)(nil)
+var _ MessageParser = (*CsvParser)(nil)
+
+func init() {
+	Register("csv", func(pp *Pool) (Parser, error) {
+		fields, err := parseFields(pp.fields)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+			return nil, err
+		}
+		p := &CsvParser{pp: pp, opts: pp.csv}
+		if p.opts == nil {
+			p.opts = &defaultCsvOptions
+		}
+		if len(fields) != 0 {
+			p.extra = make(map[string]string, len(fields))
+			for k, v := range fields {
+				switch v := v.(type) {
+				case nil:
+				case string:
+					p.extra[k] = v
+				case json.Number:
+					p.extra[k] = v.String()
+				case bool:
+					p.extra[k] = strconv.FormatBool(v)
+				default:
+					bs, _ := json.Marshal(v)
+					p.extra[k] = string(bs)
+				}
+			}
+		}
+		return p, nil
+	}, Validator(func(taskCfg *config.TaskConfig) error {
+		if len(taskCfg.CsvFormat) == 0 && !taskCfg.Csv.HeaderRecord && taskCfg.Csv.HeaderKey == "" {
+			return errors.Newf("Parser %s requires CsvFormat, Csv.HeaderRecord or Csv.HeaderKey", taskCfg.Parser)
+		}
+		return nil
+	}), Configurer(func(pp *Pool, taskCfg *config.TaskConfig) error {
+		pp.LoadCsv(taskCfg.Csv.HeaderRecord, taskCfg.Csv.HeaderKey, taskCfg.Csv.Lenient, taskCfg.Csv.NullTokens)
+		return nil
+	}))
+}
+
+// csvOptions are set by LoadCsv
+type csvOptions struct {
+	headerRecord bool
+	headerKey    string
+	lenient      bool
+	nullTokens   map[string]bool
+}
+
+var defaultCsvOptions = csvOptions{nullTokens: map[string]bool{"null": true}}
+
+// LoadCsv sets how the csv parser takes column names and values.
+// If headerRecord is true, the first record of each message is the header, followed by the values record.
+// Otherwise if the message has the header headerKey, its value is the header. CsvFormat is the fallback in both cases.
+// If lenient is true, missing trailing fields are NULL, or the default value of non-nullable columns.
+// Fields equal to any of nullTokens are NULL, which defaults to "null".
+func (pp *Pool) LoadCsv(headerRecord bool, headerKey string, lenient bool, nullTokens []string) {
+	opts := &csvOptions{headerRecord: headerRecord, headerKey: headerKey, lenient: lenient, nullTokens: defaultCsvOptions.nullTokens}
+	if len(nullTokens) != 0 {
+		opts.nullTokens = make(map[string]bool, len(nullTokens))
+		for _, tok := range nullTokens {
+			opts.nullTokens[tok] = true
+		}
+	}
+	pp.csv = opts
+}
 
 // CsvParser implementation to parse input from a CSV format per RFC 4180
 type CsvParser struct {
-	pp *Pool
+	pp    *Pool
+	opts  *csvOptions
+	extra map[string]string // the Fields extras formatted as csv values
 }
 
 // Parse extract a list of comma-separated values from the data
 func (p *CsvParser) Parse(bs []byte) (metric model.Metric, err error) {
-	r := csv.NewReader(bytes.NewReader(bs))
-	r.FieldsPerRecord = len(p.pp.csvFormat)
-	if len(p.pp.delimiter) > 0 {
-		r.Comma = rune(p.pp.delimiter[0])
+	return p.ParseMessage(bs, nil)
+}
+
+// ParseMessage takes the header from the message headers if the parser is loaded with a header key
+func (p *CsvParser) ParseMessage(bs []byte, msg *model.InputMessage) (metric model.Metric, err error) {
+	format := p.pp.csvFormat
+	nRecords := 1
+	if p.opts.headerRecord {
+		nRecords = 2
+	} else if p.opts.headerKey != "" && msg != nil {
+		for _, h := range msg.Headers {
+			if strings.EqualFold(h.Key, p.opts.headerKey) {
+				if format, err = p.header(h.Value); err != nil {
+					return
+				}
+				break
+			}
+		}
+	}
+	var records [][]string
+	if records, err = p.readRecords(bs, nRecords); err != nil {
+		return
+	}
+	if len(records) != nRecords {
+		err = errors.Newf("csv message has %d records, expect %d", len(records), nRecords)
+		return
+	}
+	if p.opts.headerRecord {
+		format = p.headerRecord(records[0])
 	}
-	var value []string
-	if value, err = r.Read(); err != nil {
-		err = errors.Wrapf(err, "")
+	value := records[nRecords-1]
+	if format == nil {
+		err = errors.Newf("csv format is unknown")
 		return
 	}
-	if len(value) != len(p.pp.csvFormat) {
+	if len(value) > len(format) || (len(value) < len(format) && !p.opts.lenient) {
 		err = errors.Newf("csv value doesn't match the format")
 		return
 	}
-	metric = &CsvMetric{p.pp, value}
+	metric = &CsvMetric{pp: p.pp, format: format, values: value, nullTokens: p.opts.nullTokens, extra: p.extra}
 	return
 }
 
+// header returns the column index of each name in line
+func (p *CsvParser) header(line []byte) (format map[string]int, err error) {
+	if v, ok := p.pp.csvHeaders.Load(string(line)); ok {
+		return v.(map[string]int), nil
+	}
+	var records [][]string
+	if records, err = p.readRecords(line, 1); err != nil {
+		return
+	}
+	if len(records) == 0 {
+		err = errors.Newf("csv header is empty")
+		return
+	}
+	format = newCsvFormat(records[0])
+	p.pp.csvHeaders.Store(string(line), format)
+	return
+}
+
+// headerRecord returns the column index of each name of the header record
+func (p *CsvParser) headerRecord(names []string) (format map[string]int) {
+	key := strings.Join(names, "\x00")
+	if v, ok := p.pp.csvHeaders.Load(key); ok {
+		return v.(map[string]int)
+	}
+	format = newCsvFormat(names)
+	p.pp.csvHeaders.Store(key, format)
+	return
+}
+
+func newCsvFormat(names []string) (format map[string]int) {
+	format = make(map[string]int, len(names))
+	for i, name := range names {
+		format[strings.TrimSpace(name)] = i
+	}
+	return
+}
+
+// readRecords reads at most n records from bs
+func (p *CsvParser) readRecords(bs []byte, n int) (records [][]string, err error) {
+	delim := p.pp.delimiter
+	if utf8.RuneCountInString(delim) > 1 {
+		s := string(bs)
+		for len(records) < n && strings.TrimRight(s, "\r\n") != "" {
+			var record []string
+			if record, s, err = readRecord(s, delim); err != nil {
+				return
+			}
+			records = append(records, record)
+		}
+		return
+	}
+	r := csv.NewReader(bytes.NewReader(bs))
+	r.FieldsPerRecord = -1
+	if delim != "" {
+		r.Comma, _ = utf8.DecodeRuneInString(delim)
+	}
+	for len(records) < n {
+		var record []string
+		if record, err = r.Read(); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			err = errors.Wrapf(err, "failed to parse csv record")
+			return
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// readRecord reads a record separated by the multi-character delimiter from s.
+// Quoted fields may contain delimiters, line breaks and doubled quotes.
+func readRecord(s, delim string) (record []string, rest string, err error) {
+	for {
+		var field string
+		if strings.HasPrefix(s, `"`) {
+			var sb strings.Builder
+			i := 1
+			for {
+				j := strings.IndexByte(s[i:], '"')
+				if j < 0 {
+					err = errors.Newf("csv: unterminated quoted field")
+					return
+				}
+				sb.WriteString(s[i : i+j])
+				i += j + 1
+				if i < len(s) && s[i] == '"' {
+					sb.WriteByte('"')
+					i++
+					continue
+				}
+				break
+			}
+			field, s = sb.String(), s[i:]
+			if s != "" && !strings.HasPrefix(s, delim) && !strings.HasPrefix(s, "\n") && !strings.HasPrefix(s, "\r\n") {
+				err = errors.Newf("csv: extraneous text after quoted field")
+				return
+			}
+		} else {
+			end := len(s)
+			if i := strings.Index(s, delim); i >= 0 {
+				end = i
+			}
+			if i := strings.IndexByte(s[:end], '\n'); i >= 0 {
+				end = i
+			}
+			field, s = strings.TrimSuffix(s[:end], "\r"), s[end:]
+		}
+		record = append(record, field)
+		if strings.HasPrefix(s, delim) {
+			s = s[len(delim):]
+			continue
+		}
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "\r"), "\n")
+		rest = s
+		return
+	}
+}
+
 // CsvMetic
 type CsvMetric struct {
-	pp     *Pool
-	values []string
+	pp         *Pool
+	format     map[string]int
+	values     []string
+	nullTokens map[string]bool
+	extra      map[string]string
+}
+
+// value returns the field of key, ok is false if the field is absent or NULL
+func (c *CsvMetric) value(key string) (s string, ok bool) {
+	if s, ok = c.extra[key]; !ok {
+		var idx int
+		if idx, ok = c.format[key]; !ok || idx >= len(c.values) {
+			return "", false
+		}
+		s = c.values[idx]
+	}
+	ok = !c.nullTokens[s]
+	return
 }
 
 // GetString get the value as string
 func (c *CsvMetric) GetString(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	s, ok := c.value(key)
+	if !ok {
 		if nullable {
 			return
 		}
 		val = ""
 		return
 	}
-	val = c.values[idx]
+	val = s
 	return
 }
 
 // GetDecimal returns the value as decimal
 func (c *CsvMetric) GetDecimal(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	s, ok := c.value(key)
+	if !ok {
 		if nullable {
 			return
 		}
@@ -95,23 +327,22 @@ func (c *CsvMetric) GetDecimal(key string, nullable bool) (val interface{}) {
 		return
 	}
 	var err error
-	if val, err = decimal.NewFromString(c.values[idx]); err != nil {
+	if val, err = decimal.NewFromString(s); err != nil {
 		val = decimal.NewFromInt(0)
 	}
 	return
 }
 
 func (c *CsvMetric) GetBool(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "" || c.values[idx] == "null" {
+	s, ok := c.value(key)
+	if !ok || s == "" {
 		if nullable {
 			return
 		}
 		val = false
 		return
 	}
-	val = (c.values[idx] == "true")
+	val = (s == "true")
 	return
 }
 
@@ -160,7 +391,10 @@ func (c *CsvMetric) GetIPv4(key string, nullable bool) (val interface{}) {
 }
 
 func (c *CsvMetric) GetIPv6(key string, nullable bool) (val interface{}) {
-	s := c.GetString(key, nullable).(string)
+	s, ok := c.value(key)
+	if !ok && nullable {
+		return
+	}
 	if net.ParseIP(s) != nil {
 		val = s
 	} else {
@@ -170,16 +404,15 @@ func (c *CsvMetric) GetIPv6(key string, nullable bool) (val interface{}) {
 }
 
 func CsvGetInt[T constraints.Signed](c *CsvMetric, key string, nullable bool, min, max int64) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	s, ok := c.value(key)
+	if !ok {
 		if nullable {
 			return
 		}
 		val = T(0)
 		return
 	}
-	if s := c.values[idx]; s == "true" {
+	if s == "true" {
 		val = T(1)
 	} else {
 		val2 := fastfloat.ParseInt64BestEffort(s)
@@ -195,16 +428,15 @@ func CsvGetInt[T constraints.Signed](c *CsvMetric, key string, nullable bool, mi
 }
 
 func CsvGetUint[T constraints.Unsigned](c *CsvMetric, key string, nullable bool, max uint64) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	s, ok := c.value(key)
+	if !ok {
 		if nullable {
 			return
 		}
 		val = T(0)
 		return
 	}
-	if s := c.values[idx]; s == "true" {
+	if s == "true" {
 		val = T(1)
 	} else {
 		val2 := fastfloat.ParseUint64BestEffort(s)
@@ -219,16 +451,15 @@ func CsvGetUint[T constraints.Unsigned](c *CsvMetric, key string, nullable bool,
 
 // GetFloat returns the value as float
 func CsvGetFloat[T constraints.Float](c *CsvMetric, key string, nullable bool, max float64) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	s, ok := c.value(key)
+	if !ok {
 		if nullable {
 			return
 		}
 		val = T(0.0)
 		return
 	}
-	val2 := fastfloat.ParseBestEffort(c.values[idx])
+	val2 := fastfloat.ParseBestEffort(s)
 	if val2 > max {
 		val = T(max)
 	} else {
@@ -238,122 +469,87 @@ func CsvGetFloat[T constraints.Float](c *CsvMetric, key string, nullable bool, m
 }
 
 func (c *CsvMetric) GetDateTime(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
-		if nullable {
-			return
-		}
-		val = Epoch
-		return
+	return c.GetTime(key, dateTimeType(nullable))
+}
+
+func (c *CsvMetric) GetTime(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	s, ok := c.value(key)
+	if !ok {
+		return getDefaultDateTime(typeinfo.Nullable)
 	}
-	s := c.values[idx]
-	if dd, err := strconv.ParseFloat(s, 64); err != nil {
-		var err error
-		if val, err = c.pp.ParseDateTime(key, s); err != nil {
-			val = Epoch
-		}
+	var t time.Time
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		t, ok = c.pp.parseTime(key, s, typeinfo)
 	} else {
-		val = UnixFloat(dd, c.pp.timeUnit)
+		t, ok = c.pp.unixTime(s, typeinfo)
 	}
-	return
+	if !ok {
+		// the field exists, so that it isn't null
+		return Epoch
+	}
+	return t
+}
+
+func (c *CsvMetric) GetBigInt(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	s, ok := c.value(key)
+	if !ok {
+		return getDefaultBigInt(typeinfo.Nullable)
+	}
+	if i, ok := parseBigInt(s, typeinfo.Type); ok {
+		return i
+	}
+	return new(big.Int)
 }
 
 // GetArray parse an CSV encoded array
-func (c *CsvMetric) GetArray(key string, typ int) (val interface{}) {
+func (c *CsvMetric) GetArray(key string, typeinfo *model.TypeInfo) (val interface{}) {
 	s := c.GetString(key, false)
 	str, _ := s.(string)
-	var array []gjson.Result
-	r := gjson.Parse(str)
-	if r.IsArray() {
-		array = r.Array()
-	}
-	switch typ {
-	case model.Bool:
-		results := make([]bool, 0, len(array))
-		for _, e := range array {
-			v := (e.Exists() && e.Type == gjson.True)
-			results = append(results, v)
-		}
-		val = results
-	case model.Int8:
-		val = GjsonIntArray[int8](array, math.MinInt8, math.MaxInt8)
-	case model.Int16:
-		val = GjsonIntArray[int16](array, math.MinInt16, math.MaxInt16)
-	case model.Int32:
-		val = GjsonIntArray[int32](array, math.MinInt32, math.MaxInt32)
-	case model.Int64:
-		val = GjsonIntArray[int64](array, math.MinInt64, math.MaxInt64)
-	case model.UInt8:
-		val = GjsonUintArray[uint8](array, math.MaxUint8)
-	case model.UInt16:
-		val = GjsonUintArray[uint16](array, math.MaxUint16)
-	case model.UInt32:
-		val = GjsonUintArray[uint32](array, math.MaxUint32)
-	case model.UInt64:
-		val = GjsonUintArray[uint64](array, math.MaxUint64)
-	case model.Float32:
-		val = GjsonFloatArray[float32](array, math.MaxFloat32)
-	case model.Float64:
-		val = GjsonFloatArray[float64](array, math.MaxFloat64)
-	case model.Decimal:
-		results := make([]decimal.Decimal, 0, len(array))
-		var f float64
-		for _, e := range array {
-			switch e.Type {
-			case gjson.Number:
-				f = e.Num
-			default:
-				f = float64(0.0)
-			}
-			results = append(results, decimal.NewFromFloat(f))
-		}
-		val = results
-	case model.String:
-		results := make([]string, 0, len(array))
-		var s string
-		for _, e := range array {
-			switch e.Type {
-			case gjson.Null:
-				s = ""
-			case gjson.String:
-				s = e.Str
-			default:
-				s = e.Raw
-			}
-			results = append(results, s)
-		}
-		val = results
-	case model.DateTime:
-		results := make([]time.Time, 0, len(array))
-		var t time.Time
-		for _, e := range array {
-			switch e.Type {
-			case gjson.Number:
-				t = UnixFloat(e.Num, c.pp.timeUnit)
-			case gjson.String:
-				var err error
-				if t, err = c.pp.ParseDateTime(key, e.Str); err != nil {
-					t = Epoch
-				}
-			default:
-				t = Epoch
-			}
-			results = append(results, t)
-		}
-		val = results
-	default:
-		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported array type %v", typ))
-	}
-	return
+	return getGJsonArray(&GjsonMetric{c.pp, str}, key, gjson.Parse(str), typeinfo)
 }
 
 func (c *CsvMetric) GetObject(key string, nullable bool) (val interface{}) {
 	return
 }
 
+// GetMap parse an CSV encoded map, which is a JSON object
 func (c *CsvMetric) GetMap(key string, typeinfo *model.TypeInfo) (val interface{}) {
-	return
+	s := c.GetString(key, false)
+	str, _ := s.(string)
+	return getGJsonMap(&GjsonMetric{c.pp, str}, gjson.Parse(str), typeinfo)
+}
+
+// GetTuple parse an CSV encoded tuple, which is a JSON object or array
+func (c *CsvMetric) GetTuple(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	s := c.GetString(key, false)
+	str, _ := s.(string)
+	return getGJsonTuple(&GjsonMetric{c.pp, str}, key, gjson.Parse(str), typeinfo)
+}
+
+// GetJSON returns the field if it's a JSON object
+func (c *CsvMetric) GetJSON(key string, nullable bool) (val interface{}) {
+	s, ok := c.value(key)
+	if !ok {
+		return getDefaultJSON(nullable)
+	}
+	return getGJsonJSON(gjson.Parse(s), nullable)
+}
+
+// GetVariant parse an CSV encoded Variant or Dynamic value, fields which aren't valid JSON are strings
+func (c *CsvMetric) GetVariant(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	s, ok := c.value(key)
+	if !ok {
+		return
+	}
+	r := gjson.Result{Type: gjson.String, Raw: strconv.Quote(s), Str: s}
+	if gjson.Valid(s) {
+		r = gjson.Parse(s)
+	}
+	return getGJsonVariant(&GjsonMetric{c.pp, s}, key, r, typeinfo)
+}
+
+func (c *CsvMetric) GetRest(columns map[string]struct{}, white, black *regexp.Regexp) (val interface{}) {
+	return EmptyJSON
 }
 
 func (c *CsvMetric) GetNewKeys(knownKeys, newKeys, warnKeys *sync.Map, white, black *regexp.Regexp, partition int, offset int64) bool {
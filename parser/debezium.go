@@ -0,0 +1,187 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"strconv"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/valyala/fastjson"
+)
+
+var _ Parser = (*DebeziumParser)(nil)
+var _ MessageParser = (*DebeziumParser)(nil)
+
+func init() {
+	Register("debezium", func(pp *Pool) (Parser, error) {
+		var obj *fastjson.Object
+		if pp.fields != "" {
+			value, err := fastjson.Parse(pp.fields)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+				return nil, err
+			}
+			if obj, err = value.Object(); err != nil {
+				err = errors.Wrapf(err, "failed to retrive fields member")
+				return nil, err
+			}
+		}
+		p := &DebeziumParser{pp: pp, opts: pp.cdc, fields: obj}
+		if p.opts == nil {
+			p.opts = &cdcOptions{}
+		}
+		return p, nil
+	}, CapDynamicSchema, Configurer(configureCdc))
+}
+
+// DebeziumParser unwraps the row of Debezium change events in JSON, either with or without the schema.
+// The row is "after" for creates, snapshot reads and updates, and "before" for deletes.
+// Fields CdcOp and CdcTsMs are added to the row, in the same way as the ExtractNewRecordState transformation.
+// Columns set by LoadCdc are filled, the version is the LSN of Postgres, the binlog position of MySQL, or ts_ms of the source for other connectors.
+// Tombstones are deletes of the key versioned by the message timestamp, unless they follow delete events of the key.
+type DebeziumParser struct {
+	pp     *Pool
+	opts   *cdcOptions
+	fjp    fastjson.Parser
+	kfjp   fastjson.Parser
+	arena  fastjson.Arena
+	fields *fastjson.Object
+}
+
+func (p *DebeziumParser) Parse(bs []byte) (metric model.Metric, err error) {
+	return p.ParseMessage(bs, nil)
+}
+
+func (p *DebeziumParser) ParseMessage(bs []byte, msg *model.InputMessage) (metric model.Metric, err error) {
+	p.arena.Reset()
+	var row *fastjson.Value
+	var op string
+	if len(bs) == 0 {
+		if row, err = p.tombstone(msg); err != nil {
+			return
+		}
+		op = "d"
+	} else {
+		var value *fastjson.Value
+		if value, err = p.fjp.ParseBytes(bs); err != nil {
+			err = errors.Wrapf(err, "failed to parse Debezium event")
+			return
+		}
+		envelope := unwrapPayload(value)
+		op = string(envelope.GetStringBytes("op"))
+		switch op {
+		case "c", "r", "u":
+			row = envelope.Get("after")
+		case "d":
+			row = envelope.Get("before")
+			if !p.opts.ignoreTombstones && msg != nil && len(msg.Key) != 0 {
+				p.pp.cdcDeletes.add(msg)
+			}
+		case "":
+			err = errors.Newf("message isn't a Debezium change event")
+			return
+		default:
+			err = errors.Newf("unsupported Debezium op %q", op)
+			return
+		}
+		if row == nil || row.Type() != fastjson.TypeObject {
+			err = errors.Newf("Debezium change event of op %q has no row", op)
+			return
+		}
+		if tsMs := envelope.Get("ts_ms"); tsMs != nil {
+			row.Set(CdcTsMs, tsMs)
+		}
+		if p.opts.versionColumn != "" {
+			if version, ok := debeziumVersion(envelope.Get("source")); ok {
+				row.Set(p.opts.versionColumn, p.arena.NewNumberString(strconv.FormatUint(version, 10)))
+			}
+		}
+	}
+	row.Set(CdcOp, p.arena.NewString(op))
+	p.opts.setFastjson(row, &p.arena, op == "d")
+	if p.fields != nil {
+		p.fields.Visit(func(key []byte, v *fastjson.Value) {
+			row.Set(string(key), v)
+		})
+	}
+	metric = &FastjsonMetric{pp: p.pp, value: row}
+	return
+}
+
+// tombstone returns the key of a tombstone as the row.
+// Tombstones following delete events of the same key are skipped, since the rows are deleted already.
+func (p *DebeziumParser) tombstone(msg *model.InputMessage) (row *fastjson.Value, err error) {
+	if p.opts.ignoreTombstones {
+		err = ErrSkipped
+		return
+	}
+	if msg == nil || len(msg.Key) == 0 {
+		err = errors.Newf("Debezium tombstone has no key")
+		return
+	}
+	if p.pp.cdcDeletes.follows(msg) {
+		err = ErrSkipped
+		return
+	}
+	var key *fastjson.Value
+	if key, err = p.kfjp.ParseBytes(msg.Key); err != nil {
+		err = errors.Wrapf(err, "failed to parse the key of Debezium tombstone")
+		return
+	}
+	if row = unwrapPayload(key); row.Type() != fastjson.TypeObject {
+		err = errors.Newf("the key of Debezium tombstone isn't an object")
+		return
+	}
+	// the message timestamp, or the offset if there's none, is the version
+	version := msg.Offset
+	if msg.Timestamp != nil {
+		version = msg.Timestamp.UnixMilli()
+		row.Set(CdcTsMs, p.arena.NewNumberString(strconv.FormatInt(version, 10)))
+	}
+	if p.opts.versionColumn != "" {
+		row.Set(p.opts.versionColumn, p.arena.NewNumberString(strconv.FormatInt(version, 10)))
+	}
+	return
+}
+
+// unwrapPayload returns the payload of a message serialized with schemas.enable=true
+func unwrapPayload(v *fastjson.Value) *fastjson.Value {
+	if payload := v.Get("payload"); payload != nil && v.Exists("schema") {
+		return payload
+	}
+	return v
+}
+
+// debeziumVersion returns the position of the change in the source database
+func debeziumVersion(source *fastjson.Value) (version uint64, ok bool) {
+	if source == nil {
+		return
+	}
+	if lsn := source.Get("lsn"); lsn != nil && lsn.Type() == fastjson.TypeNumber {
+		version, ok = lsn.GetUint64(), true
+		return
+	}
+	if file := string(source.GetStringBytes("file")); file != "" {
+		if version, ok = binlogVersion(file, source.GetUint64("pos")); ok {
+			return
+		}
+	}
+	if tsMs := source.Get("ts_ms"); tsMs != nil && tsMs.Type() == fastjson.TypeNumber {
+		version, ok = tsMs.GetUint64(), true
+	}
+	return
+}
@@ -0,0 +1,164 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+// MaxDecodedSize limits the size of a decompressed message value, larger values fail parsing rather than exhausting memory
+const MaxDecodedSize = 64 << 20
+
+// errDecodedSize reports a value which decompresses to more than MaxDecodedSize bytes
+var errDecodedSize = errors.Newf("decoded size exceeds %d bytes", MaxDecodedSize)
+
+// snappyStreamMagic is the header of the snappy framing format, the block format is assumed otherwise
+var snappyStreamMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// zstdDecoder is shared since it's safe for concurrent DecodeAll
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxDecodedSize))
+
+var valueDecoders = map[string]func(bs []byte) ([]byte, error){
+	"identity": func(bs []byte) ([]byte, error) { return bs, nil },
+	"base64":   decodeBase64,
+	"gzip":     decodeGzip,
+	"zstd":     decodeZstd,
+	"snappy":   decodeSnappy,
+}
+
+// ValueDecoder applies a pipeline of encodings to message values before parsing
+type ValueDecoder struct {
+	steps []func(bs []byte) ([]byte, error)
+}
+
+// NewValueDecoder creates a decoder from a pipeline such as "base64|gzip", which is applied from left to right.
+// Supported encodings are identity, base64, gzip, zstd and snappy.
+func NewValueDecoder(pipeline string) (dec *ValueDecoder, err error) {
+	dec = &ValueDecoder{}
+	for _, name := range strings.Split(pipeline, "|") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		fn, ok := valueDecoders[name]
+		if !ok {
+			err = errors.Newf("unknown value encoding %s", name)
+			return
+		}
+		dec.steps = append(dec.steps, fn)
+	}
+	return
+}
+
+// Decode applies the pipeline to bs
+func (dec *ValueDecoder) Decode(bs []byte) (out []byte, err error) {
+	out = bs
+	for _, step := range dec.steps {
+		if out, err = step(out); err != nil {
+			err = errors.Wrapf(err, "failed to decode message value")
+			return
+		}
+	}
+	return
+}
+
+// ValueDecoders caches the decoder of each pipeline, which is chosen per message by a header
+type ValueDecoders struct {
+	decoders sync.Map
+}
+
+// Get returns the decoder of pipeline
+func (vd *ValueDecoders) Get(pipeline string) (dec *ValueDecoder, err error) {
+	if v, ok := vd.decoders.Load(pipeline); ok {
+		return v.(*ValueDecoder), nil
+	}
+	if dec, err = NewValueDecoder(pipeline); err != nil {
+		return
+	}
+	vd.decoders.Store(pipeline, dec)
+	return
+}
+
+func decodeBase64(bs []byte) (out []byte, err error) {
+	bs = bytes.TrimSpace(bs)
+	out = make([]byte, base64.StdEncoding.DecodedLen(len(bs)))
+	var n int
+	if n, err = base64.StdEncoding.Decode(out, bs); err != nil {
+		// unpadded or URL-safe alphabet
+		enc := base64.RawStdEncoding
+		if bytes.ContainsAny(bs, "-_") {
+			enc = base64.RawURLEncoding
+		}
+		bs = bytes.TrimRight(bs, "=")
+		out = make([]byte, enc.DecodedLen(len(bs)))
+		if n, err = enc.Decode(out, bs); err != nil {
+			return
+		}
+	}
+	out = out[:n]
+	return
+}
+
+func decodeGzip(bs []byte) (out []byte, err error) {
+	var r *gzip.Reader
+	if r, err = gzip.NewReader(bytes.NewReader(bs)); err != nil {
+		return
+	}
+	defer r.Close()
+	return readLimited(r)
+}
+
+func decodeZstd(bs []byte) (out []byte, err error) {
+	if out, err = zstdDecoder.DecodeAll(bs, nil); errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		err = errDecodedSize
+	}
+	return
+}
+
+func decodeSnappy(bs []byte) (out []byte, err error) {
+	if bytes.HasPrefix(bs, snappyStreamMagic) {
+		return readLimited(snappy.NewReader(bytes.NewReader(bs)))
+	}
+	var n int
+	if n, err = snappy.DecodedLen(bs); err != nil {
+		return
+	}
+	if n > MaxDecodedSize {
+		err = errDecodedSize
+		return
+	}
+	return snappy.Decode(nil, bs)
+}
+
+// readLimited reads r till EOF, failing if more than MaxDecodedSize bytes are read
+func readLimited(r io.Reader) (out []byte, err error) {
+	if out, err = io.ReadAll(io.LimitReader(r, MaxDecodedSize+1)); err != nil {
+		return
+	}
+	if len(out) > MaxDecodedSize {
+		out, err = nil, errDecodedSize
+	}
+	return
+}
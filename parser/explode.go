@@ -0,0 +1,121 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// ExplodeRootArray explodes a message which is a JSON array
+	ExplodeRootArray = "[]"
+	// ExplodeNDJSON explodes a message into lines, blank lines are skipped
+	ExplodeNDJSON = "ndjson"
+)
+
+// Explode splits a message into elements, each of which becomes a row.
+// path is ExplodeRootArray, ExplodeNDJSON, or a gjson path to an array inside a JSON object.
+// If inherit is true and path is a gjson path, top-level fields of the object except the array are copied into each element object,
+// fields of the element take precedence.
+func Explode(bs []byte, path string, inherit bool) (elems [][]byte, err error) {
+	switch path {
+	case ExplodeNDJSON:
+		for _, line := range bytes.Split(bs, []byte("\n")) {
+			if line = bytes.TrimSpace(line); len(line) != 0 {
+				elems = append(elems, line)
+			}
+		}
+		return
+	case ExplodeRootArray:
+		if !gjson.ValidBytes(bs) {
+			err = errors.Newf("message is not a valid JSON")
+			return
+		}
+		return arrayElems(gjson.ParseBytes(bs), "", nil)
+	}
+	if !gjson.ValidBytes(bs) {
+		err = errors.Newf("message is not a valid JSON")
+		return
+	}
+	root := gjson.ParseBytes(bs)
+	if !root.IsObject() {
+		err = errors.Newf("message is not a JSON object")
+		return
+	}
+	arr := root.Get(path)
+	if !arr.Exists() {
+		// nothing to explode
+		return
+	}
+	var inherited []inheritedField
+	if inherit {
+		// the top-level key holding the array isn't inherited
+		top := path
+		if i := strings.IndexByte(path, '.'); i >= 0 {
+			top = path[:i]
+		}
+		root.ForEach(func(k, v gjson.Result) bool {
+			if k.Str != top {
+				inherited = append(inherited, inheritedField{k.Str, k.Raw + ":" + v.Raw})
+			}
+			return true
+		})
+	}
+	return arrayElems(arr, path, inherited)
+}
+
+// inheritedField is a key and its raw JSON key-value pair
+type inheritedField struct {
+	key  string
+	pair string
+}
+
+func arrayElems(arr gjson.Result, path string, inherited []inheritedField) (elems [][]byte, err error) {
+	if !arr.IsArray() {
+		err = errors.Newf("%q is not a JSON array", path)
+		return
+	}
+	arr.ForEach(func(_, v gjson.Result) bool {
+		if len(inherited) == 0 || !v.IsObject() {
+			elems = append(elems, []byte(v.Raw))
+			return true
+		}
+		elems = append(elems, inheritFields(v, inherited))
+		return true
+	})
+	return
+}
+
+// inheritFields appends the inherited key-value pairs which are absent in obj
+func inheritFields(obj gjson.Result, inherited []inheritedField) []byte {
+	own := make(map[string]bool)
+	var pairs []string
+	obj.ForEach(func(k, v gjson.Result) bool {
+		own[k.Str] = true
+		pairs = append(pairs, k.Raw+":"+v.Raw)
+		return true
+	})
+	for _, f := range inherited {
+		if !own[f.key] {
+			pairs = append(pairs, f.pair)
+		}
+	}
+	return []byte("{" + strings.Join(pairs, ",") + "}")
+}
@@ -18,14 +18,17 @@ package parser
 import (
 	"fmt"
 	"math"
+	"math/big"
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/exp/constraints"
 
+	"github.com/ClickHouse/clickhouse-go/v2/lib/chcol"
 	"github.com/housepower/clickhouse_sinker/model"
 	"github.com/housepower/clickhouse_sinker/util"
 	"github.com/shopspring/decimal"
@@ -37,6 +40,28 @@ import (
 var _ Parser = (*FastjsonParser)(nil)
 var EmpytObject = make(map[string]interface{})
 
+// EmptyJSON is the value of JSON columns whose fields are absent or aren't objects
+const EmptyJSON = "{}"
+
+func init() {
+	Register("fastjson", func(pp *Pool) (Parser, error) {
+		var obj *fastjson.Object
+		if pp.fields != "" {
+			value, err := fastjson.Parse(pp.fields)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+				return nil, err
+			}
+			obj, err = value.Object()
+			if err != nil {
+				err = errors.Wrapf(err, "failed to retrive fields member")
+				return nil, err
+			}
+		}
+		return &FastjsonParser{pp: pp, fields: obj}, nil
+	}, CapDynamicSchema)
+}
+
 // FastjsonParser, parser for get data in json format
 type FastjsonParser struct {
 	pp     *Pool
@@ -66,64 +91,93 @@ type FastjsonMetric struct {
 	value *fastjson.Value
 }
 
+// get returns the field of key. Nested fields are reachable with flattened keys if the pool has a flatten separator.
+func (c *FastjsonMetric) get(key string) *fastjson.Value {
+	if v := c.value.Get(key); v != nil || c.pp.flattenSep == "" {
+		return v
+	}
+	return fjFlattenGet(c.value, key, c.pp.flattenSep, c.pp.flattenMaxDepth)
+}
+
+// fjFlattenGet returns the field of the flattened key in v, descending at most depth levels.
+// Each prefix of key ending before a separator is tried, since keys may contain the separator.
+func fjFlattenGet(v *fastjson.Value, key, sep string, depth int) *fastjson.Value {
+	if r := v.Get(key); r != nil || depth <= 0 {
+		return r
+	}
+	for i := strings.Index(key, sep); i >= 0; {
+		if sub := v.Get(key[:i]); sub != nil && sub.Type() == fastjson.TypeObject {
+			if r := fjFlattenGet(sub, key[i+len(sep):], sep, depth-1); r != nil {
+				return r
+			}
+		}
+		j := strings.Index(key[i+len(sep):], sep)
+		if j < 0 {
+			break
+		}
+		i += len(sep) + j
+	}
+	return nil
+}
+
 func (c *FastjsonMetric) GetString(key string, nullable bool) (val interface{}) {
-	return getString(c.value.Get(key), nullable)
+	return getString(c.get(key), nullable)
 }
 
 func (c *FastjsonMetric) GetBool(key string, nullable bool) interface{} {
-	return getBool(c.value.Get(key), nullable)
+	return getBool(c.get(key), nullable)
 }
 
 func (c *FastjsonMetric) GetDecimal(key string, nullable bool) (val interface{}) {
-	return getDecimal(c.value.Get(key), nullable)
+	return getDecimal(c.get(key), nullable)
 }
 
 func (c *FastjsonMetric) GetInt8(key string, nullable bool) (val interface{}) {
-	return FastjsonGetInt[int8](c.value.Get(key), nullable, math.MinInt8, math.MaxInt8)
+	return FastjsonGetInt[int8](c.get(key), nullable, math.MinInt8, math.MaxInt8)
 }
 
 func (c *FastjsonMetric) GetInt16(key string, nullable bool) (val interface{}) {
-	return FastjsonGetInt[int16](c.value.Get(key), nullable, math.MinInt16, math.MaxInt16)
+	return FastjsonGetInt[int16](c.get(key), nullable, math.MinInt16, math.MaxInt16)
 }
 
 func (c *FastjsonMetric) GetInt32(key string, nullable bool) (val interface{}) {
-	return FastjsonGetInt[int32](c.value.Get(key), nullable, math.MinInt32, math.MaxInt32)
+	return FastjsonGetInt[int32](c.get(key), nullable, math.MinInt32, math.MaxInt32)
 }
 
 func (c *FastjsonMetric) GetInt64(key string, nullable bool) (val interface{}) {
-	return FastjsonGetInt[int64](c.value.Get(key), nullable, math.MinInt64, math.MaxInt64)
+	return FastjsonGetInt[int64](c.get(key), nullable, math.MinInt64, math.MaxInt64)
 }
 
 func (c *FastjsonMetric) GetUint8(key string, nullable bool) (val interface{}) {
-	return FastjsonGetUint[uint8](c.value.Get(key), nullable, math.MaxUint8)
+	return FastjsonGetUint[uint8](c.get(key), nullable, math.MaxUint8)
 }
 
 func (c *FastjsonMetric) GetUint16(key string, nullable bool) (val interface{}) {
-	return FastjsonGetUint[uint16](c.value.Get(key), nullable, math.MaxUint16)
+	return FastjsonGetUint[uint16](c.get(key), nullable, math.MaxUint16)
 }
 
 func (c *FastjsonMetric) GetUint32(key string, nullable bool) (val interface{}) {
-	return FastjsonGetUint[uint32](c.value.Get(key), nullable, math.MaxUint32)
+	return FastjsonGetUint[uint32](c.get(key), nullable, math.MaxUint32)
 }
 
 func (c *FastjsonMetric) GetUint64(key string, nullable bool) (val interface{}) {
-	return FastjsonGetUint[uint64](c.value.Get(key), nullable, math.MaxUint64)
+	return FastjsonGetUint[uint64](c.get(key), nullable, math.MaxUint64)
 }
 
 func (c *FastjsonMetric) GetFloat32(key string, nullable bool) (val interface{}) {
-	return FastjsonGetFloat[float32](c.value.Get(key), nullable, math.MaxFloat32)
+	return FastjsonGetFloat[float32](c.get(key), nullable, math.MaxFloat32)
 }
 
 func (c *FastjsonMetric) GetFloat64(key string, nullable bool) (val interface{}) {
-	return FastjsonGetFloat[float64](c.value.Get(key), nullable, math.MaxFloat64)
+	return FastjsonGetFloat[float64](c.get(key), nullable, math.MaxFloat64)
 }
 
 func (c *FastjsonMetric) GetIPv4(key string, nullable bool) (val interface{}) {
-	return getIPv4(c.value.Get(key), nullable)
+	return getIPv4(c.get(key), nullable)
 }
 
 func (c *FastjsonMetric) GetIPv6(key string, nullable bool) (val interface{}) {
-	return getIPv6(c.value.Get(key), nullable)
+	return getIPv6(c.get(key), nullable)
 }
 
 func FastjsonGetInt[T constraints.Signed](v *fastjson.Value, nullable bool, min, max int64) (val interface{}) {
@@ -188,21 +242,70 @@ func FastjsonGetFloat[T constraints.Float](v *fastjson.Value, nullable bool, max
 }
 
 func (c *FastjsonMetric) GetDateTime(key string, nullable bool) (val interface{}) {
-	return getDateTime(c, key, c.value.Get(key), nullable)
+	return getDateTime(c, key, c.get(key), dateTimeType(nullable))
+}
+
+func (c *FastjsonMetric) GetTime(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return getDateTime(c, key, c.get(key), typeinfo)
+}
+
+func (c *FastjsonMetric) GetBigInt(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return getBigInt(c.get(key), typeinfo.Type, typeinfo.Nullable)
 }
 
 func (c *FastjsonMetric) GetObject(key string, nullable bool) (val interface{}) {
-	v := c.value.Get(key)
+	v := c.get(key)
 	val = val2map(v)
 	return
 }
 
-func (c *FastjsonMetric) GetArray(key string, typ int) (val interface{}) {
-	return getArray(c, key, c.value.Get(key), typ)
+func (c *FastjsonMetric) GetJSON(key string, nullable bool) (val interface{}) {
+	return getJSON(c.get(key), nullable)
+}
+
+func (c *FastjsonMetric) GetVariant(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return getVariant(c, key, c.get(key), typeinfo)
+}
+
+func (c *FastjsonMetric) GetArray(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	v := c.get(key)
+	if v == nil {
+		v = fjNestedGet(c.value, key)
+	}
+	return getArray(c, key, v, typeinfo)
+}
+
+// fjNestedGet returns the array of member b of objects in array a for key "a.b", which is a column of Nested a.
+// Objects without the member contribute nulls, so that arrays of the same Nested have the same length.
+func fjNestedGet(v *fastjson.Value, key string) *fastjson.Value {
+	for i := strings.IndexByte(key, '.'); i > 0; {
+		if objs := v.Get(key[:i]); objs != nil && objs.Type() == fastjson.TypeArray {
+			var a fastjson.Arena
+			arr := a.NewArray()
+			for j, obj := range objs.GetArray() {
+				e := obj.Get(key[i+1:])
+				if e == nil {
+					e = a.NewNull()
+				}
+				arr.SetArrayItem(j, e)
+			}
+			return arr
+		}
+		j := strings.IndexByte(key[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += 1 + j
+	}
+	return nil
 }
 
 func (c *FastjsonMetric) GetMap(key string, typeinfo *model.TypeInfo) (val interface{}) {
-	return getMap(c, c.value.Get(key), typeinfo)
+	return getMap(c, c.get(key), typeinfo)
+}
+
+func (c *FastjsonMetric) GetTuple(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return getTuple(c, key, c.get(key), typeinfo)
 }
 
 func (c *FastjsonMetric) val2OrderedMap(v *fastjson.Value, typeinfo *model.TypeInfo) (m *model.OrderedMap) {
@@ -341,40 +444,62 @@ func getDecimal(v *fastjson.Value, nullable bool) (val interface{}) {
 	return
 }
 
-func getDateTime(c *FastjsonMetric, sourcename string, v *fastjson.Value, nullable bool) (val interface{}) {
+func getDateTime(c *FastjsonMetric, sourcename string, v *fastjson.Value, typeinfo *model.TypeInfo) (val interface{}) {
 	if !fjCompatibleDateTime(v) {
-		val = getDefaultDateTime(nullable)
+		val = getDefaultDateTime(typeinfo.Nullable)
 		return
 	}
-	var err error
+	var t time.Time
+	var ok bool
 	switch v.Type() {
 	case fastjson.TypeNumber:
-		var f float64
-		if f, err = v.Float64(); err != nil {
-			val = getDefaultDateTime(nullable)
-			return
-		}
-		val = UnixFloat(f, c.pp.timeUnit)
+		t, ok = c.pp.unixTime(string(v.MarshalTo(nil)), typeinfo)
 	case fastjson.TypeString:
-		var b []byte
-		if b, err = v.StringBytes(); err != nil || len(b) == 0 {
-			val = getDefaultDateTime(nullable)
-			return
-		}
-		if val, err = c.pp.ParseDateTime(sourcename, string(b)); err != nil {
-			val = getDefaultDateTime(nullable)
-		}
-	default:
-		val = getDefaultDateTime(nullable)
+		t, ok = c.pp.parseTime(sourcename, string(v.GetStringBytes()), typeinfo)
+	}
+	if !ok {
+		val = getDefaultDateTime(typeinfo.Nullable)
+		return
 	}
+	val = t
 	return
 }
 
-func getArray(c *FastjsonMetric, sourcename string, v *fastjson.Value, typ int) (val interface{}) {
+func getBigInt(v *fastjson.Value, typ int, nullable bool) (val interface{}) {
+	if v != nil {
+		switch v.Type() {
+		case fastjson.TypeNumber:
+			if i, ok := parseBigInt(string(v.MarshalTo(nil)), typ); ok {
+				return i
+			}
+		case fastjson.TypeString:
+			if i, ok := parseBigInt(string(v.GetStringBytes()), typ); ok {
+				return i
+			}
+		case fastjson.TypeTrue:
+			return big.NewInt(1)
+		case fastjson.TypeFalse:
+			return new(big.Int)
+		}
+	}
+	return getDefaultBigInt(nullable)
+}
+
+func getArray(c *FastjsonMetric, sourcename string, v *fastjson.Value, typeinfo *model.TypeInfo) (val interface{}) {
 	var array []*fastjson.Value
 	if v != nil {
 		array, _ = v.Array()
 	}
+	elem := typeinfo.ElemType()
+	if !elem.IsBasic() {
+		// arrays of Nullable, Array, Map and Tuple
+		arr := make([]interface{}, 0, len(array))
+		for _, e := range array {
+			arr = append(arr, c.castMapValueByType(sourcename, e, elem))
+		}
+		return arr
+	}
+	typ := elem.Type
 	switch typ {
 	case model.Bool:
 		arr := make([]bool, 0)
@@ -428,27 +553,8 @@ func getArray(c *FastjsonMetric, sourcename string, v *fastjson.Value, typ int)
 		val = arr
 	case model.DateTime:
 		arr := make([]time.Time, 0)
-		var t time.Time
 		for _, e := range array {
-			switch e.Type() {
-			case fastjson.TypeNumber:
-				if f, err := e.Float64(); err != nil {
-					t = Epoch
-				} else {
-					t = UnixFloat(f, c.pp.timeUnit)
-				}
-			case fastjson.TypeString:
-				if b, err := e.StringBytes(); err != nil || len(b) == 0 {
-					t = Epoch
-				} else {
-					var err error
-					if t, err = c.pp.ParseDateTime(sourcename, string(b)); err != nil {
-						t = Epoch
-					}
-				}
-			default:
-				t = Epoch
-			}
+			t, _ := getDateTime(c, sourcename, e, elem).(time.Time)
 			arr = append(arr, t)
 		}
 		val = arr
@@ -475,6 +581,12 @@ func getArray(c *FastjsonMetric, sourcename string, v *fastjson.Value, typ int)
 			arr = append(arr, v)
 		}
 		val = arr
+	case model.Int128, model.Int256, model.UInt128, model.UInt256:
+		arr := make([]*big.Int, 0)
+		for _, e := range array {
+			arr = append(arr, getBigInt(e, typ, false).(*big.Int))
+		}
+		val = arr
 	default:
 		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported array type %v", typ))
 	}
@@ -490,6 +602,53 @@ func getMap(c *FastjsonMetric, v *fastjson.Value, typeinfo *model.TypeInfo) (val
 	return
 }
 
+// getTuple returns the elements of a tuple, which is an object for named tuples or an array.
+// Missing elements get the default value of their types.
+func getTuple(c *FastjsonMetric, sourcename string, v *fastjson.Value, typeinfo *model.TypeInfo) (val interface{}) {
+	tuple := make([]interface{}, len(typeinfo.TupleTypes))
+	for i, typ := range typeinfo.TupleTypes {
+		var e *fastjson.Value
+		if v != nil {
+			if typeinfo.TupleNames != nil && v.Type() == fastjson.TypeObject {
+				e = v.Get(typeinfo.TupleNames[i])
+			} else if v.Type() == fastjson.TypeArray {
+				e = v.Get(strconv.Itoa(i))
+			}
+		}
+		tuple[i] = c.castMapValueByType(sourcename, e, typ)
+	}
+	return tuple
+}
+
+// getJSON returns the text of an object, values other than objects are taken as empty objects
+func getJSON(v *fastjson.Value, nullable bool) (val interface{}) {
+	if v == nil || v.Type() == fastjson.TypeNull {
+		return getDefaultJSON(nullable)
+	}
+	if v.Type() != fastjson.TypeObject {
+		return EmptyJSON
+	}
+	return v.String()
+}
+
+// getVariant returns a value of Variant or Dynamic typeinfo along with the type it's stored as
+func getVariant(c *FastjsonMetric, sourcename string, v *fastjson.Value, typeinfo *model.TypeInfo) (val interface{}) {
+	if v == nil || v.Type() == fastjson.TypeNull {
+		return
+	}
+	typ, array := fjDetectType(v, 0)
+	if typeinfo.Type == model.Dynamic {
+		if name := dynamicType(typ, array); name != "" {
+			return chcol.NewDynamicWithType(c.castMapValueByType(sourcename, v, model.WhichType(name)), name)
+		}
+		return chcol.NewDynamicWithType(v.String(), "String")
+	}
+	if i := variantMember(typeinfo, typ, array); i >= 0 {
+		return chcol.NewVariantWithType(c.castMapValueByType(sourcename, v, typeinfo.VariantTypes[i]), typeinfo.VariantNames[i])
+	}
+	return
+}
+
 func (c *FastjsonMetric) castMapKeyByType(key []byte, typeinfo *model.TypeInfo) (val interface{}) {
 	switch typeinfo.Type {
 	case model.Int8:
@@ -541,12 +700,19 @@ func (c *FastjsonMetric) castMapKeyByType(key []byte, typeinfo *model.TypeInfo)
 			util.Logger.Error("failed to parse map key", zap.Error(err))
 		}
 	case model.DateTime:
-		if res, err := c.pp.ParseDateTime(string(key), string(key)); err == nil {
+		if res, ok := c.pp.parseTime(string(key), string(key), typeinfo); ok {
 			return res
 		} else {
-			util.Logger.Error("failed to parse map key", zap.Error(err))
+			util.Logger.Error("failed to parse map key", zap.ByteString("key", key))
 		}
 		val = getDefaultDateTime(typeinfo.Nullable)
+	case model.Int128, model.Int256, model.UInt128, model.UInt256:
+		if res, ok := parseBigInt(string(key), typeinfo.Type); ok {
+			return res
+		} else {
+			util.Logger.Error("failed to parse map key", zap.ByteString("key", key))
+		}
+		val = getDefaultBigInt(typeinfo.Nullable)
 	case model.String:
 		return string(key)
 	case model.Float32:
@@ -564,7 +730,10 @@ func (c *FastjsonMetric) castMapKeyByType(key []byte, typeinfo *model.TypeInfo)
 
 func (c *FastjsonMetric) castMapValueByType(sourcename string, value *fastjson.Value, typeinfo *model.TypeInfo) (val interface{}) {
 	if typeinfo.Array {
-		val = getArray(c, sourcename, value, typeinfo.Type)
+		val = getArray(c, sourcename, value, typeinfo)
+		return
+	} else if typeinfo.Type == model.Tuple {
+		val = getTuple(c, sourcename, value, typeinfo)
 		return
 	} else {
 		switch typeinfo.Type {
@@ -597,13 +766,19 @@ func (c *FastjsonMetric) castMapValueByType(sourcename string, value *fastjson.V
 		case model.Decimal:
 			val = getDecimal(value, typeinfo.Nullable)
 		case model.DateTime:
-			val = getDateTime(c, sourcename, value, typeinfo.Nullable)
+			val = getDateTime(c, sourcename, value, typeinfo)
+		case model.Int128, model.Int256, model.UInt128, model.UInt256:
+			val = getBigInt(value, typeinfo.Type, typeinfo.Nullable)
 		case model.String:
 			val = getString(value, typeinfo.Nullable)
 		case model.Map:
 			val = getMap(c, value, typeinfo)
 		case model.Object:
 			val = val2map(value)
+		case model.JSON:
+			val = getJSON(value, typeinfo.Nullable)
+		case model.Variant, model.Dynamic:
+			val = getVariant(c, sourcename, value, typeinfo)
 		default:
 			util.Logger.Fatal("LOGIC ERROR: reached switch default condition")
 		}
@@ -672,23 +847,56 @@ func (c *FastjsonMetric) GetNewKeys(knownKeys, newKeys, warnKeys *sync.Map, whit
 	if obj, err = c.value.Object(); err != nil {
 		return
 	}
-	obj.Visit(func(key []byte, v *fastjson.Value) {
-		strKey := string(key)
-		if _, loaded := knownKeys.LoadOrStore(strKey, nil); !loaded {
-			if (white == nil || white.MatchString(strKey)) &&
-				(black == nil || !black.MatchString(strKey)) {
-				if typ, arr := fjDetectType(v, 0); typ != model.Unknown && typ != model.Object && !arr {
-					newKeys.Store(strKey, typ)
-					foundNew = true
-				} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
-					util.Logger.Warn("FastjsonMetric.GetNewKeys ignored new key due to unsupported type of dynamic column", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.String("value", v.String()))
+	sep := c.pp.flattenSep
+	var visit func(obj *fastjson.Object, prefix string, depth int)
+	visit = func(obj *fastjson.Object, prefix string, depth int) {
+		obj.Visit(func(key []byte, v *fastjson.Value) {
+			strKey := prefix + string(key)
+			if sep != "" && depth < c.pp.flattenMaxDepth && v.Type() == fastjson.TypeObject {
+				// leaves of an object are new keys unless the object is a known column, e.g. a Map
+				if _, known := knownKeys.Load(strKey); !known {
+					sub, _ := v.Object()
+					visit(sub, strKey+sep, depth+1)
+					return
 				}
-			} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
-				util.Logger.Warn("FastjsonMetric.GetNewKeys ignored new key due to white/black list setting", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.String("value", v.String()))
-				knownKeys.Store(strKey, nil)
 			}
+			foundNew = c.newKey(strKey, v, knownKeys, newKeys, warnKeys, white, black, partition, offset) || foundNew
+		})
+	}
+	visit(obj, "", 0)
+	return
+}
+
+func (c *FastjsonMetric) GetRest(columns map[string]struct{}, white, black *regexp.Regexp) (val interface{}) {
+	obj, err := c.value.Object()
+	if err != nil {
+		return EmptyJSON
+	}
+	var a fastjson.Arena
+	rest := a.NewObject()
+	obj.Visit(func(key []byte, v *fastjson.Value) {
+		if strKey := string(key); isRestKey(strKey, strKey, columns, white, black) {
+			rest.Set(strKey, v)
 		}
 	})
+	return string(rest.MarshalTo(nil))
+}
+
+func (c *FastjsonMetric) newKey(strKey string, v *fastjson.Value, knownKeys, newKeys, warnKeys *sync.Map, white, black *regexp.Regexp, partition int, offset int64) (foundNew bool) {
+	if _, loaded := knownKeys.LoadOrStore(strKey, nil); !loaded {
+		if (white == nil || white.MatchString(strKey)) &&
+			(black == nil || !black.MatchString(strKey)) {
+			if typ, arr := fjDetectType(v, 0); typ != model.Unknown && typ != model.Object && !arr {
+				newKeys.Store(strKey, typ)
+				foundNew = true
+			} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
+				util.Logger.Warn("FastjsonMetric.GetNewKeys ignored new key due to unsupported type of dynamic column", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.String("value", v.String()))
+			}
+		} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
+			util.Logger.Warn("FastjsonMetric.GetNewKeys ignored new key due to white/black list setting", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.String("value", v.String()))
+			knownKeys.Store(strKey, nil)
+		}
+	}
 	return
 }
 
@@ -769,6 +977,22 @@ func getDefaultDecimal(nullable bool) (val interface{}) {
 	return
 }
 
+func getDefaultBigInt(nullable bool) (val interface{}) {
+	if nullable {
+		return
+	}
+	val = new(big.Int)
+	return
+}
+
+func getDefaultJSON(nullable bool) (val interface{}) {
+	if nullable {
+		return
+	}
+	val = EmptyJSON
+	return
+}
+
 func getDefaultDateTime(nullable bool) (val interface{}) {
 	if nullable {
 		return
@@ -18,12 +18,15 @@ package parser
 import (
 	"fmt"
 	"math"
+	"math/big"
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2/lib/chcol"
 	"github.com/shopspring/decimal"
 	"github.com/tidwall/gjson"
 	"go.uber.org/zap"
@@ -35,6 +38,12 @@ import (
 
 var _ Parser = (*GjsonParser)(nil)
 
+func init() {
+	Register("gjson", func(pp *Pool) (Parser, error) {
+		return &GjsonParser{pp: pp}, nil
+	}, CapDynamicSchema)
+}
+
 type GjsonParser struct {
 	pp *Pool
 }
@@ -54,9 +63,46 @@ func (c *GjsonMetric) getField(key string) gjson.Result {
 	if !ret.Exists() {
 		ret = gjson.Get(c.raw, key)
 	}
+	if !ret.Exists() && c.pp.flattenSep != "" {
+		// key is a source name whose dots are escaped, see util.GetSourceName
+		ret = gjFlattenGet(gjson.Parse(c.raw), strings.ReplaceAll(key, "\\.", "."), c.pp.flattenSep, c.pp.flattenMaxDepth)
+	}
 	return ret
 }
 
+// gjChild returns the member key of object r, keys aren't interpreted as paths
+func gjChild(r gjson.Result, key string) (child gjson.Result) {
+	r.ForEach(func(k, v gjson.Result) bool {
+		if k.Str == key {
+			child = v
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// gjFlattenGet returns the field of the flattened key in r, descending at most depth levels.
+// Each prefix of key ending before a separator is tried, since keys may contain the separator.
+func gjFlattenGet(r gjson.Result, key, sep string, depth int) gjson.Result {
+	if v := gjChild(r, key); v.Exists() || depth <= 0 {
+		return v
+	}
+	for i := strings.Index(key, sep); i >= 0; {
+		if sub := gjChild(r, key[:i]); sub.IsObject() {
+			if v := gjFlattenGet(sub, key[i+len(sep):], sep, depth-1); v.Exists() {
+				return v
+			}
+		}
+		j := strings.Index(key[i+len(sep):], sep)
+		if j < 0 {
+			break
+		}
+		i += len(sep) + j
+	}
+	return gjson.Result{}
+}
+
 func (c *GjsonMetric) GetString(key string, nullable bool) (val interface{}) {
 	return getGJsonString(c.getField(key), nullable)
 }
@@ -186,21 +232,103 @@ func GjsonGetFloat[T constraints.Float](c *GjsonMetric, r gjson.Result, nullable
 }
 
 func (c *GjsonMetric) GetDateTime(key string, nullable bool) (val interface{}) {
-	return getGJsonDateTime(c, key, c.getField(key), nullable)
+	return getGJsonDateTime(c, key, c.getField(key), dateTimeType(nullable))
+}
+
+func (c *GjsonMetric) GetTime(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return getGJsonDateTime(c, key, c.getField(key), typeinfo)
+}
+
+func (c *GjsonMetric) GetBigInt(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return getGJsonBigInt(c.getField(key), typeinfo.Type, typeinfo.Nullable)
 }
 
 func (c *GjsonMetric) GetObject(key string, nullable bool) (val interface{}) {
 	return
 }
 
-func (c *GjsonMetric) GetArray(key string, typ int) (val interface{}) {
-	return getGJsonArray(c, key, c.getField(key), typ)
+func (c *GjsonMetric) GetJSON(key string, nullable bool) (val interface{}) {
+	return getGJsonJSON(c.getField(key), nullable)
+}
+
+func (c *GjsonMetric) GetVariant(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return getGJsonVariant(c, key, c.getField(key), typeinfo)
+}
+
+func (c *GjsonMetric) GetArray(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	r := c.getField(key)
+	if !r.Exists() {
+		r = gjNestedGet(gjson.Parse(c.raw), strings.ReplaceAll(key, "\\.", "."))
+	}
+	return getGJsonArray(c, key, r, typeinfo)
+}
+
+// gjNestedGet returns the array of member b of objects in array a for key "a.b", which is a column of Nested a.
+// Objects without the member contribute nulls, so that arrays of the same Nested have the same length.
+func gjNestedGet(r gjson.Result, key string) gjson.Result {
+	for i := strings.IndexByte(key, '.'); i > 0; {
+		if objs := gjChild(r, key[:i]); objs.IsArray() {
+			var sb strings.Builder
+			sb.WriteByte('[')
+			for j, obj := range objs.Array() {
+				if j != 0 {
+					sb.WriteByte(',')
+				}
+				if e := gjChild(obj, key[i+1:]); e.Exists() {
+					sb.WriteString(e.Raw)
+				} else {
+					sb.WriteString("null")
+				}
+			}
+			sb.WriteByte(']')
+			return gjson.Parse(sb.String())
+		}
+		j := strings.IndexByte(key[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += 1 + j
+	}
+	return gjson.Result{}
 }
 
 func (c *GjsonMetric) GetMap(key string, typeinfo *model.TypeInfo) (val interface{}) {
 	return getGJsonMap(c, c.getField(key), typeinfo)
 }
 
+func (c *GjsonMetric) GetTuple(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return getGJsonTuple(c, key, c.getField(key), typeinfo)
+}
+
+// getGJsonJSON returns the text of an object, values other than objects are taken as empty objects
+func getGJsonJSON(r gjson.Result, nullable bool) (val interface{}) {
+	if !r.Exists() || r.Type == gjson.Null {
+		return getDefaultJSON(nullable)
+	}
+	if !r.IsObject() {
+		return EmptyJSON
+	}
+	return r.Raw
+}
+
+// getGJsonVariant returns a value of Variant or Dynamic typeinfo along with the type it's stored as
+func getGJsonVariant(c *GjsonMetric, sourcename string, r gjson.Result, typeinfo *model.TypeInfo) (val interface{}) {
+	if !r.Exists() || r.Type == gjson.Null {
+		return
+	}
+	typ, array := gjDetectType(r, 0)
+	if typeinfo.Type == model.Dynamic {
+		if name := dynamicType(typ, array); name != "" {
+			return chcol.NewDynamicWithType(c.castResultByType(sourcename, r, model.WhichType(name)), name)
+		}
+		return chcol.NewDynamicWithType(r.Raw, "String")
+	}
+	if i := variantMember(typeinfo, typ, array); i >= 0 {
+		return chcol.NewVariantWithType(c.castResultByType(sourcename, r, typeinfo.VariantTypes[i]), typeinfo.VariantNames[i])
+	}
+	return
+}
+
 func (c *GjsonMetric) val2OrderedMap(v gjson.Result, typeinfo *model.TypeInfo) (m *model.OrderedMap) {
 	m = model.NewOrderedMap()
 	v.ForEach(func(k, v gjson.Result) bool {
@@ -280,31 +408,63 @@ func GjsonFloatArray[T constraints.Float](a []gjson.Result, max float64) (arr []
 }
 
 func (c *GjsonMetric) GetNewKeys(knownKeys, newKeys, warnKeys *sync.Map, white, black *regexp.Regexp, partition int, offset int64) (foundNew bool) {
-	ite := func(k, v gjson.Result) bool {
-		strKey := k.Str
-		if _, loaded := knownKeys.LoadOrStore(strKey, nil); !loaded {
-			if (white == nil || white.MatchString(strKey)) &&
-				(black == nil || !black.MatchString(strKey)) {
-				if typ, array := gjDetectType(v, 0); typ != model.Unknown && typ != model.Object && !array {
-					newKeys.Store(strKey, typ)
-					foundNew = true
-				} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
-					util.Logger.Warn("GjsonMetric.GetNewKeys failed to detect field type", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.String("value", v.String()))
+	sep := c.pp.flattenSep
+	var ite func(prefix string, depth int) func(k, v gjson.Result) bool
+	ite = func(prefix string, depth int) func(k, v gjson.Result) bool {
+		return func(k, v gjson.Result) bool {
+			strKey := prefix + k.Str
+			// knownKeys are source names, whose dots are escaped
+			srcKey := util.GetSourceName("gjson", strKey)
+			if sep != "" && depth < c.pp.flattenMaxDepth && v.IsObject() {
+				// leaves of an object are new keys unless the object is a known column, e.g. a Map
+				if _, known := knownKeys.Load(srcKey); !known {
+					v.ForEach(ite(strKey+sep, depth+1))
+					return true
+				}
+			}
+			if _, loaded := knownKeys.LoadOrStore(srcKey, nil); !loaded {
+				if (white == nil || white.MatchString(strKey)) &&
+					(black == nil || !black.MatchString(strKey)) {
+					if typ, array := gjDetectType(v, 0); typ != model.Unknown && typ != model.Object && !array {
+						newKeys.Store(strKey, typ)
+						foundNew = true
+					} else if _, loaded = warnKeys.LoadOrStore(srcKey, nil); !loaded {
+						util.Logger.Warn("GjsonMetric.GetNewKeys failed to detect field type", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.String("value", v.String()))
+					}
+				} else if _, loaded = warnKeys.LoadOrStore(srcKey, nil); !loaded {
+					util.Logger.Warn("GjsonMetric.GetNewKeys ignored new key due to white/black list setting", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.String("value", v.String()))
+					knownKeys.Store(srcKey, nil)
 				}
-			} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
-				util.Logger.Warn("GjsonMetric.GetNewKeys ignored new key due to white/black list setting", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.String("value", v.String()))
-				knownKeys.Store(strKey, nil)
 			}
+			return true
 		}
-		return true
 	}
 
-	c.pp.once.Do(func() { gjson.Parse(c.pp.fields).ForEach(ite) })
-	gjson.Parse(c.raw).ForEach(ite)
+	c.pp.once.Do(func() { gjson.Parse(c.pp.fields).ForEach(ite("", 0)) })
+	gjson.Parse(c.raw).ForEach(ite("", 0))
 
 	return
 }
 
+func (c *GjsonMetric) GetRest(columns map[string]struct{}, white, black *regexp.Regexp) (val interface{}) {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	gjson.Parse(c.raw).ForEach(func(k, v gjson.Result) bool {
+		// columns are source names, whose dots are escaped
+		if isRestKey(util.GetSourceName("gjson", k.Str), k.Str, columns, white, black) {
+			if sb.Len() > 1 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(k.Raw)
+			sb.WriteByte(':')
+			sb.WriteString(v.Raw)
+		}
+		return true
+	})
+	sb.WriteByte('}')
+	return sb.String()
+}
+
 func gjCompatibleBool(r gjson.Result) (ok bool) {
 	if !r.Exists() {
 		return
@@ -391,7 +551,10 @@ func gjDetectType(v gjson.Result, depth int) (typ int, array bool) {
 
 func (c *GjsonMetric) castResultByType(sourcename string, value gjson.Result, typeinfo *model.TypeInfo) (val interface{}) {
 	if typeinfo.Array {
-		val = getGJsonArray(c, sourcename, value, typeinfo.Type)
+		val = getGJsonArray(c, sourcename, value, typeinfo)
+		return
+	} else if typeinfo.Type == model.Tuple {
+		val = getGJsonTuple(c, sourcename, value, typeinfo)
 		return
 	} else {
 		switch typeinfo.Type {
@@ -424,11 +587,17 @@ func (c *GjsonMetric) castResultByType(sourcename string, value gjson.Result, ty
 		case model.Decimal:
 			val = getGJsonDecimal(value, typeinfo.Nullable)
 		case model.DateTime:
-			val = getGJsonDateTime(c, sourcename, value, typeinfo.Nullable)
+			val = getGJsonDateTime(c, sourcename, value, typeinfo)
+		case model.Int128, model.Int256, model.UInt128, model.UInt256:
+			val = getGJsonBigInt(value, typeinfo.Type, typeinfo.Nullable)
 		case model.String:
 			val = getGJsonString(value, typeinfo.Nullable)
 		case model.Map:
 			val = getGJsonMap(c, value, typeinfo)
+		case model.JSON:
+			val = getGJsonJSON(value, typeinfo.Nullable)
+		case model.Variant, model.Dynamic:
+			val = getGJsonVariant(c, sourcename, value, typeinfo)
 		default:
 			util.Logger.Fatal("LOGIC ERROR: reached switch default condition")
 		}
@@ -528,30 +697,60 @@ func getGJsonIPv6(c *GjsonMetric, r gjson.Result, nullable bool) (val interface{
 	return
 }
 
-func getGJsonDateTime(c *GjsonMetric, key string, r gjson.Result, nullable bool) (val interface{}) {
+func getGJsonDateTime(c *GjsonMetric, key string, r gjson.Result, typeinfo *model.TypeInfo) (val interface{}) {
 	if !gjCompatibleDateTime(r) {
-		val = getDefaultDateTime(nullable)
+		val = getDefaultDateTime(typeinfo.Nullable)
 		return
 	}
+	var t time.Time
+	var ok bool
 	switch r.Type {
 	case gjson.Number:
-		val = UnixFloat(r.Num, c.pp.timeUnit)
+		t, ok = c.pp.unixTime(r.Raw, typeinfo)
 	case gjson.String:
-		var err error
-		if val, err = c.pp.ParseDateTime(key, r.Str); err != nil {
-			val = getDefaultDateTime(nullable)
-		}
-	default:
-		val = getDefaultDateTime(nullable)
+		t, ok = c.pp.parseTime(key, r.Str, typeinfo)
+	}
+	if !ok {
+		val = getDefaultDateTime(typeinfo.Nullable)
+		return
 	}
+	val = t
 	return
 }
 
-func getGJsonArray(c *GjsonMetric, key string, r gjson.Result, typ int) (val interface{}) {
+func getGJsonBigInt(r gjson.Result, typ int, nullable bool) (val interface{}) {
+	switch r.Type {
+	case gjson.Number:
+		if i, ok := parseBigInt(r.Raw, typ); ok {
+			return i
+		}
+	case gjson.String:
+		if i, ok := parseBigInt(r.Str, typ); ok {
+			return i
+		}
+	case gjson.True:
+		return big.NewInt(1)
+	case gjson.False:
+		return new(big.Int)
+	}
+	return getDefaultBigInt(nullable)
+}
+
+func getGJsonArray(c *GjsonMetric, key string, r gjson.Result, typeinfo *model.TypeInfo) (val interface{}) {
 	var array []gjson.Result
 	if r.IsArray() {
 		array = r.Array()
 	}
+	elem := typeinfo.ElemType()
+	if !elem.IsBasic() {
+		// arrays of Nullable, Array, Map and Tuple
+		arr := make([]interface{}, 0, len(array))
+		for _, e := range array {
+			arr = append(arr, c.castResultByType(key, e, elem))
+		}
+		return arr
+	}
+	typ := elem.Type
 	switch typ {
 	case model.Bool:
 		results := make([]bool, 0, len(array))
@@ -610,19 +809,8 @@ func getGJsonArray(c *GjsonMetric, key string, r gjson.Result, typ int) (val int
 		val = results
 	case model.DateTime:
 		results := make([]time.Time, 0, len(array))
-		var t time.Time
 		for _, e := range array {
-			switch e.Type {
-			case gjson.Number:
-				t = UnixFloat(e.Num, c.pp.timeUnit)
-			case gjson.String:
-				var err error
-				if t, err = c.pp.ParseDateTime(key, e.Str); err != nil {
-					t = Epoch
-				}
-			default:
-				t = Epoch
-			}
+			t, _ := getGJsonDateTime(c, key, e, elem).(time.Time)
 			results = append(results, t)
 		}
 		val = results
@@ -640,12 +828,38 @@ func getGJsonArray(c *GjsonMetric, key string, r gjson.Result, typ int) (val int
 			arr = append(arr, v)
 		}
 		val = arr
+	case model.Int128, model.Int256, model.UInt128, model.UInt256:
+		results := make([]*big.Int, 0, len(array))
+		for _, e := range array {
+			results = append(results, getGJsonBigInt(e, typ, false).(*big.Int))
+		}
+		val = results
 	default:
 		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported array type %v", typ))
 	}
 	return
 }
 
+// getGJsonTuple returns the elements of a tuple, which is an object for named tuples or an array.
+// Missing elements get the default value of their types.
+func getGJsonTuple(c *GjsonMetric, key string, r gjson.Result, typeinfo *model.TypeInfo) (val interface{}) {
+	tuple := make([]interface{}, len(typeinfo.TupleTypes))
+	var elems []gjson.Result
+	if r.IsArray() {
+		elems = r.Array()
+	}
+	for i, typ := range typeinfo.TupleTypes {
+		var e gjson.Result
+		if typeinfo.TupleNames != nil && r.IsObject() {
+			e = gjChild(r, typeinfo.TupleNames[i])
+		} else if i < len(elems) {
+			e = elems[i]
+		}
+		tuple[i] = c.castResultByType(key, e, typ)
+	}
+	return tuple
+}
+
 func getGJsonMap(c *GjsonMetric, r gjson.Result, typeinfo *model.TypeInfo) (val interface{}) {
 	if r.Type == gjson.JSON {
 		val = c.val2OrderedMap(r, typeinfo)
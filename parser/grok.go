@@ -0,0 +1,234 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+var _ Parser = (*GrokParser)(nil)
+
+func init() {
+	Register("grok", func(pp *Pool) (Parser, error) {
+		if pp.grok == nil {
+			return nil, errors.Newf("grok parser requires a pattern loaded with LoadGrok")
+		}
+		fields, err := parseFields(pp.fields)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+			return nil, err
+		}
+		return &GrokParser{pp: pp, fields: fields}, nil
+	}, CapDynamicSchema, Validator(func(taskCfg *config.TaskConfig) error {
+		if taskCfg.Grok.Pattern == "" {
+			return errors.Newf("Parser %s requires Grok.Pattern", taskCfg.Parser)
+		}
+		return nil
+	}), Configurer(func(pp *Pool, taskCfg *config.TaskConfig) error {
+		return pp.LoadGrok(taskCfg.Grok.Pattern, taskCfg.Grok.Patterns)
+	}))
+}
+
+// GrokPatterns are the standard patterns which may be referred as %{NAME}, %{NAME:field} or %{NAME:field:int|float}.
+// They're adapted from Logstash to the RE2 syntax.
+var GrokPatterns = map[string]string{
+	"USERNAME":          `[a-zA-Z0-9._-]+`,
+	"USER":              `%{USERNAME}`,
+	"EMAILLOCALPART":    `[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+(?:\.[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+)*`,
+	"EMAILADDRESS":      `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":               `[+-]?[0-9]+`,
+	"BASE10NUM":         `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"NUMBER":            `%{BASE10NUM}`,
+	"BASE16NUM":         `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"POSINT":            `[1-9][0-9]*`,
+	"NONNEGINT":         `[0-9]+`,
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"UUID":              `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":               `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}|(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4}`,
+	"IPV4":              `(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9]?[0-9])`,
+	"IPV6":              `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{1,4}|%{IPV4})?(?:%[0-9A-Za-z]+)?`,
+	"IP":                `%{IPV6}|%{IPV4}`,
+	"HOSTNAME":          `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?\b`,
+	"IPORHOST":          `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT":          `%{IPORHOST}:%{POSINT}`,
+	"UNIXPATH":          `(?:/[\w_%!$@:.,+~-]*)+`,
+	"WINPATH":           `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":              `%{UNIXPATH}|%{WINPATH}`,
+	"URIPROTO":          `[A-Za-z]([A-Za-z0-9+\-.]+)+`,
+	"URIHOST":           `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":           `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":          `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM":      `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":               `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+	"MONTH":             `\b(?:[Jj]an(?:uary|uar)?|[Ff]eb(?:ruary|ruar)?|[Mm](?:a|ä)?r(?:ch|z)?|[Aa]pr(?:il)?|[Mm]a(?:y|i)?|[Jj]un(?:e|i)?|[Jj]ul(?:y|i)?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo](?:c|k)?t(?:ober)?|[Nn]ov(?:ember)?|[Dd]e(?:c|z)(?:ember)?)\b`,
+	"MONTHNUM":          `0?[1-9]|1[0-2]`,
+	"MONTHDAY":          `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `2[0123]|[01]?[0-9]`,
+	"MINUTE":            `[0-5][0-9]`,
+	"SECOND":            `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"ISO8601_TIMEZONE":  `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"ISO8601_SECOND":    `%{SECOND}|60`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"DATE":              `%{DATE_US}|%{DATE_EU}`,
+	"DATESTAMP":         `%{DATE}[- ]%{TIME}`,
+	"TZ":                `[A-Z]{3}`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"SYSLOGHOST":        `%{IPORHOST}`,
+	"SYSLOGPROG":        `%{PROG:program}(?:\[%{POSINT:pid}\])?`,
+	"PROG":              `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGBASE":        `%{SYSLOGTIMESTAMP:timestamp} %{SYSLOGHOST:logsource} %{SYSLOGPROG}:`,
+	"LOGLEVEL":          `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn?(?:ing)?|WARN?(?:ING)?|[Ee]rr?(?:or)?|ERR?(?:OR)?|[Cc]rit?(?:ical)?|CRIT?(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|EMERG(?:ENCY)?|[Ee]merg(?:ency)?`,
+	"HTTPDUSER":         `%{EMAILADDRESS}|%{USER}`,
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{HTTPDUSER:ident} %{HTTPDUSER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response:int} (?:%{NUMBER:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+	"QS":                `%{QUOTEDSTRING}`,
+}
+
+var grokRef = regexp.MustCompile(`%{(\w+)(?::([\w.\[\]@-]+))?(?::(int|float))?}`)
+
+// grokPattern is a compiled grok pattern
+type grokPattern struct {
+	re *regexp.Regexp
+	// fields and conversions by the index of capture groups, empty field means the group isn't captured
+	fields []string
+	types  []string
+}
+
+// LoadGrok compiles pattern, which may refer to GrokPatterns and custom patterns. Custom patterns take precedence.
+func (pp *Pool) LoadGrok(pattern string, custom map[string]string) (err error) {
+	g := &grokPattern{}
+	var captures []grokCapture
+	var expanded string
+	if expanded, err = expandGrok(pattern, custom, &captures, 0); err != nil {
+		return
+	}
+	if g.re, err = regexp.Compile("^" + expanded + "$"); err != nil {
+		err = errors.Wrapf(err, "invalid grok pattern %s", pattern)
+		return
+	}
+	names := g.re.SubexpNames()
+	g.fields = make([]string, len(names))
+	g.types = make([]string, len(names))
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+		if idx, err := strconv.Atoi(strings.TrimPrefix(name, grokGroupPrefix)); err == nil && strings.HasPrefix(name, grokGroupPrefix) && idx < len(captures) {
+			// a generated group name of %{NAME:field}
+			g.fields[i] = captures[idx].field
+			g.types[i] = captures[idx].typ
+		} else {
+			g.fields[i] = name
+		}
+	}
+	pp.grok = g
+	return
+}
+
+// grokGroupPrefix prefixes the generated group names
+const grokGroupPrefix = "__grok"
+
+// grokCapture is the field and conversion of %{NAME:field:type}
+type grokCapture struct {
+	field string
+	typ   string
+}
+
+// expandGrok replaces references with the referred patterns, fields are captured by generated group names since they may contain dots
+func expandGrok(pattern string, custom map[string]string, captures *[]grokCapture, depth int) (expanded string, err error) {
+	if depth > 32 {
+		err = errors.Newf("grok pattern %s is recursive", pattern)
+		return
+	}
+	expanded = grokRef.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		m := grokRef.FindStringSubmatch(ref)
+		def, ok := custom[m[1]]
+		if !ok {
+			if def, ok = GrokPatterns[m[1]]; !ok {
+				err = errors.Newf("unknown grok pattern %s", m[1])
+				return ""
+			}
+		}
+		var sub string
+		if sub, err = expandGrok(def, custom, captures, depth+1); err != nil {
+			return ""
+		}
+		if m[2] == "" {
+			return "(?:" + sub + ")"
+		}
+		group := grokGroupPrefix + strconv.Itoa(len(*captures))
+		*captures = append(*captures, grokCapture{m[2], m[3]})
+		return "(?P<" + group + ">" + sub + ")"
+	})
+	return
+}
+
+// GrokParser matches each message against a grok pattern
+type GrokParser struct {
+	pp     *Pool
+	fields map[string]interface{}
+}
+
+func (p *GrokParser) Parse(bs []byte) (metric model.Metric, err error) {
+	g := p.pp.grok
+	line := strings.TrimRight(string(bs), "\r\n")
+	match := g.re.FindStringSubmatchIndex(line)
+	if match == nil {
+		err = errors.Newf("message doesn't match the grok pattern")
+		return
+	}
+	values := make(map[string]interface{}, len(g.fields))
+	for i := 1; i < len(g.fields); i++ {
+		if g.fields[i] == "" || match[2*i] < 0 {
+			continue
+		}
+		s := line[match[2*i]:match[2*i+1]]
+		var v interface{} = s
+		switch g.types[i] {
+		case "int":
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				v = n
+			}
+		case "float":
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				v = f
+			}
+		}
+		values[g.fields[i]] = v
+	}
+	metric = newNativeMetric(p.pp, values, p.fields)
+	return
+}
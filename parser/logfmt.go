@@ -0,0 +1,96 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+var _ Parser = (*LogfmtParser)(nil)
+
+func init() {
+	Register("logfmt", func(pp *Pool) (Parser, error) {
+		fields, err := parseFields(pp.fields)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+			return nil, err
+		}
+		return &LogfmtParser{pp: pp, fields: fields}, nil
+	}, CapDynamicSchema)
+}
+
+// LogfmtParser parses lines of key=value pairs, such as `level=info msg="hello world" took=1.5ms`.
+// Values may be double-quoted with Go escapes, a bare key has an empty value.
+type LogfmtParser struct {
+	pp     *Pool
+	fields map[string]interface{}
+}
+
+func (p *LogfmtParser) Parse(bs []byte) (metric model.Metric, err error) {
+	values := make(map[string]interface{})
+	line := strings.TrimSpace(string(bs))
+	for len(line) != 0 {
+		// key
+		i := strings.IndexAny(line, "= \t")
+		if i < 0 {
+			i = len(line)
+		}
+		key := line[:i]
+		if key == "" {
+			err = errors.Newf("logfmt: missing key at %q", line)
+			return
+		}
+		line = line[i:]
+		var val string
+		if strings.HasPrefix(line, "=") {
+			line = line[1:]
+			if strings.HasPrefix(line, `"`) {
+				// find the closing quote which isn't escaped
+				end := 1
+				for ; end < len(line); end++ {
+					if line[end] == '\\' {
+						end++
+					} else if line[end] == '"' {
+						break
+					}
+				}
+				if end >= len(line) {
+					err = errors.Newf("logfmt: unterminated quoted value of %s", key)
+					return
+				}
+				if val, err = strconv.Unquote(line[:end+1]); err != nil {
+					err = errors.Wrapf(err, "logfmt: invalid quoted value of %s", key)
+					return
+				}
+				line = line[end+1:]
+			} else {
+				j := strings.IndexAny(line, " \t")
+				if j < 0 {
+					j = len(line)
+				}
+				val, line = line[:j], line[j:]
+			}
+		}
+		values[key] = val
+		line = strings.TrimLeft(line, " \t")
+	}
+	metric = newNativeMetric(p.pp, values, p.fields)
+	return
+}
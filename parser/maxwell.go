@@ -0,0 +1,141 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+var _ Parser = (*MaxwellParser)(nil)
+
+func init() {
+	Register("maxwell", func(pp *Pool) (Parser, error) {
+		fields, err := parseFields(pp.fields)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+			return nil, err
+		}
+		p := &MaxwellParser{pp: pp, opts: pp.cdc, fields: fields}
+		if p.opts == nil {
+			p.opts = &cdcOptions{}
+		}
+		return p, nil
+	}, CapDynamicSchema, Configurer(configureCdc))
+}
+
+// MaxwellParser parses the JSON messages of Maxwell, such as
+// {"database":"test","table":"t","type":"update","ts":1449786310,"position":"master.000006:800911","data":{"id":1,"name":"a"},"old":{"name":"b"}}.
+// Fields CdcOp and CdcTsMs are added to the row, and columns set by LoadCdc are filled,
+// the version is the binlog position if Maxwell outputs it, otherwise "ts".
+type MaxwellParser struct {
+	pp     *Pool
+	opts   *cdcOptions
+	fields map[string]interface{}
+}
+
+func (p *MaxwellParser) Parse(bs []byte) (metric model.Metric, err error) {
+	if !gjson.ValidBytes(bs) {
+		err = errors.Newf("message is not a valid JSON")
+		return
+	}
+	root := gjson.ParseBytes(bs)
+	var op string
+	switch typ := root.Get("type").Str; typ {
+	case "insert":
+		op = "c"
+	case "bootstrap-insert":
+		op = "r"
+	case "update":
+		op = "u"
+	case "delete":
+		op = "d"
+	case "":
+		err = errors.Newf("message isn't a Maxwell change event")
+		return
+	default:
+		if strings.HasPrefix(typ, "bootstrap-") || strings.HasPrefix(typ, "table-") || strings.HasPrefix(typ, "database-") {
+			// bootstrap markers and DDLs
+			err = ErrSkipped
+			return
+		}
+		err = errors.Newf("unsupported Maxwell type %q", typ)
+		return
+	}
+	data := root.Get("data")
+	if !data.IsObject() {
+		err = errors.Newf("Maxwell change event has no row")
+		return
+	}
+	values := make(map[string]interface{})
+	data.ForEach(func(k, v gjson.Result) bool {
+		values[k.Str] = maxwellValue(v)
+		return true
+	})
+	values[CdcOp] = op
+	ts := root.Get("ts")
+	if tsMs := root.Get("ts_ms"); tsMs.Exists() {
+		values[CdcTsMs] = tsMs.Int()
+	} else if ts.Exists() {
+		values[CdcTsMs] = ts.Int() * 1000
+	}
+	if p.opts.versionColumn != "" {
+		// master.000006:800911
+		position := root.Get("position").Str
+		if i := strings.LastIndexByte(position, ':'); i > 0 {
+			if pos, err := strconv.ParseUint(position[i+1:], 10, 64); err == nil {
+				if version, ok := binlogVersion(position[:i], pos); ok {
+					values[p.opts.versionColumn] = version
+				}
+			}
+		}
+		if _, ok := values[p.opts.versionColumn]; !ok && ts.Exists() {
+			values[p.opts.versionColumn] = ts.Uint()
+		}
+	}
+	p.opts.setNative(values, op == "d")
+	metric = newNativeMetric(p.pp, values, p.fields)
+	return
+}
+
+func maxwellValue(v gjson.Result) interface{} {
+	switch v.Type {
+	case gjson.Null:
+		return nil
+	case gjson.String:
+		return v.Str
+	case gjson.Number:
+		return json.Number(v.Raw)
+	case gjson.True, gjson.False:
+		return v.Bool()
+	}
+	if v.IsArray() {
+		// SET columns
+		arr := make([]interface{}, 0)
+		v.ForEach(func(_, e gjson.Result) bool {
+			arr = append(arr, maxwellValue(e))
+			return true
+		})
+		return arr
+	}
+	// JSON columns
+	return v.Raw
+}
@@ -0,0 +1,865 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/chcol"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/shopspring/decimal"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+	"golang.org/x/exp/constraints"
+)
+
+var _ model.Metric = (*NativeMetric)(nil)
+
+// ratScale is the number of fractional digits kept when converting a *big.Rat to decimal
+const ratScale = 18
+
+// NativeMetric is a metric backed by Go native values, which is produced by parsers decoding binary formats such as Avro.
+// Values are bool, signed and unsigned integers, floats, *big.Rat, json.Number, string, []byte, time.Time,
+// []interface{} and map[string]interface{}.
+type NativeMetric struct {
+	pp     *Pool
+	values map[string]interface{}
+}
+
+// parseFields decodes the extra fields of the pool, which are merged into each NativeMetric
+func parseFields(fields string) (m map[string]interface{}, err error) {
+	if fields == "" {
+		return
+	}
+	dec := json.NewDecoder(strings.NewReader(fields))
+	dec.UseNumber()
+	if err = dec.Decode(&m); err != nil {
+		return
+	}
+	return
+}
+
+// NewNativeMetric creates a metric of values, which is handy for custom parsers decoding messages into Go native values
+func NewNativeMetric(pp *Pool, values map[string]interface{}) *NativeMetric {
+	return &NativeMetric{pp: pp, values: values}
+}
+
+func newNativeMetric(pp *Pool, values, fields map[string]interface{}) *NativeMetric {
+	for k, v := range fields {
+		values[k] = v
+	}
+	return &NativeMetric{pp: pp, values: values}
+}
+
+// get returns the value of key. Values of nested records are reachable with dotted keys, e.g. "a.b".
+func (c *NativeMetric) get(key string) (v interface{}) {
+	var ok bool
+	if v, ok = c.values[key]; ok || !strings.Contains(key, ".") {
+		return
+	}
+	m := c.values
+	for {
+		i := strings.IndexByte(key, '.')
+		if i < 0 {
+			return m[key]
+		}
+		if m, ok = m[key[:i]].(map[string]interface{}); !ok {
+			return nil
+		}
+		key = key[i+1:]
+	}
+}
+
+func (c *NativeMetric) GetString(key string, nullable bool) (val interface{}) {
+	return nativeGetString(c.get(key), nullable)
+}
+
+func (c *NativeMetric) GetBool(key string, nullable bool) (val interface{}) {
+	return nativeGetBool(c.get(key), nullable)
+}
+
+func (c *NativeMetric) GetDecimal(key string, nullable bool) (val interface{}) {
+	return nativeGetDecimal(c.get(key), nullable)
+}
+
+func (c *NativeMetric) GetInt8(key string, nullable bool) (val interface{}) {
+	return NativeGetInt[int8](c.get(key), nullable, math.MinInt8, math.MaxInt8)
+}
+
+func (c *NativeMetric) GetInt16(key string, nullable bool) (val interface{}) {
+	return NativeGetInt[int16](c.get(key), nullable, math.MinInt16, math.MaxInt16)
+}
+
+func (c *NativeMetric) GetInt32(key string, nullable bool) (val interface{}) {
+	return NativeGetInt[int32](c.get(key), nullable, math.MinInt32, math.MaxInt32)
+}
+
+func (c *NativeMetric) GetInt64(key string, nullable bool) (val interface{}) {
+	return NativeGetInt[int64](c.get(key), nullable, math.MinInt64, math.MaxInt64)
+}
+
+func (c *NativeMetric) GetUint8(key string, nullable bool) (val interface{}) {
+	return NativeGetUint[uint8](c.get(key), nullable, math.MaxUint8)
+}
+
+func (c *NativeMetric) GetUint16(key string, nullable bool) (val interface{}) {
+	return NativeGetUint[uint16](c.get(key), nullable, math.MaxUint16)
+}
+
+func (c *NativeMetric) GetUint32(key string, nullable bool) (val interface{}) {
+	return NativeGetUint[uint32](c.get(key), nullable, math.MaxUint32)
+}
+
+func (c *NativeMetric) GetUint64(key string, nullable bool) (val interface{}) {
+	return NativeGetUint[uint64](c.get(key), nullable, math.MaxUint64)
+}
+
+func (c *NativeMetric) GetFloat32(key string, nullable bool) (val interface{}) {
+	return NativeGetFloat[float32](c.get(key), nullable, math.MaxFloat32)
+}
+
+func (c *NativeMetric) GetFloat64(key string, nullable bool) (val interface{}) {
+	return NativeGetFloat[float64](c.get(key), nullable, math.MaxFloat64)
+}
+
+func (c *NativeMetric) GetIPv4(key string, nullable bool) (val interface{}) {
+	return nativeGetIPv4(c.get(key), nullable)
+}
+
+func (c *NativeMetric) GetIPv6(key string, nullable bool) (val interface{}) {
+	return nativeGetIPv6(c.get(key), nullable)
+}
+
+func (c *NativeMetric) GetDateTime(key string, nullable bool) (val interface{}) {
+	return c.nativeGetDateTime(key, c.get(key), dateTimeType(nullable))
+}
+
+func (c *NativeMetric) GetTime(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return c.nativeGetDateTime(key, c.get(key), typeinfo)
+}
+
+func (c *NativeMetric) GetBigInt(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return nativeGetBigInt(c.get(key), typeinfo.Type, typeinfo.Nullable)
+}
+
+func (c *NativeMetric) GetObject(key string, nullable bool) (val interface{}) {
+	if m, ok := c.get(key).(map[string]interface{}); ok {
+		return m
+	}
+	if nullable {
+		return
+	}
+	return EmpytObject
+}
+
+func (c *NativeMetric) GetJSON(key string, nullable bool) (val interface{}) {
+	return nativeGetJSON(c.get(key), nullable)
+}
+
+func (c *NativeMetric) GetVariant(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return c.nativeGetVariant(key, c.get(key), typeinfo)
+}
+
+func (c *NativeMetric) GetArray(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	v := c.get(key)
+	if v == nil {
+		v = c.nestedGet(key)
+	}
+	return c.nativeGetArray(key, v, typeinfo)
+}
+
+// nestedGet returns the array of member b of records in array a for key "a.b", which is a column of Nested a.
+// Records without the member contribute nils, so that arrays of the same Nested have the same length.
+func (c *NativeMetric) nestedGet(key string) (v interface{}) {
+	for i := strings.IndexByte(key, '.'); i > 0; {
+		if records, ok := c.values[key[:i]].([]interface{}); ok {
+			arr := make([]interface{}, 0, len(records))
+			for _, record := range records {
+				m, _ := record.(map[string]interface{})
+				arr = append(arr, m[key[i+1:]])
+			}
+			return arr
+		}
+		j := strings.IndexByte(key[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += 1 + j
+	}
+	return nil
+}
+
+func (c *NativeMetric) GetMap(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return c.nativeGetMap(key, c.get(key), typeinfo)
+}
+
+func (c *NativeMetric) GetTuple(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	return c.nativeGetTuple(key, c.get(key), typeinfo)
+}
+
+func (c *NativeMetric) GetNewKeys(knownKeys, newKeys, warnKeys *sync.Map, white, black *regexp.Regexp, partition int, offset int64) (foundNew bool) {
+	for strKey, v := range c.values {
+		var loaded bool
+		if _, loaded = knownKeys.LoadOrStore(strKey, nil); loaded {
+			continue
+		}
+		if (white == nil || white.MatchString(strKey)) &&
+			(black == nil || !black.MatchString(strKey)) {
+			if typ, array := nativeDetectType(v, 0); typ != model.Unknown && typ != model.Object && !array {
+				newKeys.Store(strKey, typ)
+				foundNew = true
+			} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
+				util.Logger.Warn("NativeMetric.GetNewKeys ignored new key due to unsupported type of dynamic column", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.Any("value", v))
+			}
+		} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
+			util.Logger.Warn("NativeMetric.GetNewKeys ignored new key due to white/black list setting", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.Any("value", v))
+			knownKeys.Store(strKey, nil)
+		}
+	}
+	return
+}
+
+func (c *NativeMetric) GetRest(columns map[string]struct{}, white, black *regexp.Regexp) (val interface{}) {
+	rest := make(map[string]interface{})
+	for strKey, v := range c.values {
+		if isRestKey(strKey, strKey, columns, white, black) {
+			rest[strKey] = v
+		}
+	}
+	b, err := json.Marshal(rest)
+	if err != nil {
+		return EmptyJSON
+	}
+	return string(b)
+}
+
+func nativeDetectType(v interface{}, depth int) (typ int, array bool) {
+	typ = model.Unknown
+	if depth > 1 {
+		return
+	}
+	switch v := v.(type) {
+	case bool:
+		typ = model.Bool
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		typ = model.Int64
+	case float32, float64, *big.Rat:
+		typ = model.Float64
+	case json.Number:
+		typ = model.Float64
+		if _, err := v.Int64(); err == nil {
+			typ = model.Int64
+		}
+	case string:
+		typ = model.String
+		if _, layout := parseInLocation(v, time.Local); layout != "" {
+			typ = model.DateTime
+		}
+	case []byte:
+		typ = model.String
+	case time.Time:
+		typ = model.DateTime
+	case map[string]interface{}:
+		typ = model.Object
+	case []interface{}:
+		if depth >= 1 {
+			return
+		}
+		array = true
+		if len(v) != 0 {
+			typ, _ = nativeDetectType(v[0], depth+1)
+		}
+	}
+	return
+}
+
+// nativeInt64 converts v to int64, values out of range are clamped
+func nativeInt64(v interface{}) (i int64, ok bool) {
+	ok = true
+	switch v := v.(type) {
+	case bool:
+		if v {
+			i = 1
+		}
+	case int:
+		i = int64(v)
+	case int8:
+		i = int64(v)
+	case int16:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint, uint8, uint16, uint32, uint64:
+		u, _ := nativeUint64(v)
+		if u > math.MaxInt64 {
+			i = math.MaxInt64
+		} else {
+			i = int64(u)
+		}
+	case float32, float64, *big.Rat:
+		f, _ := nativeFloat64(v)
+		if f >= math.MaxInt64 {
+			i = math.MaxInt64
+		} else if f <= math.MinInt64 {
+			i = math.MinInt64
+		} else {
+			i = int64(f)
+		}
+	case json.Number:
+		var err error
+		if i, err = v.Int64(); err != nil {
+			return nativeInt64(string(v))
+		}
+	case string:
+		var err error
+		if i, err = strconv.ParseInt(v, 10, 64); err != nil {
+			var f float64
+			if f, err = strconv.ParseFloat(v, 64); err != nil {
+				return 0, false
+			}
+			return nativeInt64(f)
+		}
+	default:
+		ok = false
+	}
+	return
+}
+
+// nativeUint64 converts v to uint64, negative values are clamped to 0
+func nativeUint64(v interface{}) (u uint64, ok bool) {
+	ok = true
+	switch v := v.(type) {
+	case uint:
+		u = uint64(v)
+	case uint8:
+		u = uint64(v)
+	case uint16:
+		u = uint64(v)
+	case uint32:
+		u = uint64(v)
+	case uint64:
+		u = v
+	case float32, float64, *big.Rat:
+		f, _ := nativeFloat64(v)
+		if f >= math.MaxUint64 {
+			u = math.MaxUint64
+		} else if f > 0 {
+			u = uint64(f)
+		}
+	case json.Number:
+		return nativeUint64(string(v))
+	case string:
+		var err error
+		if u, err = strconv.ParseUint(v, 10, 64); err != nil {
+			var i int64
+			if i, ok = nativeInt64(v); ok && i > 0 {
+				u = uint64(i)
+			}
+		}
+	default:
+		var i int64
+		if i, ok = nativeInt64(v); ok && i > 0 {
+			u = uint64(i)
+		}
+	}
+	return
+}
+
+func nativeFloat64(v interface{}) (f float64, ok bool) {
+	ok = true
+	switch v := v.(type) {
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	case *big.Rat:
+		if v == nil {
+			return 0, false
+		}
+		f, _ = v.Float64()
+	case json.Number:
+		var err error
+		if f, err = v.Float64(); err != nil {
+			return 0, false
+		}
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(v, 64); err != nil {
+			return 0, false
+		}
+	case uint, uint8, uint16, uint32, uint64:
+		u, _ := nativeUint64(v)
+		f = float64(u)
+	default:
+		var i int64
+		if i, ok = nativeInt64(v); ok {
+			f = float64(i)
+		}
+	}
+	return
+}
+
+func NativeGetInt[T constraints.Signed](v interface{}, nullable bool, min, max int64) (val interface{}) {
+	val2, ok := nativeInt64(v)
+	if !ok {
+		val = getDefaultInt[T](nullable)
+	} else if val2 < min {
+		val = T(min)
+	} else if val2 > max {
+		val = T(max)
+	} else {
+		val = T(val2)
+	}
+	return
+}
+
+func NativeGetUint[T constraints.Unsigned](v interface{}, nullable bool, max uint64) (val interface{}) {
+	val2, ok := nativeUint64(v)
+	if !ok {
+		val = getDefaultInt[T](nullable)
+	} else if val2 > max {
+		val = T(max)
+	} else {
+		val = T(val2)
+	}
+	return
+}
+
+func NativeGetFloat[T constraints.Float](v interface{}, nullable bool, max float64) (val interface{}) {
+	val2, ok := nativeFloat64(v)
+	if !ok {
+		val = getDefaultFloat[T](nullable)
+	} else if val2 > max {
+		val = T(max)
+	} else {
+		val = T(val2)
+	}
+	return
+}
+
+func nativeGetString(v interface{}, nullable bool) (val interface{}) {
+	switch v := v.(type) {
+	case nil:
+		if nullable {
+			return
+		}
+		val = ""
+	case string:
+		val = v
+	case []byte:
+		val = string(v)
+	case json.Number:
+		val = v.String()
+	case *big.Rat:
+		val = v.RatString()
+	case time.Time:
+		val = v.Format(time.RFC3339Nano)
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		val = string(b)
+	default:
+		val = fmt.Sprint(v)
+	}
+	return
+}
+
+func nativeGetBool(v interface{}, nullable bool) (val interface{}) {
+	switch v := v.(type) {
+	case bool:
+		val = v
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			val = b
+		} else {
+			val = getDefaultBool(nullable)
+		}
+	default:
+		val = getDefaultBool(nullable)
+	}
+	return
+}
+
+func nativeGetDecimal(v interface{}, nullable bool) (val interface{}) {
+	switch v := v.(type) {
+	case *big.Rat:
+		if v == nil {
+			val = getDefaultDecimal(nullable)
+			return
+		}
+		val = decimal.NewFromBigInt(v.Num(), 0).DivRound(decimal.NewFromBigInt(v.Denom(), 0), ratScale)
+	case json.Number:
+		var err error
+		if val, err = decimal.NewFromString(v.String()); err != nil {
+			val = getDefaultDecimal(nullable)
+		}
+	case string:
+		var err error
+		if val, err = decimal.NewFromString(v); err != nil {
+			val = getDefaultDecimal(nullable)
+		}
+	default:
+		if f, ok := nativeFloat64(v); ok {
+			val = decimal.NewFromFloat(f)
+		} else {
+			val = getDefaultDecimal(nullable)
+		}
+	}
+	return
+}
+
+func nativeGetIPv4(v interface{}, nullable bool) (val interface{}) {
+	switch v := v.(type) {
+	case nil:
+		if nullable {
+			return
+		}
+		val = ""
+	case string:
+		if net.ParseIP(v) != nil {
+			val = v
+		} else {
+			val = net.IPv4zero.String()
+		}
+	default:
+		if _, ok := nativeUint64(v); ok {
+			val = NativeGetUint[uint32](v, nullable, math.MaxUint32)
+		} else {
+			val = net.IPv4zero.String()
+		}
+	}
+	return
+}
+
+func nativeGetIPv6(v interface{}, nullable bool) (val interface{}) {
+	switch v := v.(type) {
+	case nil:
+		if nullable {
+			return
+		}
+		val = ""
+	case string:
+		if net.ParseIP(v) != nil {
+			val = v
+		} else {
+			val = net.IPv6zero.String()
+		}
+	default:
+		val = net.IPv6zero.String()
+	}
+	return
+}
+
+func (c *NativeMetric) nativeGetDateTime(key string, v interface{}, typeinfo *model.TypeInfo) (val interface{}) {
+	var t time.Time
+	var ok bool
+	switch v := v.(type) {
+	case time.Time:
+		t, ok = fitTime(v.UTC(), typeinfo)
+	case string:
+		t, ok = c.pp.parseTime(key, v, typeinfo)
+	case json.Number:
+		t, ok = c.pp.unixTime(string(v), typeinfo)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		t, ok = c.pp.unixTime(fmt.Sprint(v), typeinfo)
+	case bool, nil:
+	default:
+		var f float64
+		if f, ok = nativeFloat64(v); ok {
+			t, ok = fitTime(UnixFloat(f, c.pp.timeUnit), typeinfo)
+		}
+	}
+	if !ok {
+		val = getDefaultDateTime(typeinfo.Nullable)
+		return
+	}
+	val = t
+	return
+}
+
+func nativeGetBigInt(v interface{}, typ int, nullable bool) (val interface{}) {
+	var s string
+	switch v := v.(type) {
+	case *big.Int:
+		if v != nil {
+			s = v.String()
+		}
+	case big.Int:
+		s = v.String()
+	case *big.Rat:
+		if v != nil {
+			s = new(big.Int).Quo(v.Num(), v.Denom()).String()
+		}
+	case json.Number:
+		s = string(v)
+	case string:
+		s = v
+	case bool:
+		if v {
+			return big.NewInt(1)
+		}
+		return new(big.Int)
+	case float32, float64:
+		f, _ := nativeFloat64(v)
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s = fmt.Sprint(v)
+	}
+	if i, ok := parseBigInt(s, typ); ok {
+		return i
+	}
+	return getDefaultBigInt(nullable)
+}
+
+func nativeArray[T any](array []interface{}, fn func(interface{}) interface{}) (arr []T) {
+	arr = make([]T, 0, len(array))
+	for _, e := range array {
+		v, _ := fn(e).(T)
+		arr = append(arr, v)
+	}
+	return
+}
+
+func (c *NativeMetric) nativeGetArray(key string, v interface{}, typeinfo *model.TypeInfo) (val interface{}) {
+	array, _ := v.([]interface{})
+	elem := typeinfo.ElemType()
+	if !elem.IsBasic() {
+		// arrays of Nullable, Array, Map and Tuple
+		arr := make([]interface{}, 0, len(array))
+		for _, e := range array {
+			arr = append(arr, c.castNativeByType(key, e, elem))
+		}
+		return arr
+	}
+	typ := elem.Type
+	switch typ {
+	case model.Bool:
+		val = nativeArray[bool](array, func(e interface{}) interface{} { return nativeGetBool(e, false) })
+	case model.Int8:
+		val = nativeArray[int8](array, func(e interface{}) interface{} { return NativeGetInt[int8](e, false, math.MinInt8, math.MaxInt8) })
+	case model.Int16:
+		val = nativeArray[int16](array, func(e interface{}) interface{} { return NativeGetInt[int16](e, false, math.MinInt16, math.MaxInt16) })
+	case model.Int32:
+		val = nativeArray[int32](array, func(e interface{}) interface{} { return NativeGetInt[int32](e, false, math.MinInt32, math.MaxInt32) })
+	case model.Int64:
+		val = nativeArray[int64](array, func(e interface{}) interface{} { return NativeGetInt[int64](e, false, math.MinInt64, math.MaxInt64) })
+	case model.UInt8:
+		val = nativeArray[uint8](array, func(e interface{}) interface{} { return NativeGetUint[uint8](e, false, math.MaxUint8) })
+	case model.UInt16:
+		val = nativeArray[uint16](array, func(e interface{}) interface{} { return NativeGetUint[uint16](e, false, math.MaxUint16) })
+	case model.UInt32:
+		val = nativeArray[uint32](array, func(e interface{}) interface{} { return NativeGetUint[uint32](e, false, math.MaxUint32) })
+	case model.UInt64:
+		val = nativeArray[uint64](array, func(e interface{}) interface{} { return NativeGetUint[uint64](e, false, math.MaxUint64) })
+	case model.Float32:
+		val = nativeArray[float32](array, func(e interface{}) interface{} { return NativeGetFloat[float32](e, false, math.MaxFloat32) })
+	case model.Float64:
+		val = nativeArray[float64](array, func(e interface{}) interface{} { return NativeGetFloat[float64](e, false, math.MaxFloat64) })
+	case model.Decimal:
+		val = nativeArray[decimal.Decimal](array, func(e interface{}) interface{} { return nativeGetDecimal(e, false) })
+	case model.DateTime:
+		val = nativeArray[time.Time](array, func(e interface{}) interface{} { return c.nativeGetDateTime(key, e, elem) })
+	case model.String:
+		val = nativeArray[string](array, func(e interface{}) interface{} { return nativeGetString(e, false) })
+	case model.Object:
+		arr := make([]map[string]interface{}, 0, len(array))
+		for _, e := range array {
+			if m, ok := e.(map[string]interface{}); ok {
+				arr = append(arr, m)
+			}
+		}
+		val = arr
+	case model.IPv4:
+		arr := make([]interface{}, 0, len(array))
+		for _, e := range array {
+			arr = append(arr, nativeGetIPv4(e, false))
+		}
+		val = arr
+	case model.IPv6:
+		arr := make([]interface{}, 0, len(array))
+		for _, e := range array {
+			arr = append(arr, nativeGetIPv6(e, false))
+		}
+		val = arr
+	case model.Int128, model.Int256, model.UInt128, model.UInt256:
+		arr := make([]*big.Int, 0, len(array))
+		for _, e := range array {
+			arr = append(arr, nativeGetBigInt(e, typ, false).(*big.Int))
+		}
+		val = arr
+	default:
+		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported array type %v", typ))
+	}
+	return
+}
+
+func (c *NativeMetric) nativeGetMap(key string, v interface{}, typeinfo *model.TypeInfo) (val interface{}) {
+	m := model.NewOrderedMap()
+	obj, _ := v.(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m.Put(c.castMapKeyByType(k, typeinfo.MapKey), c.castNativeByType(k, obj[k], typeinfo.MapValue))
+	}
+	val = m
+	return
+}
+
+// nativeGetTuple returns the elements of a tuple, which is a record for named tuples or a slice.
+// Missing elements get the default value of their types.
+func (c *NativeMetric) nativeGetTuple(key string, v interface{}, typeinfo *model.TypeInfo) (val interface{}) {
+	tuple := make([]interface{}, len(typeinfo.TupleTypes))
+	for i, typ := range typeinfo.TupleTypes {
+		var e interface{}
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if typeinfo.TupleNames != nil {
+				e = t[typeinfo.TupleNames[i]]
+			}
+		case []interface{}:
+			if i < len(t) {
+				e = t[i]
+			}
+		}
+		tuple[i] = c.castNativeByType(key, e, typ)
+	}
+	return tuple
+}
+
+// nativeGetJSON returns the text of a record, or of a string which is a JSON object. Other values are taken as empty objects.
+func nativeGetJSON(v interface{}, nullable bool) (val interface{}) {
+	switch v := v.(type) {
+	case nil:
+		val = getDefaultJSON(nullable)
+	case map[string]interface{}:
+		val = EmptyJSON
+		if b, err := json.Marshal(v); err == nil {
+			val = string(b)
+		}
+	case string:
+		val = EmptyJSON
+		if gjson.Valid(v) && gjson.Parse(v).IsObject() {
+			val = v
+		}
+	default:
+		val = EmptyJSON
+	}
+	return
+}
+
+// nativeGetVariant returns a value of Variant or Dynamic typeinfo along with the type it's stored as
+func (c *NativeMetric) nativeGetVariant(key string, v interface{}, typeinfo *model.TypeInfo) (val interface{}) {
+	if v == nil {
+		return
+	}
+	typ, array := nativeDetectType(v, 0)
+	if typeinfo.Type == model.Dynamic {
+		if name := dynamicType(typ, array); name != "" {
+			return chcol.NewDynamicWithType(c.castNativeByType(key, v, model.WhichType(name)), name)
+		}
+		return chcol.NewDynamicWithType(nativeGetString(v, false), "String")
+	}
+	if i := variantMember(typeinfo, typ, array); i >= 0 {
+		return chcol.NewVariantWithType(c.castNativeByType(key, v, typeinfo.VariantTypes[i]), typeinfo.VariantNames[i])
+	}
+	return
+}
+
+func (c *NativeMetric) castMapKeyByType(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	switch typeinfo.Type {
+	case model.Int8, model.Int16, model.Int32, model.Int64, model.UInt8, model.UInt16, model.UInt32, model.UInt64, model.DateTime,
+		model.Int128, model.Int256, model.UInt128, model.UInt256:
+		val = c.castNativeByType(key, key, typeinfo)
+	case model.String:
+		val = key
+	case model.Float32, model.Float64, model.Bool:
+		util.Logger.Fatal("unsupported map key type")
+	default:
+		util.Logger.Fatal("LOGIC ERROR: reached switch default condition")
+	}
+	return
+}
+
+func (c *NativeMetric) castNativeByType(key string, v interface{}, typeinfo *model.TypeInfo) (val interface{}) {
+	if typeinfo.Array {
+		return c.nativeGetArray(key, v, typeinfo)
+	}
+	if typeinfo.Type == model.Tuple {
+		return c.nativeGetTuple(key, v, typeinfo)
+	}
+	switch typeinfo.Type {
+	case model.Bool:
+		val = nativeGetBool(v, typeinfo.Nullable)
+	case model.Int8:
+		val = NativeGetInt[int8](v, typeinfo.Nullable, math.MinInt8, math.MaxInt8)
+	case model.Int16:
+		val = NativeGetInt[int16](v, typeinfo.Nullable, math.MinInt16, math.MaxInt16)
+	case model.Int32:
+		val = NativeGetInt[int32](v, typeinfo.Nullable, math.MinInt32, math.MaxInt32)
+	case model.Int64:
+		val = NativeGetInt[int64](v, typeinfo.Nullable, math.MinInt64, math.MaxInt64)
+	case model.UInt8:
+		val = NativeGetUint[uint8](v, typeinfo.Nullable, math.MaxUint8)
+	case model.UInt16:
+		val = NativeGetUint[uint16](v, typeinfo.Nullable, math.MaxUint16)
+	case model.UInt32:
+		val = NativeGetUint[uint32](v, typeinfo.Nullable, math.MaxUint32)
+	case model.UInt64:
+		val = NativeGetUint[uint64](v, typeinfo.Nullable, math.MaxUint64)
+	case model.IPv4:
+		val = nativeGetIPv4(v, typeinfo.Nullable)
+	case model.IPv6:
+		val = nativeGetIPv6(v, typeinfo.Nullable)
+	case model.Float32:
+		val = NativeGetFloat[float32](v, typeinfo.Nullable, math.MaxFloat32)
+	case model.Float64:
+		val = NativeGetFloat[float64](v, typeinfo.Nullable, math.MaxFloat64)
+	case model.Decimal:
+		val = nativeGetDecimal(v, typeinfo.Nullable)
+	case model.DateTime:
+		val = c.nativeGetDateTime(key, v, typeinfo)
+	case model.Int128, model.Int256, model.UInt128, model.UInt256:
+		val = nativeGetBigInt(v, typeinfo.Type, typeinfo.Nullable)
+	case model.String:
+		val = nativeGetString(v, typeinfo.Nullable)
+	case model.Map:
+		val = c.nativeGetMap(key, v, typeinfo)
+	case model.Object:
+		val, _ = v.(map[string]interface{})
+	case model.JSON:
+		val = nativeGetJSON(v, typeinfo.Nullable)
+	case model.Variant, model.Dynamic:
+		val = c.nativeGetVariant(key, v, typeinfo)
+	default:
+		util.Logger.Fatal("LOGIC ERROR: reached switch default condition")
+	}
+	return
+}
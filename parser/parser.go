@@ -18,13 +18,14 @@ package parser
 import (
 	"math"
 	"math/big"
+	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/housepower/clickhouse_sinker/config"
 	"github.com/housepower/clickhouse_sinker/model"
-	"github.com/housepower/clickhouse_sinker/util"
 	"github.com/thanos-io/thanos/pkg/errors"
-	"github.com/valyala/fastjson"
 )
 
 var (
@@ -56,6 +57,7 @@ var (
 		"02/Jan/2006 15:04:05 Z07:00",
 		"02/Jan/2006 15:04:05 Z0700",
 		"02/Jan/2006 15:04:05",
+		"02/Jan/2006:15:04:05 Z0700", //Apache access log
 		//Date
 		"2006-01-02",
 		"02/01/2006",
@@ -65,13 +67,131 @@ var (
 	}
 	Epoch            = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
 	ErrParseDateTime = errors.Newf("value doesn't contain DateTime")
+	// ErrSkipped is returned by parsers for messages which intentionally produce no row, they aren't parse failures
+	ErrSkipped = errors.Newf("message skipped")
 )
 
+// DefaultFlattenMaxDepth is the default levels of nested objects flattened
+const DefaultFlattenMaxDepth = 5
+
 // Parse is the Parser interface
 type Parser interface {
 	Parse(bs []byte) (metric model.Metric, err error)
 }
 
+// MessageParser is implemented by parsers which depend on the message key or headers besides the value.
+// ParseMessage is preferred over Parse, bs is the decoded value or an element exploded from it.
+type MessageParser interface {
+	ParseMessage(bs []byte, msg *model.InputMessage) (metric model.Metric, err error)
+}
+
+// Splitter is implemented by parsers of messages carrying multiple rows, each element of Split is parsed into a row.
+// It's ignored if the task explodes messages.
+type Splitter interface {
+	Split(bs []byte) (elems [][]byte, err error)
+}
+
+// Factory creates a Parser for the pool, it's invoked whenever the pool has no idle Parser.
+type Factory func(pp *Pool) (Parser, error)
+
+// Capability is an optional feature supported by a parser
+type Capability int
+
+const (
+	// CapDynamicSchema means Metric.GetNewKeys detects new keys, which is required by DynamicSchema
+	CapDynamicSchema Capability = iota
+)
+
+// Option customizes the registration of a parser, it's a Capability, Validator or Configurer.
+type Option interface {
+	apply(r *registration)
+}
+
+func (c Capability) apply(r *registration) {
+	r.caps[c] = true
+}
+
+// Validator checks the settings of a task which uses the parser, it's invoked when the config is loaded.
+type Validator func(taskCfg *config.TaskConfig) error
+
+func (v Validator) apply(r *registration) {
+	r.validate = v
+}
+
+// Configurer loads the settings of a task into the parser pool, it's invoked when the task is created.
+type Configurer func(pp *Pool, taskCfg *config.TaskConfig) error
+
+func (c Configurer) apply(r *registration) {
+	r.configure = c
+}
+
+type registration struct {
+	factory   Factory
+	caps      map[Capability]bool
+	validate  Validator
+	configure Configurer
+}
+
+var (
+	registryMux   sync.RWMutex
+	registrations = make(map[string]*registration)
+)
+
+// Register makes a parser available by name to task configs. Built-in parsers register themselves in init.
+// Registering a name twice replaces the former one.
+func Register(name string, factory Factory, opts ...Option) {
+	r := &registration{factory: factory, caps: make(map[Capability]bool)}
+	for _, opt := range opts {
+		opt.apply(r)
+	}
+	registryMux.Lock()
+	registrations[name] = r
+	registryMux.Unlock()
+}
+
+// Registered tells whether a parser is registered with name
+func Registered(name string) bool {
+	_, ok := lookup(name)
+	return ok
+}
+
+// HasCapability tells whether the parser registered with name supports c
+func HasCapability(name string, c Capability) bool {
+	r, ok := lookup(name)
+	return ok && r.caps[c]
+}
+
+// CheckTask validates the parser settings of a task, config invokes it through config.CheckParser.
+func CheckTask(taskCfg *config.TaskConfig) (err error) {
+	r, ok := lookup(taskCfg.Parser)
+	if !ok {
+		err = errors.Newf("unknown Parser %s", taskCfg.Parser)
+		return
+	}
+	if r.validate != nil {
+		if err = r.validate(taskCfg); err != nil {
+			return
+		}
+	}
+	if (taskCfg.DynamicSchema.Enable || taskCfg.PrometheusSchema) && !r.caps[CapDynamicSchema] {
+		err = errors.Newf("Parser %s doesn't support DynamicSchema", taskCfg.Parser)
+		return
+	}
+	_, err = NewValueDecoder(taskCfg.ValueEncoding)
+	return
+}
+
+func init() {
+	config.CheckParser = CheckTask
+}
+
+func lookup(name string) (r *registration, ok bool) {
+	registryMux.RLock()
+	r, ok = registrations[name]
+	registryMux.RUnlock()
+	return
+}
+
 // Pool may be used for pooling Parsers for similarly typed JSONs.
 type Pool struct {
 	name         string
@@ -83,6 +203,16 @@ type Pool struct {
 	pool         sync.Pool
 	once         sync.Once // only need to detect new keys from fields once
 	fields       string
+	registry     *SchemaRegistry
+	protobuf     *protobufDesc
+	grok         *grokPattern
+	csv          *csvOptions
+	cdc          *cdcOptions
+	cdcDeletes   cdcDeletes
+	// nested fields are reachable with keys flattened by flattenSep, at most flattenMaxDepth levels deep
+	flattenSep      string
+	flattenMaxDepth int
+	csvHeaders      sync.Map // header line => column index of each name
 }
 
 // NewParserPool creates a parser pool
@@ -110,42 +240,65 @@ func NewParserPool(name string, csvFormat []string, delimiter string, timezone s
 	return
 }
 
+// Configure loads the settings of taskCfg shared by all parsers, then the ones of the parser the pool is created for
+func (pp *Pool) Configure(taskCfg *config.TaskConfig) (err error) {
+	if taskCfg.SchemaRegistry != "" {
+		pp.LoadSchemaRegistry(taskCfg.SchemaRegistry)
+	}
+	if taskCfg.FlattenSeparator != "" {
+		pp.LoadFlatten(taskCfg.FlattenSeparator, taskCfg.FlattenMaxDepth)
+	}
+	if r, ok := lookup(pp.name); ok && r.configure != nil {
+		err = r.configure(pp, taskCfg)
+	}
+	return
+}
+
+// LoadSchemaRegistry makes parsers fetch schemas by ID from the Confluent Schema Registry at url
+func (pp *Pool) LoadSchemaRegistry(url string) {
+	pp.registry = NewSchemaRegistry(url)
+}
+
+// LoadFlatten makes nested fields of JSON parsers reachable with flattened keys, e.g. "http_request_method" with separator "_",
+// and DynamicSchema discover leaves of nested objects as such keys. Objects deeper than maxDepth levels aren't flattened, <=0 means DefaultFlattenMaxDepth.
+func (pp *Pool) LoadFlatten(separator string, maxDepth int) {
+	if maxDepth <= 0 {
+		maxDepth = DefaultFlattenMaxDepth
+	}
+	pp.flattenSep = separator
+	pp.flattenMaxDepth = maxDepth
+}
+
 // Get returns a Parser from pp.
 //
 // The Parser must be Put to pp after use.
 func (pp *Pool) Get() (Parser, error) {
 	v := pp.pool.Get()
 	if v == nil {
-		switch pp.name {
-		case "gjson":
-			return &GjsonParser{pp: pp}, nil
-		case "csv":
-			if pp.fields != "" {
-				util.Logger.Warn("extra fields for csv parser is not supported, fields ignored")
-			}
-			return &CsvParser{pp: pp}, nil
-		case "fastjson":
-			fallthrough
-		default:
-			var obj *fastjson.Object
-			if pp.fields != "" {
-				value, err := fastjson.Parse(pp.fields)
-				if err != nil {
-					err = errors.Wrapf(err, "failed to parse fields as a valid json object")
-					return nil, err
-				}
-				obj, err = value.Object()
-				if err != nil {
-					err = errors.Wrapf(err, "failed to retrive fields member")
-					return nil, err
-				}
-			}
-			return &FastjsonParser{pp: pp, fields: obj}, nil
+		r, ok := lookup(pp.name)
+		if !ok {
+			return nil, errors.Newf("unknown parser %s", pp.name)
 		}
+		return r.factory(pp)
 	}
 	return v.(Parser), nil
 }
 
+// Name returns the parser name of pp
+func (pp *Pool) Name() string {
+	return pp.name
+}
+
+// Fields returns the additional fields, a json object, to be appended to each message
+func (pp *Pool) Fields() string {
+	return pp.fields
+}
+
+// TimeUnit returns the unit in seconds of numeric DateTime values
+func (pp *Pool) TimeUnit() float64 {
+	return pp.timeUnit
+}
+
 // Put returns p to pp.
 //
 // p and objects recursively returned from p cannot be used after p
@@ -158,6 +311,11 @@ func (pp *Pool) Put(p Parser) {
 // Automatically detect the layout from till the first successful detection and reuse that layout forever.
 // Return time in UTC.
 func (pp *Pool) ParseDateTime(key string, val string) (t time.Time, err error) {
+	return pp.parseDateTime(key, val, pp.timeZone)
+}
+
+// parseDateTime parses val in loc unless it contains a zone, the layout is detected once per key
+func (pp *Pool) parseDateTime(key string, val string, loc *time.Location) (t time.Time, err error) {
 	var layout string
 	var lay interface{}
 	var ok bool
@@ -167,7 +325,7 @@ func (pp *Pool) ParseDateTime(key string, val string) (t time.Time, err error) {
 		return
 	}
 	if lay, ok = pp.knownLayouts.Load(key); !ok {
-		t2, layout = parseInLocation(val, pp.timeZone)
+		t2, layout = parseInLocation(val, loc)
 		if layout == "" {
 			err = ErrParseDateTime
 			return
@@ -180,7 +338,7 @@ func (pp *Pool) ParseDateTime(key string, val string) (t time.Time, err error) {
 		err = ErrParseDateTime
 		return
 	}
-	if t2, err = time.ParseInLocation(layout, val, pp.timeZone); err != nil {
+	if t2, err = time.ParseInLocation(layout, val, loc); err != nil {
 		err = ErrParseDateTime
 		return
 	}
@@ -201,12 +359,191 @@ func parseInLocation(val string, loc *time.Location) (t time.Time, layout string
 	return
 }
 
+// dateTimeTypes are the types of GetDateTime and arrays of DateTime, nanoseconds are kept and the range is the one of DateTime
+var dateTimeTypes = [2]*model.TypeInfo{{Type: model.DateTime, Precision: 9}, {Type: model.DateTime, Nullable: true, Precision: 9}}
+
+func dateTimeType(nullable bool) *model.TypeInfo {
+	if nullable {
+		return dateTimeTypes[1]
+	}
+	return dateTimeTypes[0]
+}
+
+// parseTime parses val into a value of column typeinfo, zone-less values are in the column's timezone, or the task's one if the column has none
+func (pp *Pool) parseTime(key string, val string, typeinfo *model.TypeInfo) (t time.Time, ok bool) {
+	loc := pp.timeZone
+	if typeinfo.Location != nil {
+		loc = typeinfo.Location
+	}
+	var err error
+	if t, err = pp.parseDateTime(key, val, loc); err != nil {
+		return
+	}
+	return fitTime(t, typeinfo)
+}
+
+// unixTime converts num, the decimal number of time units since epoch, into a value of column typeinfo
+func (pp *Pool) unixTime(num string, typeinfo *model.TypeInfo) (t time.Time, ok bool) {
+	if t, ok = unixNumber(num, pp.timeUnit); !ok {
+		return
+	}
+	return fitTime(t, typeinfo)
+}
+
+// fitTime truncates t to the precision of column typeinfo, and fails if t is out of the column's range
+func fitTime(t time.Time, typeinfo *model.TypeInfo) (time.Time, bool) {
+	if typeinfo.Precision < 9 {
+		t = t.Truncate(time.Duration(math.Pow10(9 - typeinfo.Precision)))
+	}
+	if min, max := typeinfo.TimeRange(); t.Before(min) || t.After(max) {
+		return Epoch, false
+	}
+	return t, true
+}
+
+// UnixFloat converts sec, the number of time units since epoch, into time rounded to nanoseconds.
+// Epoch is returned if the result isn't representable.
 func UnixFloat(sec, unit float64) (t time.Time) {
-	sec, _ = new(big.Float).Mul(big.NewFloat(sec), big.NewFloat(unit)).Float64()
-	//2^32 seconds since epoch: 2106-02-07T06:28:16Z
-	if sec < 0 || sec >= 4294967296.0 {
+	if math.IsNaN(sec) || math.IsInf(sec, 0) {
+		return Epoch
+	}
+	return unixBigFloat(new(big.Float).SetPrec(256).SetFloat64(sec), unit)
+}
+
+// unixNumber is UnixFloat of num in decimal, which is parsed exactly so that nanoseconds of large timestamps aren't lost
+func unixNumber(num string, unit float64) (t time.Time, ok bool) {
+	f, _, err := big.ParseFloat(num, 10, 256, big.ToNearestEven)
+	if err != nil || f.IsInf() {
+		return
+	}
+	return unixBigFloat(f, unit), true
+}
+
+func unixBigFloat(sec *big.Float, unit float64) (t time.Time) {
+	// unit is converted from its decimal form, since units such as 1e-9 aren't exact in binary
+	u, _, _ := big.ParseFloat(strconv.FormatFloat(unit, 'g', -1, 64), 10, 256, big.ToNearestEven)
+	ns := new(big.Float).SetPrec(256).Mul(sec, u)
+	ns.Mul(ns, big.NewFloat(1e9))
+	// round half away from zero
+	if ns.Sign() >= 0 {
+		ns.Add(ns, big.NewFloat(0.5))
+	} else {
+		ns.Sub(ns, big.NewFloat(0.5))
+	}
+	i, _ := ns.Int(nil)
+	if !i.IsInt64() {
 		return Epoch
 	}
-	i, f := math.Modf(sec)
-	return time.Unix(int64(i), int64(f*1e9)).UTC()
+	return time.Unix(0, 0).Add(time.Duration(i.Int64())).UTC()
+}
+
+var bigIntRanges = func() map[int][2]*big.Int {
+	one := big.NewInt(1)
+	signed := func(bits uint) [2]*big.Int {
+		max := new(big.Int).Lsh(one, bits-1)
+		return [2]*big.Int{new(big.Int).Neg(max), max.Sub(max, one)}
+	}
+	unsigned := func(bits uint) [2]*big.Int {
+		max := new(big.Int).Lsh(one, bits)
+		return [2]*big.Int{new(big.Int), max.Sub(max, one)}
+	}
+	return map[int][2]*big.Int{
+		model.Int128:  signed(128),
+		model.Int256:  signed(256),
+		model.UInt128: unsigned(128),
+		model.UInt256: unsigned(256),
+	}
+}()
+
+// parseBigInt parses s, an integer in decimal or a number whose fractional part is truncated, into a value of Int128, Int256, UInt128 or UInt256 typ.
+// The nearer border of typ is returned on overflow.
+func parseBigInt(s string, typ int) (i *big.Int, ok bool) {
+	r := bigIntRanges[typ]
+	if i, ok = new(big.Int).SetString(s, 10); !ok {
+		var f *big.Float
+		var err error
+		if f, _, err = big.ParseFloat(s, 10, 512, big.ToZero); err != nil {
+			return
+		}
+		ok = true
+		if f.IsInf() || f.MantExp(nil) > 256 {
+			// avoid materializing huge numbers
+			if f.Sign() < 0 {
+				return new(big.Int).Set(r[0]), ok
+			}
+			return new(big.Int).Set(r[1]), ok
+		}
+		i, _ = f.Int(nil)
+	}
+	if i.Cmp(r[0]) < 0 {
+		i.Set(r[0])
+	} else if i.Cmp(r[1]) > 0 {
+		i.Set(r[1])
+	}
+	return
+}
+
+// variantCandidates are the types of Variant members accepting values of a detected type, in the order of preference
+var variantCandidates = map[int][]int{
+	model.Bool: {model.Bool, model.UInt8, model.Int8},
+	model.Int64: {model.Int64, model.Int32, model.Int16, model.Int8, model.UInt64, model.UInt32, model.UInt16, model.UInt8,
+		model.Int128, model.Int256, model.UInt128, model.UInt256, model.Float64, model.Float32, model.Decimal, model.DateTime},
+	model.Float64:  {model.Float64, model.Float32, model.Decimal},
+	model.String:   {model.String},
+	model.DateTime: {model.DateTime, model.String},
+	model.Object:   {model.Map, model.Tuple, model.JSON},
+}
+
+// variantMember returns the index of the member of Variant typeinfo which a value of the detected type goes to, -1 if there's none.
+// Arrays go to the first array member whose elements have the detected type, or the first array member.
+func variantMember(typeinfo *model.TypeInfo, typ int, array bool) int {
+	if array {
+		idx := -1
+		for i, member := range typeinfo.VariantTypes {
+			if member.Array {
+				if member.Type == typ {
+					return i
+				}
+				if idx < 0 {
+					idx = i
+				}
+			}
+		}
+		return idx
+	}
+	for _, want := range variantCandidates[typ] {
+		for i, member := range typeinfo.VariantTypes {
+			if !member.Array && member.Type == want {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// dynamicTypes are the types of Dynamic values per detected type, strings are kept as they are even if they look like time
+var dynamicTypes = map[int]string{
+	model.Bool:     "Bool",
+	model.Int64:    "Int64",
+	model.Float64:  "Float64",
+	model.String:   "String",
+	model.DateTime: "String",
+}
+
+// dynamicType returns the type of Dynamic values of the detected type, it's empty for objects and arrays of them,
+// whose JSON text is stored as String
+func dynamicType(typ int, array bool) (name string) {
+	if name = dynamicTypes[typ]; name != "" && array {
+		name = "Array(" + name + ")"
+	}
+	return
+}
+
+// isRestKey tells whether a top-level member goes to DynamicSchema.JSONColumn, i.e. no column takes its source name srcKey,
+// and key passes white and black lists
+func isRestKey(srcKey, key string, columns map[string]struct{}, white, black *regexp.Regexp) bool {
+	if _, ok := columns[srcKey]; ok {
+		return false
+	}
+	return (white == nil || white.MatchString(key)) && (black == nil || !black.MatchString(key))
 }
@@ -16,26 +16,47 @@ limitations under the License.
 package parser
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2/lib/chcol"
+	"github.com/golang/snappy"
+	"github.com/housepower/clickhouse_sinker/config"
 	"github.com/housepower/clickhouse_sinker/model"
 	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/klauspost/compress/zstd"
+	"github.com/linkedin/goavro/v2"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tidwall/gjson"
 	"github.com/valyala/fastjson"
 	"golang.org/x/exp/constraints"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // https://golang.org/pkg/math/, Mathematical constants
@@ -623,7 +644,7 @@ func TestParserArray(t *testing.T) {
 				skipped = append(skipped, desc)
 				continue
 			}
-			v = metric.GetArray(testCases[j].Field, testCases[j].Type)
+			v = metric.GetArray(testCases[j].Field, arrayOf(testCases[j].Type))
 			assert.Equal(t, testCases[j].ExpVal, v, desc)
 		}
 		if skipped != nil {
@@ -632,6 +653,11 @@ func TestParserArray(t *testing.T) {
 	}
 }
 
+// arrayOf returns the type of arrays of basic typ, nanoseconds of DateTime are kept as GetDateTime does
+func arrayOf(typ int) *model.TypeInfo {
+	return &model.TypeInfo{Type: typ, Array: true, Elem: &model.TypeInfo{Type: typ, Precision: 9}}
+}
+
 func TestParserMap(t *testing.T) {
 	initialize.Do(initMetrics)
 	require.Nil(t, errInit)
@@ -857,7 +883,7 @@ func TestParseDateTime(t *testing.T) {
 			v, layout := parseInLocation(tc.TS, time.Local)
 			desc := fmt.Sprintf(`parseInLocation("%s", "%s") = %s(layout: %s), expect %s`, tc.TS, location, v.Format(time.RFC3339Nano), layout, tc.ExpVal.Format(time.RFC3339Nano))
 			if strings.Contains(tc.TS, "CST") && v != tc.ExpVal {
-				log.Printf(desc + "(CST is ambiguous)")
+				log.Print(desc + "(CST is ambiguous)")
 			} else {
 				require.Equal(t, tc.ExpVal, v, desc)
 			}
@@ -1117,6 +1143,1128 @@ func TestGjsonDetectSchema(t *testing.T) {
 	require.Equal(t, jsonSchema, act)
 }
 
+const avroSchemaSample = `{
+	"type": "record",
+	"name": "Sample",
+	"namespace": "com.example",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "name", "type": "string"},
+		{"name": "score", "type": ["null", "double"]},
+		{"name": "missing", "type": ["null", "string"], "default": null},
+		{"name": "ts", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "price", "type": {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2}},
+		{"name": "ip", "type": "string"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "nums", "type": {"type": "array", "items": ["null", "int"]}},
+		{"name": "attrs", "type": {"type": "map", "values": "long"}},
+		{"name": "inner", "type": ["null", {"type": "record", "name": "Inner", "fields": [{"name": "k", "type": ["null", "string"], "default": null}]}]}
+	]
+}`
+
+func TestAvroParser(t *testing.T) {
+	initialize.Do(initMetrics)
+	var hits int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/schemas/ids/7" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		b, _ := json.Marshal(map[string]string{"schema": avroSchemaSample})
+		_, _ = w.Write(b)
+	}))
+	defer registry.Close()
+
+	codec, err := goavro.NewCodec(avroSchemaSample)
+	require.Nil(t, err)
+	ts := time.Date(2009, 7, 13, 9, 7, 13, 123000000, time.UTC)
+	body, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"id":    int64(123),
+		"name":  "escaped_\"ws",
+		"score": goavro.Union("double", 123.321),
+		"ts":    ts,
+		"price": big.NewRat(12345, 100),
+		"ip":    "1.2.3.4",
+		"tags":  []interface{}{"aa", "bb"},
+		"nums":  []interface{}{goavro.Union("int", int32(1)), nil, goavro.Union("int", int32(3))},
+		"attrs": map[string]interface{}{"i": int64(1), "j": int64(2)},
+		"inner": goavro.Union("com.example.Inner", map[string]interface{}{"k": goavro.Union("string", "v")}),
+	})
+	require.Nil(t, err)
+	msg := append([]byte{0, 0, 0, 0, 7}, body...)
+
+	pp, err := NewParserPool("avro", nil, "", "", timeUnit, `{"fstr":"f"}`)
+	require.Nil(t, err)
+	pp.LoadSchemaRegistry(registry.URL)
+	parser, err := pp.Get()
+	require.Nil(t, err)
+	defer pp.Put(parser)
+	metric, err := parser.Parse(msg)
+	require.Nil(t, err)
+	_, err = parser.Parse(msg)
+	require.Nil(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits), "schema shall be cached")
+
+	require.Equal(t, int64(123), metric.GetInt64("id", false))
+	require.Equal(t, int8(123), metric.GetInt8("id", false))
+	require.Equal(t, uint16(123), metric.GetUint16("id", false))
+	require.Equal(t, "escaped_\"ws", metric.GetString("name", false))
+	require.Equal(t, 123.321, metric.GetFloat64("score", false))
+	require.Equal(t, float32(123.321), metric.GetFloat32("score", false))
+	require.Nil(t, metric.GetString("missing", true))
+	require.Equal(t, "", metric.GetString("missing", false))
+	require.Nil(t, metric.GetInt32("not_exist", true))
+	require.Equal(t, ts, metric.GetDateTime("ts", false))
+	require.True(t, decimal.RequireFromString("123.45").Equal(metric.GetDecimal("price", false).(decimal.Decimal)))
+	require.Equal(t, "1.2.3.4", metric.GetIPv4("ip", false))
+	require.Equal(t, "f", metric.GetString("fstr", false))
+	require.Equal(t, []string{"aa", "bb"}, metric.GetArray("tags", arrayOf(model.String)))
+	require.Equal(t, []int32{1, 0, 3}, metric.GetArray("nums", arrayOf(model.Int32)))
+	require.Equal(t, map[string]interface{}{"k": "v"}, metric.GetObject("inner", false))
+
+	m := metric.GetMap("attrs", &model.TypeInfo{Type: model.Map, MapKey: &model.TypeInfo{Type: model.String}, MapValue: &model.TypeInfo{Type: model.Int64}}).(*model.OrderedMap)
+	v, _ := m.Get("j")
+	require.Equal(t, int64(2), v)
+	require.Equal(t, 2, len(m.GetValues()))
+
+	var knownKeys, newKeys, warnKeys sync.Map
+	require.True(t, metric.GetNewKeys(&knownKeys, &newKeys, &warnKeys, nil, nil, 0, 0))
+	act := make(map[string]string)
+	newKeys.Range(func(k, v interface{}) bool {
+		act[k.(string)] = model.GetTypeName(v.(int))
+		return true
+	})
+	require.Equal(t, map[string]string{
+		"id":    "Int64",
+		"name":  "String",
+		"score": "Float64",
+		"ts":    "DateTime",
+		"price": "Float64",
+		"ip":    "String",
+		"fstr":  "String",
+	}, act)
+
+	_, err = parser.Parse([]byte(`{"id":1}`))
+	require.NotNil(t, err)
+	_, err = parser.Parse([]byte{0, 0, 0, 0, 8, 1})
+	require.NotNil(t, err)
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	var hits7, hits8, hits10 int32
+	release := make(chan struct{})
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/schemas/ids/7":
+			atomic.AddInt32(&hits7, 1)
+			<-release
+			_, _ = w.Write([]byte(`{"schema": "s7"}`))
+		case "/schemas/ids/8":
+			atomic.AddInt32(&hits8, 1)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "/schemas/ids/10":
+			atomic.AddInt32(&hits10, 1)
+			http.Error(w, "not found", http.StatusNotFound)
+		default:
+			_, _ = w.Write([]byte(`{"schema": "other"}`))
+		}
+	}))
+	defer registry.Close()
+	sr := NewSchemaRegistry(registry.URL)
+	compile := func(schema string) (interface{}, error) { return schema, nil }
+
+	// concurrent misses share one fetch, which doesn't block others
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := sr.Get(7, compile)
+			require.Nil(t, err)
+			require.Equal(t, "s7", v)
+		}()
+	}
+	v, err := sr.Get(9, compile)
+	require.Nil(t, err)
+	require.Equal(t, "other", v)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits7))
+
+	// missing schemas are cached for a while
+	defer func(interval time.Duration) { registryRetryInterval = interval }(registryRetryInterval)
+	registryRetryInterval = 100 * time.Millisecond
+	_, err = sr.Get(10, compile)
+	require.NotNil(t, err)
+	require.False(t, errors.Is(err, ErrRegistryUnavailable))
+	_, err = sr.Get(10, compile)
+	require.NotNil(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits10))
+	time.Sleep(150 * time.Millisecond)
+	_, err = sr.Get(10, compile)
+	require.NotNil(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits10))
+
+	// the registry being unavailable isn't cached
+	for i := 1; i <= 2; i++ {
+		_, err = sr.Get(8, compile)
+		require.True(t, errors.Is(err, ErrRegistryUnavailable))
+		require.Equal(t, int32(i), atomic.LoadInt32(&hits8))
+	}
+	_, err = NewSchemaRegistry("http://127.0.0.1:1").Get(8, compile)
+	require.True(t, errors.Is(err, ErrRegistryUnavailable))
+}
+
+func TestProtobufParser(t *testing.T) {
+	initialize.Do(initMetrics)
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		fd := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(num), Type: typ.Enum(), Label: label.Enum()}
+		if typeName != "" {
+			fd.TypeName = proto.String(typeName)
+		}
+		return fd
+	}
+	optional, repeated := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL, descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("sample.proto"),
+		Package:    proto.String("com.example"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name:  proto.String("Level"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{{Name: proto.String("INFO"), Number: proto.Int32(0)}, {Name: proto.String("WARN"), Number: proto.Int32(1)}},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Sample"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+				field("name", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+				field("score", 3, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional, ""),
+				field("level", 4, descriptorpb.FieldDescriptorProto_TYPE_ENUM, optional, ".com.example.Level"),
+				field("ts", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".google.protobuf.Timestamp"),
+				field("tags", 6, descriptorpb.FieldDescriptorProto_TYPE_STRING, repeated, ""),
+				field("attrs", 7, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".com.example.Sample.AttrsEntry"),
+				field("user", 8, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".com.example.Sample.User"),
+				field("count", 9, descriptorpb.FieldDescriptorProto_TYPE_UINT32, optional, ""),
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("AttrsEntry"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+				},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}, {
+				Name:  proto.String("User"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, "")},
+			}},
+		}},
+	}
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto), file}}
+	bs, err := proto.Marshal(fds)
+	require.Nil(t, err)
+	descFile := filepath.Join(t.TempDir(), "sample.pb")
+	require.Nil(t, os.WriteFile(descFile, bs, 0o644))
+
+	files, err := protodesc.NewFiles(fds)
+	require.Nil(t, err)
+	desc, err := files.FindDescriptorByName("com.example.Sample")
+	require.Nil(t, err)
+	md := desc.(protoreflect.MessageDescriptor)
+	msg := dynamicpb.NewMessage(md)
+	fields := md.Fields()
+	msg.Set(fields.ByName("id"), protoreflect.ValueOfInt64(123))
+	msg.Set(fields.ByName("name"), protoreflect.ValueOfString("escaped_\"ws"))
+	msg.Set(fields.ByName("score"), protoreflect.ValueOfFloat64(123.321))
+	msg.Set(fields.ByName("level"), protoreflect.ValueOfEnum(1))
+	ts := time.Date(2009, 7, 13, 9, 7, 13, 123000000, time.UTC)
+	msg.Set(fields.ByName("ts"), protoreflect.ValueOfMessage(timestamppb.New(ts).ProtoReflect()))
+	tags := msg.Mutable(fields.ByName("tags")).List()
+	tags.Append(protoreflect.ValueOfString("aa"))
+	tags.Append(protoreflect.ValueOfString("bb"))
+	attrs := msg.Mutable(fields.ByName("attrs")).Map()
+	attrs.Set(protoreflect.ValueOfString("i").MapKey(), protoreflect.ValueOfInt64(1))
+	attrs.Set(protoreflect.ValueOfString("j").MapKey(), protoreflect.ValueOfInt64(2))
+	user := msg.Mutable(fields.ByName("user")).Message()
+	user.Set(user.Descriptor().Fields().ByName("name"), protoreflect.ValueOfString("alice"))
+	body, err := proto.Marshal(msg)
+	require.Nil(t, err)
+
+	for _, confluent := range []bool{false, true} {
+		pp, err := NewParserPool("protobuf", nil, "", "", timeUnit, "")
+		require.Nil(t, err)
+		require.Nil(t, pp.LoadProtobuf(descFile, "com.example.Sample", confluent, 7))
+		parser, err := pp.Get()
+		require.Nil(t, err)
+		input := body
+		if confluent {
+			// magic byte, schema ID 7, and message indexes [0] encoded as a single 0
+			input = append([]byte{0, 0, 0, 0, 7, 0}, body...)
+		}
+		metric, err := parser.Parse(input)
+		require.Nil(t, err)
+
+		require.Equal(t, int64(123), metric.GetInt64("id", false))
+		require.Equal(t, int16(123), metric.GetInt16("id", false))
+		require.Equal(t, "escaped_\"ws", metric.GetString("name", false))
+		require.Equal(t, 123.321, metric.GetFloat64("score", false))
+		require.Equal(t, "WARN", metric.GetString("level", false))
+		require.Equal(t, ts, metric.GetDateTime("ts", false))
+		require.Equal(t, uint32(0), metric.GetUint32("count", true), "proto3 scalars default to zero")
+		require.Equal(t, "alice", metric.GetString("user.name", false))
+		require.Nil(t, metric.GetString("user.not_exist", true))
+		require.Equal(t, []string{"aa", "bb"}, metric.GetArray("tags", arrayOf(model.String)))
+		m := metric.GetMap("attrs", &model.TypeInfo{Type: model.Map, MapKey: &model.TypeInfo{Type: model.String}, MapValue: &model.TypeInfo{Type: model.Int64}}).(*model.OrderedMap)
+		v, _ := m.Get("i")
+		require.Equal(t, int64(1), v)
+		require.Equal(t, 2, len(m.GetValues()))
+		if confluent {
+			// message indexes [0] encoded explicitly
+			_, err = parser.Parse(append([]byte{0, 0, 0, 0, 7, 2, 0}, body...))
+			require.Nil(t, err)
+			// another schema ID
+			_, err = parser.Parse(append([]byte{0, 0, 0, 0, 8, 0}, body...))
+			require.NotNil(t, err)
+			// message indexes [1] locate another message type
+			_, err = parser.Parse(append([]byte{0, 0, 0, 0, 7, 2, 2}, body...))
+			require.NotNil(t, err)
+		}
+		pp.Put(parser)
+	}
+	// a nested message type is located by the indexes of itself and its enclosing messages
+	pp, _ := NewParserPool("protobuf", nil, "", "", timeUnit, "")
+	require.Nil(t, pp.LoadProtobuf(descFile, "com.example.Sample.User", true, 0))
+	require.Equal(t, []int64{0, 1}, pp.protobuf.indexes)
+	parser, err := pp.Get()
+	require.Nil(t, err)
+	userBody, err := proto.Marshal(user.Interface())
+	require.Nil(t, err)
+	metric, err := parser.Parse(append([]byte{0, 0, 0, 0, 9, 4, 0, 2}, userBody...))
+	require.Nil(t, err)
+	require.Equal(t, "alice", metric.GetString("name", false))
+	_, err = parser.Parse(append([]byte{0, 0, 0, 0, 9, 0}, userBody...))
+	require.NotNil(t, err)
+	pp.Put(parser)
+	require.NotNil(t, pp.LoadProtobuf(descFile, "com.example.NotExist", false, 0))
+}
+
+type kvParser struct {
+	pp *Pool
+}
+
+func (p *kvParser) Parse(bs []byte) (metric model.Metric, err error) {
+	values := make(map[string]interface{})
+	for _, kv := range strings.Fields(string(bs)) {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			values[k] = v
+		}
+	}
+	return NewNativeMetric(p.pp, values), nil
+}
+
+func TestRegister(t *testing.T) {
+	require.True(t, Registered("fastjson"))
+	require.True(t, HasCapability("gjson", CapDynamicSchema))
+	require.False(t, HasCapability("csv", CapDynamicSchema))
+	require.False(t, Registered("kv"))
+
+	var configured string
+	Register("kv", func(pp *Pool) (Parser, error) {
+		return &kvParser{pp: pp}, nil
+	}, Validator(func(taskCfg *config.TaskConfig) error {
+		if taskCfg.Delimiter == "" {
+			return errors.New("kv requires Delimiter")
+		}
+		return nil
+	}), Configurer(func(pp *Pool, taskCfg *config.TaskConfig) error {
+		configured = taskCfg.Name
+		return nil
+	}))
+	require.True(t, Registered("kv"))
+	require.False(t, HasCapability("kv", CapDynamicSchema))
+	taskCfg := &config.TaskConfig{Name: "test_kv", Parser: "kv"}
+	require.NotNil(t, CheckTask(taskCfg))
+	taskCfg.Delimiter = " "
+	require.Nil(t, CheckTask(taskCfg))
+	taskCfg.DynamicSchema.Enable = true
+	require.NotNil(t, CheckTask(taskCfg))
+	require.NotNil(t, CheckTask(&config.TaskConfig{Parser: "not_exist"}))
+
+	pp, _ := NewParserPool("kv", nil, "", "", timeUnit, "")
+	require.Nil(t, pp.Configure(taskCfg))
+	require.Equal(t, "test_kv", configured)
+	parser, err := pp.Get()
+	require.Nil(t, err)
+	metric, err := parser.Parse([]byte("a=1 b=x"))
+	require.Nil(t, err)
+	require.Equal(t, int32(1), metric.GetInt32("a", false))
+	require.Equal(t, "x", metric.GetString("b", false))
+
+	pp, _ = NewParserPool("not_exist", nil, "", "", timeUnit, "")
+	_, err = pp.Get()
+	require.NotNil(t, err)
+}
+
+func TestExplode(t *testing.T) {
+	testCases := []struct {
+		msg     string
+		path    string
+		inherit bool
+		exp     []string
+		err     bool
+	}{
+		{`[{"a":1},{"a":2}]`, ExplodeRootArray, false, []string{`{"a":1}`, `{"a":2}`}, false},
+		{`[]`, ExplodeRootArray, false, nil, false},
+		{`{"a":1}`, ExplodeRootArray, false, nil, true},
+		{"{\"a\":1}\n\n{\"a\":2}\n", ExplodeNDJSON, false, []string{`{"a":1}`, `{"a":2}`}, false},
+		{`{"host":"h1","events":[{"a":1},{"a":2}]}`, "events", false, []string{`{"a":1}`, `{"a":2}`}, false},
+		{`{"host":"h1","a":0,"events":[{"a":1},{"b":2},3]}`, "events", true, []string{`{"a":1,"host":"h1"}`, `{"b":2,"host":"h1","a":0}`, `3`}, false},
+		{`{"host":"h1","data":{"events":[{"a":1}]}}`, "data.events", true, []string{`{"a":1,"host":"h1"}`}, false},
+		{`{"host":"h1"}`, "events", true, nil, false},
+		{`{"events":1}`, "events", false, nil, true},
+		{`not json`, "events", false, nil, true},
+	}
+	for _, tc := range testCases {
+		elems, err := Explode([]byte(tc.msg), tc.path, tc.inherit)
+		if tc.err {
+			require.NotNil(t, err, tc.msg)
+			continue
+		}
+		require.Nil(t, err, tc.msg)
+		var act []string
+		for _, e := range elems {
+			act = append(act, string(e))
+		}
+		require.Equal(t, tc.exp, act, tc.msg)
+	}
+}
+
+func TestValueDecoder(t *testing.T) {
+	raw := []byte(`{"a":1}`)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write(raw)
+	require.Nil(t, w.Close())
+	enc, err := zstd.NewWriter(nil)
+	require.Nil(t, err)
+	zs := enc.EncodeAll(raw, nil)
+	var framed bytes.Buffer
+	sw := snappy.NewBufferedWriter(&framed)
+	_, _ = sw.Write(raw)
+	require.Nil(t, sw.Close())
+
+	testCases := []struct {
+		pipeline string
+		value    []byte
+	}{
+		{"", raw},
+		{"identity", raw},
+		{"gzip", gz.Bytes()},
+		{"zstd", zs},
+		{"snappy", snappy.Encode(nil, raw)},
+		{"snappy", framed.Bytes()},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(raw))},
+		{"base64", []byte(base64.RawURLEncoding.EncodeToString(raw))},
+		{"base64 | gzip", []byte(base64.StdEncoding.EncodeToString(gz.Bytes()))},
+		{"BASE64|zstd", []byte(base64.StdEncoding.EncodeToString(zs))},
+	}
+	var decoders ValueDecoders
+	for _, tc := range testCases {
+		dec, err := decoders.Get(tc.pipeline)
+		require.Nil(t, err, tc.pipeline)
+		act, err := dec.Decode(tc.value)
+		require.Nil(t, err, tc.pipeline)
+		require.Equal(t, raw, act, tc.pipeline)
+	}
+	_, err = NewValueDecoder("base64|lz5")
+	require.NotNil(t, err)
+	dec, _ := NewValueDecoder("gzip")
+	_, err = dec.Decode(raw)
+	require.NotNil(t, err)
+
+	// values decompressing to more than MaxDecodedSize bytes fail
+	bomb := make([]byte, MaxDecodedSize+1)
+	gz.Reset()
+	w.Reset(&gz)
+	_, _ = w.Write(bomb)
+	require.Nil(t, w.Close())
+	framed.Reset()
+	sw.Reset(&framed)
+	_, _ = sw.Write(bomb)
+	require.Nil(t, sw.Close())
+	bombs := []struct {
+		pipeline string
+		value    []byte
+	}{
+		{"gzip", gz.Bytes()},
+		{"zstd", enc.EncodeAll(bomb, nil)},
+		{"snappy", snappy.Encode(nil, bomb)},
+		{"snappy", framed.Bytes()},
+	}
+	for _, tc := range bombs {
+		dec, err := decoders.Get(tc.pipeline)
+		require.Nil(t, err, tc.pipeline)
+		_, err = dec.Decode(tc.value)
+		require.True(t, errors.Is(err, errDecodedSize), tc.pipeline)
+	}
+}
+
+func TestCsvOptions(t *testing.T) {
+	initialize.Do(initMetrics)
+	// Fields extras, null tokens and lenient trailing fields
+	pp, _ := NewParserPool("csv", []string{"a", "b", "c"}, "\t", "", timeUnit, `{"src":"tsv","n":3}`)
+	pp.LoadCsv(false, "", true, []string{`\N`, "NULL"})
+	parser, err := pp.Get()
+	require.Nil(t, err)
+	metric, err := parser.Parse([]byte("1\t\\N"))
+	require.Nil(t, err)
+	require.Equal(t, int64(1), metric.GetInt64("a", false))
+	require.Equal(t, nil, metric.GetInt64("b", true))
+	require.Equal(t, "", metric.GetString("c", false))
+	require.Equal(t, nil, metric.GetIPv6("c", true))
+	require.Equal(t, "tsv", metric.GetString("src", false))
+	require.Equal(t, int32(3), metric.GetInt32("n", false))
+	_, err = parser.Parse([]byte("1\t2\t3\t4"))
+	require.NotNil(t, err)
+
+	// the first record is the header, multi-character delimiter
+	pp, _ = NewParserPool("csv", nil, "||", "", timeUnit, "")
+	pp.LoadCsv(true, "", false, nil)
+	parser, _ = pp.Get()
+	metric, err = parser.Parse([]byte("name||age\r\n\"Smith, \"\"J\"\"||x\"||42\n"))
+	require.Nil(t, err)
+	require.Equal(t, `Smith, "J"||x`, metric.GetString("name", false))
+	require.Equal(t, int64(42), metric.GetInt64("age", false))
+	_, err = parser.Parse([]byte("name||age\nSmith"))
+	require.NotNil(t, err)
+	_, err = parser.Parse([]byte("name||age"))
+	require.NotNil(t, err)
+
+	// the header is taken from a message header, CsvFormat is the fallback
+	pp, _ = NewParserPool("csv", []string{"x", "y"}, ",", "", timeUnit, "")
+	pp.LoadCsv(false, "columns", false, nil)
+	p, _ := pp.Get()
+	mp := p.(MessageParser)
+	metric, err = mp.ParseMessage([]byte("1,2"), &model.InputMessage{Headers: []model.MsgHeader{{Key: "Columns", Value: []byte("y,x")}}})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), metric.GetInt64("x", false))
+	require.Equal(t, nil, metric.GetInt64("z", true))
+	metric, err = mp.ParseMessage([]byte("1,null"), &model.InputMessage{})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), metric.GetInt64("x", false))
+	require.Equal(t, nil, metric.GetInt64("y", true))
+}
+
+func TestDebeziumParser(t *testing.T) {
+	initialize.Do(initMetrics)
+	pp, _ := NewParserPool("debezium", nil, "", "", timeUnit, `{"db":"inventory"}`)
+	pp.LoadCdc("sign", "is_deleted", "version", false)
+	p, err := pp.Get()
+	require.Nil(t, err)
+	parser := p.(MessageParser)
+
+	// Postgres update with the schema
+	metric, err := parser.ParseMessage([]byte(`{"schema":{"type":"struct"},"payload":{"before":{"id":1,"name":"a"},"after":{"id":1,"name":"b"},"source":{"connector":"postgresql","lsn":33841872,"ts_ms":1700000000000},"op":"u","ts_ms":1700000000123}}`), nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), metric.GetInt64("id", false))
+	require.Equal(t, "b", metric.GetString("name", false))
+	require.Equal(t, "u", metric.GetString(CdcOp, false))
+	require.Equal(t, int64(1700000000123), metric.GetInt64(CdcTsMs, false))
+	require.Equal(t, int8(1), metric.GetInt8("sign", false))
+	require.Equal(t, uint8(0), metric.GetUint8("is_deleted", false))
+	require.Equal(t, uint64(33841872), metric.GetUint64("version", false))
+	require.Equal(t, "inventory", metric.GetString("db", false))
+
+	// MySQL delete without the schema
+	metric, err = parser.ParseMessage([]byte(`{"before":{"id":2,"name":"c"},"after":null,"source":{"connector":"mysql","file":"mysql-bin.000003","pos":154},"op":"d","ts_ms":1}`), nil)
+	require.Nil(t, err)
+	require.Equal(t, "c", metric.GetString("name", false))
+	require.Equal(t, int8(-1), metric.GetInt8("sign", false))
+	require.Equal(t, uint8(1), metric.GetUint8("is_deleted", false))
+	require.Equal(t, uint64(3<<32|154), metric.GetUint64("version", false))
+
+	// tombstone
+	ts := time.UnixMilli(1700000000456)
+	metric, err = parser.ParseMessage(nil, &model.InputMessage{Key: []byte(`{"schema":{},"payload":{"id":2}}`), Timestamp: &ts})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), metric.GetInt64("id", false))
+	require.Equal(t, nil, metric.GetString("name", true))
+	require.Equal(t, "d", metric.GetString(CdcOp, false))
+	require.Equal(t, int8(-1), metric.GetInt8("sign", false))
+	require.Equal(t, int64(1700000000456), metric.GetInt64(CdcTsMs, false))
+	require.Equal(t, uint64(1700000000456), metric.GetUint64("version", false))
+
+	// the tombstone following a delete of the key is skipped, but not the one of another key or partition
+	deleted := &model.InputMessage{Topic: "t", Partition: 1, Offset: 10, Key: []byte(`{"id":3}`)}
+	metric, err = parser.ParseMessage([]byte(`{"before":{"id":3},"source":{"ts_ms":1},"op":"d"}`), deleted)
+	require.Nil(t, err)
+	require.Equal(t, int8(-1), metric.GetInt8("sign", false))
+	tombstone := &model.InputMessage{Topic: "t", Partition: 1, Offset: 11, Key: []byte(`{"id":3}`)}
+	_, err = parser.ParseMessage(nil, tombstone)
+	require.Equal(t, ErrSkipped, err)
+	metric, err = parser.ParseMessage(nil, tombstone)
+	require.Nil(t, err)
+	require.Equal(t, uint64(11), metric.GetUint64("version", false))
+	_, err = parser.ParseMessage([]byte(`{"before":{"id":3},"source":{"ts_ms":1},"op":"d"}`), deleted)
+	require.Nil(t, err)
+	_, err = parser.ParseMessage(nil, &model.InputMessage{Topic: "t", Partition: 2, Offset: 11, Key: []byte(`{"id":3}`)})
+	require.Nil(t, err)
+
+	for _, msg := range []string{`{"id":1}`, `{"op":"t","source":{}}`, `{"op":"c","after":null}`} {
+		_, err = parser.ParseMessage([]byte(msg), nil)
+		require.NotNil(t, err, msg)
+	}
+	_, err = parser.ParseMessage(nil, &model.InputMessage{})
+	require.NotNil(t, err)
+
+	pp, _ = NewParserPool("debezium", nil, "", "", timeUnit, "")
+	pp.LoadCdc("", "", "", true)
+	p, _ = pp.Get()
+	_, err = p.(MessageParser).ParseMessage(nil, &model.InputMessage{Key: []byte(`{"id":2}`)})
+	require.Equal(t, ErrSkipped, err)
+}
+
+func TestCanalParser(t *testing.T) {
+	initialize.Do(initMetrics)
+	pp, _ := NewParserPool("canal", nil, "", "Asia/Shanghai", timeUnit, "")
+	pp.LoadCdc("sign", "is_deleted", "version", false)
+	p, err := pp.Get()
+	require.Nil(t, err)
+	msg := `{"data":[{"id":"1","price":"12.30","amount":"18446744073709551615","created":"2020-05-13 20:39:20","name":"a","note":null},{"id":"2","price":"1.5","amount":"0","created":"2020-05-13 20:39:21","name":"b","note":"x"}],` +
+		`"old":[{"name":"c"},{"name":"d"}],"database":"db","table":"t","es":1589373560000,"isDdl":false,` +
+		`"mysqlType":{"id":"int(11)","price":"decimal(10,2)","amount":"bigint(20) unsigned","created":"datetime","name":"varchar(32)","note":"text"},"type":"UPDATE"}`
+	elems, err := p.(Splitter).Split([]byte(msg))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(elems))
+
+	metric, err := p.Parse(elems[0])
+	require.Nil(t, err)
+	require.Equal(t, int64(1), metric.GetInt64("id", false))
+	require.True(t, decimal.RequireFromString("12.3").Equal(metric.GetDecimal("price", false).(decimal.Decimal)))
+	require.Equal(t, uint64(math.MaxUint64), metric.GetUint64("amount", false))
+	require.Equal(t, time.Date(2020, 5, 13, 12, 39, 20, 0, time.UTC), metric.GetDateTime("created", false))
+	require.Equal(t, "a", metric.GetString("name", false))
+	require.Equal(t, nil, metric.GetString("note", true))
+	require.Equal(t, "u", metric.GetString(CdcOp, false))
+	require.Equal(t, int64(1589373560000), metric.GetInt64(CdcTsMs, false))
+	require.Equal(t, uint64(1589373560000), metric.GetUint64("version", false))
+	require.Equal(t, int8(1), metric.GetInt8("sign", false))
+	metric, err = p.Parse(elems[1])
+	require.Nil(t, err)
+	require.Equal(t, "b", metric.GetString("name", false))
+
+	metric, err = p.Parse([]byte(`{"data":[{"id":"3"}],"mysqlType":{"id":"int(11)"},"type":"DELETE","isDdl":false,"es":1}`))
+	require.Nil(t, err)
+	require.Equal(t, int64(3), metric.GetInt64("id", false))
+	require.Equal(t, int8(-1), metric.GetInt8("sign", false))
+	require.Equal(t, uint8(1), metric.GetUint8("is_deleted", false))
+
+	ddl := []byte(`{"data":null,"isDdl":true,"sql":"ALTER TABLE t ADD c INT","type":"ALTER"}`)
+	elems, err = p.(Splitter).Split(ddl)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(elems))
+	_, err = p.Parse(ddl)
+	require.Equal(t, ErrSkipped, err)
+	_, err = p.Parse([]byte(msg))
+	require.NotNil(t, err)
+	_, err = p.Parse([]byte(`{"id":1}`))
+	require.NotNil(t, err)
+}
+
+func TestMaxwellParser(t *testing.T) {
+	initialize.Do(initMetrics)
+	pp, _ := NewParserPool("maxwell", nil, "", "", timeUnit, "")
+	pp.LoadCdc("", "is_deleted", "version", false)
+	p, err := pp.Get()
+	require.Nil(t, err)
+	metric, err := p.Parse([]byte(`{"database":"test","table":"t","type":"delete","ts":1449786310,"position":"master.000006:800911","data":{"id":1,"name":"a","tags":["x","y"],"attrs":{"k":"v"}}}`))
+	require.Nil(t, err)
+	require.Equal(t, int64(1), metric.GetInt64("id", false))
+	require.Equal(t, "a", metric.GetString("name", false))
+	require.Equal(t, []string{"x", "y"}, metric.GetArray("tags", arrayOf(model.String)))
+	require.Equal(t, `{"k":"v"}`, metric.GetString("attrs", false))
+	require.Equal(t, "d", metric.GetString(CdcOp, false))
+	require.Equal(t, int64(1449786310000), metric.GetInt64(CdcTsMs, false))
+	require.Equal(t, uint64(6<<32|800911), metric.GetUint64("version", false))
+	require.Equal(t, uint8(1), metric.GetUint8("is_deleted", false))
+
+	metric, err = p.Parse([]byte(`{"type":"bootstrap-insert","ts":1449786310,"data":{"id":2}}`))
+	require.Nil(t, err)
+	require.Equal(t, "r", metric.GetString(CdcOp, false))
+	require.Equal(t, uint64(1449786310), metric.GetUint64("version", false))
+	require.Equal(t, uint8(0), metric.GetUint8("is_deleted", false))
+
+	for _, msg := range []string{`{"type":"bootstrap-start","data":{}}`, `{"type":"table-create","def":{}}`} {
+		_, err = p.Parse([]byte(msg))
+		require.Equal(t, ErrSkipped, err, msg)
+	}
+	for _, msg := range []string{`{"id":1}`, `{"type":"insert","data":null}`} {
+		_, err = p.Parse([]byte(msg))
+		require.NotNil(t, err, msg)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	initialize.Do(initMetrics)
+	msg := []byte(`{"id":1,"http":{"request":{"method":"GET","bytes":12},"status_code":200},"labels":{"k":"v"},"a":{"b":{"c":{"d":1}}}}`)
+	for _, name := range []string{"fastjson", "gjson"} {
+		for _, sep := range []string{"_", "."} {
+			desc := name + " " + sep
+			pp, _ := NewParserPool(name, nil, "", "", timeUnit, "")
+			pp.LoadFlatten(sep, 2)
+			parser, err := pp.Get()
+			require.Nil(t, err, desc)
+			metric, err := parser.Parse(msg)
+			require.Nil(t, err, desc)
+			key := func(parts ...string) string {
+				return util.GetSourceName(name, strings.Join(parts, sep))
+			}
+			require.Equal(t, "GET", metric.GetString(key("http", "request", "method"), false), desc)
+			require.Equal(t, int64(12), metric.GetInt64(key("http", "request", "bytes"), false), desc)
+			require.Equal(t, int64(200), metric.GetInt64(key("http", "status_code"), false), desc)
+			require.Equal(t, int64(1), metric.GetInt64("id", false), desc)
+			require.Equal(t, nil, metric.GetInt64(key("a", "b", "c", "d"), true), desc)
+			require.Equal(t, nil, metric.GetString(key("http", "missing"), true), desc)
+
+			var knownKeys, newKeys, warnKeys sync.Map
+			knownKeys.Store("id", nil)
+			knownKeys.Store("labels", nil)
+			require.True(t, metric.GetNewKeys(&knownKeys, &newKeys, &warnKeys, nil, nil, 0, 0), desc)
+			found := make(map[string]int)
+			newKeys.Range(func(k, v interface{}) bool {
+				found[k.(string)] = v.(int)
+				return true
+			})
+			require.Equal(t, map[string]int{
+				strings.Join([]string{"http", "request", "method"}, sep): model.String,
+				strings.Join([]string{"http", "request", "bytes"}, sep):  model.Int64,
+				strings.Join([]string{"http", "status_code"}, sep):       model.Int64,
+			}, found, desc)
+			// a.b.c is deeper than the max depth
+			_, warned := warnKeys.Load(key("a", "b", "c"))
+			require.True(t, warned, desc)
+		}
+	}
+}
+
+func TestTuple(t *testing.T) {
+	initialize.Do(initMetrics)
+	ti := model.WhichType("Tuple(a String, `b c` Nullable(Int64), m Map(String, Int32))")
+	require.Equal(t, []string{"a", "b c", "m"}, ti.TupleNames)
+	require.Equal(t, model.Map, ti.TupleTypes[2].Type)
+	require.True(t, ti.TupleTypes[1].Nullable)
+	unnamed := model.WhichType("Tuple(String, Array(Int32))")
+	require.Nil(t, unnamed.TupleNames)
+	require.True(t, unnamed.TupleTypes[1].Array)
+	nested := model.WhichType("Nested(k String, v Float64)")
+	require.True(t, nested.Array)
+	require.Equal(t, model.Tuple, nested.Type)
+
+	msg := []byte(`{"t":{"a":"x","m":{"k":1}},"u":["y",[1,2]],"n":[{"k":"p","v":1.5},{"k":"q"}]}`)
+	var values map[string]interface{}
+	require.Nil(t, json.Unmarshal(msg, &values))
+	m := model.NewOrderedMap()
+	m.Put("k", int32(1))
+	for _, name := range []string{"fastjson", "gjson", "native"} {
+		var metric model.Metric
+		pp, _ := NewParserPool(name, nil, "", "", timeUnit, "")
+		if name == "native" {
+			metric = NewNativeMetric(pp, values)
+		} else {
+			parser, err := pp.Get()
+			require.Nil(t, err, name)
+			metric, err = parser.Parse(msg)
+			require.Nil(t, err, name)
+		}
+		require.Equal(t, []interface{}{"x", nil, m}, metric.GetTuple("t", ti), name)
+		require.Equal(t, []interface{}{"y", []int32{1, 2}}, metric.GetTuple("u", unnamed), name)
+		require.Equal(t, []interface{}{
+			[]interface{}{"p", 1.5},
+			[]interface{}{"q", 0.0},
+		}, metric.GetArray("n", nested), name)
+		// columns of a flattened Nested
+		require.Equal(t, []string{"p", "q"}, metric.GetArray(util.GetSourceName(name, "n.k"), arrayOf(model.String)), name)
+		require.Equal(t, []float64{1.5, 0}, metric.GetArray(util.GetSourceName(name, "n.v"), arrayOf(model.Float64)), name)
+		require.Equal(t, []interface{}{}, metric.GetArray("missing", nested), name)
+	}
+}
+
+func TestNestedTypes(t *testing.T) {
+	initialize.Do(initMetrics)
+	arrArr := model.WhichType("Array(Array(String))")
+	require.True(t, arrArr.Array)
+	require.True(t, arrArr.Elem.Array)
+	require.Equal(t, model.String, arrArr.Elem.Elem.Type)
+	arrNull := model.WhichType("Array(Nullable(Int64))")
+	require.True(t, arrNull.Elem.Nullable)
+	mapArr := model.WhichType("Map(String, Array(String))")
+	require.True(t, mapArr.MapValue.Array)
+	mapMap := model.WhichType("Map(String, Map(String, Int32))")
+	require.Equal(t, model.Map, mapMap.MapValue.Type)
+	arrMap := model.WhichType("Array(Map(String, Nullable(Int64)))")
+	require.Equal(t, model.Map, arrMap.Elem.Type)
+	arrTime := model.WhichType("Array(DateTime64(3))")
+
+	msg := []byte(`{"aa":[["a","b"],[],["c"]],"an":[1,null,3],"ma":{"k":["a","b"]},"mm":{"k":{"x":1}},"am":[{"k":1},{"k":null}],"at":[1700000000123]}`)
+	var values map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	require.Nil(t, dec.Decode(&values))
+	orderedMap := func(k string, v interface{}) *model.OrderedMap {
+		m := model.NewOrderedMap()
+		m.Put(k, v)
+		return m
+	}
+	for _, name := range []string{"fastjson", "gjson", "native"} {
+		var metric model.Metric
+		pp, _ := NewParserPool(name, nil, "", "", 0.001, "")
+		if name == "native" {
+			metric = NewNativeMetric(pp, values)
+		} else {
+			parser, err := pp.Get()
+			require.Nil(t, err, name)
+			metric, err = parser.Parse(msg)
+			require.Nil(t, err, name)
+		}
+		require.Equal(t, []interface{}{[]string{"a", "b"}, []string{}, []string{"c"}}, metric.GetArray("aa", arrArr), name)
+		require.Equal(t, []interface{}{int64(1), nil, int64(3)}, metric.GetArray("an", arrNull), name)
+		require.Equal(t, orderedMap("k", []string{"a", "b"}), metric.GetMap("ma", mapArr), name)
+		require.Equal(t, orderedMap("k", orderedMap("x", int32(1))), metric.GetMap("mm", mapMap), name)
+		require.Equal(t, []interface{}{orderedMap("k", int64(1)), orderedMap("k", nil)}, metric.GetArray("am", arrMap), name)
+		require.Equal(t, []time.Time{time.Date(2023, 11, 14, 22, 13, 20, 123000000, time.UTC)}, metric.GetArray("at", arrTime), name)
+		require.Equal(t, []interface{}{}, metric.GetArray("missing", arrArr), name)
+	}
+}
+
+func TestBigInt(t *testing.T) {
+	initialize.Do(initMetrics)
+	msg := []byte(`{"i":-170141183460469231731687303715884105728,"u":"340282366920938463463374607431768211455","f":1.5e3,"o":1e100,"n":-1,"b":true,"arr":[1,"2",null]}`)
+	var values map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	require.Nil(t, dec.Decode(&values))
+	// big.Int of the same value may differ in internal representation
+	str := func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case *big.Int:
+			return v.String()
+		case []*big.Int:
+			arr := make([]string, 0, len(v))
+			for _, i := range v {
+				arr = append(arr, i.String())
+			}
+			return arr
+		}
+		return v
+	}
+	for _, name := range []string{"fastjson", "gjson", "native"} {
+		var metric model.Metric
+		pp, _ := NewParserPool(name, nil, "", "", timeUnit, "")
+		if name == "native" {
+			metric = NewNativeMetric(pp, values)
+		} else {
+			parser, err := pp.Get()
+			require.Nil(t, err, name)
+			metric, err = parser.Parse(msg)
+			require.Nil(t, err, name)
+		}
+		require.Equal(t, "-170141183460469231731687303715884105728", str(metric.GetBigInt("i", model.WhichType("Int128"))), name)
+		require.Equal(t, "340282366920938463463374607431768211455", str(metric.GetBigInt("u", model.WhichType("UInt128"))), name)
+		require.Equal(t, "1500", str(metric.GetBigInt("f", model.WhichType("Int256"))), name)
+		// overflow gets the nearer border
+		require.Equal(t, "340282366920938463463374607431768211455", str(metric.GetBigInt("o", model.WhichType("UInt128"))), name)
+		require.Equal(t, "0", str(metric.GetBigInt("n", model.WhichType("UInt256"))), name)
+		require.Equal(t, "1", str(metric.GetBigInt("b", model.WhichType("Int128"))), name)
+		require.Equal(t, nil, metric.GetBigInt("missing", model.WhichType("Nullable(Int128)")), name)
+		require.Equal(t, "0", str(metric.GetBigInt("missing", model.WhichType("Int128"))), name)
+		require.Equal(t, []string{"1", "2", "0"}, str(metric.GetArray("arr", arrayOf(model.Int256))), name)
+	}
+}
+
+func TestTimeTypes(t *testing.T) {
+	initialize.Do(initMetrics)
+	dt64 := model.WhichType("DateTime64(3, 'Asia/Shanghai')")
+	require.Equal(t, 3, dt64.Precision)
+	require.Equal(t, "Asia/Shanghai", dt64.Location.String())
+	require.Equal(t, "Asia/Shanghai", model.WhichType("Nullable(DateTime('Asia/Shanghai'))").Location.String())
+	date32 := model.WhichType("Date32")
+	dateTime := model.WhichType("DateTime")
+
+	msg := []byte(`{"ns":1700000000123456789,"ms":1700000000123,"local":"2023-11-15 06:13:20.123456","zoned":"2023-11-14T22:13:20.1234Z","old":"1901-02-03","far":"2200-01-01 00:00:00"}`)
+	var values map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	require.Nil(t, dec.Decode(&values))
+	want := time.Date(2023, 11, 14, 22, 13, 20, 123000000, time.UTC)
+	for _, name := range []string{"fastjson", "gjson", "native"} {
+		for unit, key := range map[float64]string{1e-9: "ns", 1e-3: "ms"} {
+			desc := name + " " + key
+			var metric model.Metric
+			pp, _ := NewParserPool(name, nil, "", "UTC", unit, "")
+			if name == "native" {
+				metric = NewNativeMetric(pp, values)
+			} else {
+				parser, err := pp.Get()
+				require.Nil(t, err, desc)
+				metric, err = parser.Parse(msg)
+				require.Nil(t, err, desc)
+			}
+			// truncated to the precision without float rounding errors
+			require.Equal(t, want, metric.GetTime(key, dt64), desc)
+			if key == "ns" {
+				require.Equal(t, time.Date(2023, 11, 14, 22, 13, 20, 123456789, time.UTC), metric.GetTime(key, model.WhichType("DateTime64(9)")), desc)
+			}
+			require.Equal(t, want.Truncate(time.Second), metric.GetTime(key, dateTime), desc)
+			// zone-less values are in the timezone of the column
+			require.Equal(t, want, metric.GetTime("local", dt64), desc)
+			require.Equal(t, time.Date(2023, 11, 15, 6, 13, 20, 0, time.UTC), metric.GetTime("local", dateTime), desc)
+			require.Equal(t, want, metric.GetTime("zoned", dt64), desc)
+			// ranges beyond DateTime
+			require.Equal(t, time.Date(1901, 2, 3, 0, 0, 0, 0, time.UTC), metric.GetTime("old", date32), desc)
+			require.Equal(t, Epoch, metric.GetTime("old", dateTime), desc)
+			require.Equal(t, time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC), metric.GetTime("far", model.WhichType("DateTime64(0)")), desc)
+			require.Equal(t, Epoch, metric.GetTime("far", dateTime), desc)
+			require.Equal(t, nil, metric.GetTime("missing", model.WhichType("Nullable(DateTime64(3))")), desc)
+		}
+	}
+}
+
+func TestSemiStructuredTypes(t *testing.T) {
+	initialize.Do(initMetrics)
+	require.Equal(t, model.JSON, model.WhichType("JSON(max_dynamic_paths=16, a.b UInt32, SKIP a.c)").Type)
+	require.Equal(t, model.Dynamic, model.WhichType("Dynamic(max_types=8)").Type)
+	variant := model.WhichType("Variant(String, Int64, Array(String), Map(String, String))")
+	require.Equal(t, []string{"String", "Int64", "Array(String)", "Map(String, String)"}, variant.VariantNames)
+	require.True(t, variant.VariantTypes[2].Array)
+	dynamic := model.WhichType("Dynamic")
+
+	msg := []byte(`{"j":{"b":1,"a":"x"},"s":"str","n":3,"f":1.5,"b":true,"arr":[1,2],"obj":{"k":"v"},"null":null,"extra":{"y":[1]}}`)
+	var values map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	require.Nil(t, dec.Decode(&values))
+	orderedMap := model.NewOrderedMap()
+	orderedMap.Put("k", "v")
+	columns := map[string]struct{}{"j": {}, "s": {}, "n": {}, "f": {}, "b": {}, "arr": {}}
+	for _, name := range []string{"fastjson", "gjson", "native"} {
+		var metric model.Metric
+		pp, _ := NewParserPool(name, nil, "", "", timeUnit, "")
+		if name == "native" {
+			metric = NewNativeMetric(pp, values)
+		} else {
+			parser, err := pp.Get()
+			require.Nil(t, err, name)
+			metric, err = parser.Parse(msg)
+			require.Nil(t, err, name)
+		}
+		require.JSONEq(t, `{"b":1,"a":"x"}`, metric.GetJSON("j", false).(string), name)
+		require.Equal(t, EmptyJSON, metric.GetJSON("s", false), name)
+		require.Equal(t, EmptyJSON, metric.GetJSON("missing", false), name)
+
+		require.Equal(t, chcol.NewVariantWithType("str", "String"), metric.GetVariant("s", variant), name)
+		require.Equal(t, chcol.NewVariantWithType(int64(3), "Int64"), metric.GetVariant("n", variant), name)
+		require.Equal(t, chcol.NewVariantWithType([]string{"1", "2"}, "Array(String)"), metric.GetVariant("arr", variant), name)
+		require.Equal(t, chcol.NewVariantWithType(orderedMap, "Map(String, String)"), metric.GetVariant("obj", variant), name)
+		// no member takes booleans
+		require.Equal(t, nil, metric.GetVariant("b", variant), name)
+		require.Equal(t, nil, metric.GetVariant("null", variant), name)
+
+		require.Equal(t, chcol.NewDynamicWithType(int64(3), "Int64"), metric.GetVariant("n", dynamic), name)
+		require.Equal(t, chcol.NewDynamicWithType(1.5, "Float64"), metric.GetVariant("f", dynamic), name)
+		require.Equal(t, chcol.NewDynamicWithType(true, "Bool"), metric.GetVariant("b", dynamic), name)
+		require.Equal(t, chcol.NewDynamicWithType([]int64{1, 2}, "Array(Int64)"), metric.GetVariant("arr", dynamic), name)
+		obj := metric.GetVariant("obj", dynamic).(chcol.Dynamic)
+		require.Equal(t, "String", obj.Type(), name)
+		require.JSONEq(t, `{"k":"v"}`, obj.Any().(string), name)
+		require.Equal(t, nil, metric.GetVariant("missing", dynamic), name)
+
+		require.JSONEq(t, `{"obj":{"k":"v"},"extra":{"y":[1]}}`, metric.GetRest(columns, nil, regexp.MustCompile(`^null$`)).(string), name)
+		require.JSONEq(t, `{"extra":{"y":[1]}}`, metric.GetRest(columns, regexp.MustCompile(`^ext`), nil).(string), name)
+	}
+
+	pp, _ := NewParserPool("csv", []string{"j", "n", "s"}, ",", "", timeUnit, "")
+	parser, _ := pp.Get()
+	metric, err := parser.Parse([]byte(`"{""a"":1}",3,str`))
+	require.Nil(t, err)
+	require.Equal(t, `{"a":1}`, metric.GetJSON("j", false))
+	require.Equal(t, EmptyJSON, metric.GetJSON("n", false))
+	require.Equal(t, chcol.NewVariantWithType(int64(3), "Int64"), metric.GetVariant("n", variant))
+	require.Equal(t, chcol.NewVariantWithType("str", "String"), metric.GetVariant("s", variant))
+	require.Equal(t, chcol.NewDynamicWithType("str", "String"), metric.GetVariant("s", dynamic))
+}
+
+func TestValidator(t *testing.T) {
+	initialize.Do(initMetrics)
+	enum := model.WhichType("Enum8('a' = 1, 'b\\'c' = 2, 'd')")
+	require.Equal(t, map[string]int{"a": 1, "b'c": 2, "d": 3}, enum.Enum)
+	fixed := model.WhichType("LowCardinality(FixedString(3))")
+	require.Equal(t, 3, fixed.Length)
+	dec := model.WhichType("Decimal(5, 2)")
+	require.Equal(t, 5, dec.Precision)
+	require.Equal(t, 2, dec.Scale)
+	require.Equal(t, 18, model.WhichType("Nullable(Decimal64(4))").Precision)
+	uuidType := model.WhichType("UUID")
+	require.True(t, model.WhichType("Map(String, Array(Enum16('x' = -1)))").Constrained())
+	require.False(t, model.WhichType("Array(String)").Constrained())
+
+	msg := []byte(`{"e":"b'c","code":1,"bad":"z","s":"abcd","d":123.456,"big":1234.5,"u":"2f1a9a8e-4c3a-4b55-9f1e-3d2c1b0a9f8e","arr":["a","2"],"m":{"k":["a","z"]}}`)
+	pp, _ := NewParserPool("fastjson", nil, "", "", timeUnit, "")
+	parser, _ := pp.Get()
+	metric, err := parser.Parse(msg)
+	require.Nil(t, err)
+	validate := func(v *model.Validator, key string, typeinfo *model.TypeInfo) (interface{}, error) {
+		return v.Validate(model.GetValueByType(metric, &model.ColumnWithType{SourceName: key, Type: typeinfo}), typeinfo)
+	}
+	v := &model.Validator{}
+	val, err := validate(v, "e", enum)
+	require.Nil(t, err)
+	require.Equal(t, "b'c", val)
+	// numbers are taken as values of the Enum
+	val, err = validate(v, "code", enum)
+	require.Nil(t, err)
+	require.Equal(t, "a", val)
+	_, err = validate(v, "bad", enum)
+	require.NotNil(t, err)
+	val, err = validate(v, "arr", model.WhichType("Array(Enum8('a' = 1, 'b' = 2))"))
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, val)
+	_, err = validate(v, "m", model.WhichType("Map(String, Array(Enum8('a' = 1)))"))
+	require.NotNil(t, err)
+
+	_, err = validate(v, "s", fixed)
+	require.NotNil(t, err)
+	val, err = validate(&model.Validator{FixedString: model.FixedStringTruncate}, "s", fixed)
+	require.Nil(t, err)
+	require.Equal(t, "abc", val)
+
+	val, err = validate(v, "u", uuidType)
+	require.Nil(t, err)
+	require.Equal(t, "2f1a9a8e-4c3a-4b55-9f1e-3d2c1b0a9f8e", val)
+	val, err = validate(v, "missing", uuidType)
+	require.Nil(t, err)
+	require.Equal(t, model.ZeroUUID, val)
+	_, err = validate(v, "s", uuidType)
+	require.NotNil(t, err)
+	val, err = validate(v, "missing", model.WhichType("Nullable(UUID)"))
+	require.Nil(t, err)
+	require.Nil(t, val)
+
+	for rounding, want := range map[string]string{model.RoundTruncate: "123.45", model.RoundHalfUp: "123.46", model.RoundHalfEven: "123.46"} {
+		val, err = validate(&model.Validator{DecimalRounding: rounding}, "d", dec)
+		require.Nil(t, err, rounding)
+		require.Equal(t, want, val.(decimal.Decimal).String(), rounding)
+	}
+	_, err = validate(&model.Validator{DecimalRounding: model.RoundReject}, "d", dec)
+	require.NotNil(t, err)
+	// 3 integral digits at most
+	_, err = validate(v, "big", dec)
+	require.NotNil(t, err)
+}
+
+func TestGrokParser(t *testing.T) {
+	initialize.Do(initMetrics)
+	pp, _ := NewParserPool("grok", nil, "", "", timeUnit, `{"src":"nginx"}`)
+	require.Nil(t, pp.LoadGrok("%{COMBINEDAPACHELOG}", nil))
+	parser, err := pp.Get()
+	require.Nil(t, err)
+	line := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"` + "\n"
+	metric, err := parser.Parse([]byte(line))
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1", metric.GetString("clientip", false))
+	require.Equal(t, "frank", metric.GetString("auth", false))
+	require.Equal(t, "GET", metric.GetString("verb", false))
+	require.Equal(t, "/apache_pb.gif", metric.GetString("request", false))
+	require.Equal(t, int32(200), metric.GetInt32("response", false))
+	require.Equal(t, int64(2326), metric.GetInt64("bytes", false))
+	require.Equal(t, `"Mozilla/4.08"`, metric.GetString("agent", false))
+	require.Equal(t, time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC), metric.GetDateTime("timestamp", false))
+	require.Equal(t, "nginx", metric.GetString("src", false))
+	_, err = parser.Parse([]byte("not an access log"))
+	require.NotNil(t, err)
+
+	// custom patterns, named groups and float conversion
+	pp, _ = NewParserPool("grok", nil, "", "", timeUnit, "")
+	require.Nil(t, pp.LoadGrok(`%{LOGLEVEL:level} %{REQID:req.id} took=%{NUMBER:took:float}ms (?P<msg>.*)`, map[string]string{"REQID": `[0-9a-f]{8}`}))
+	parser, _ = pp.Get()
+	metric, err = parser.Parse([]byte("WARN 0badcafe took=1.5ms slow query"))
+	require.Nil(t, err)
+	require.Equal(t, "WARN", metric.GetString("level", false))
+	require.Equal(t, "0badcafe", metric.GetString("req.id", false))
+	require.Equal(t, 1.5, metric.GetFloat64("took", false))
+	require.Equal(t, "slow query", metric.GetString("msg", false))
+
+	require.NotNil(t, pp.LoadGrok("%{NOT_EXIST:x}", nil))
+	require.NotNil(t, pp.LoadGrok("%{A}", map[string]string{"A": "%{B}", "B": "%{A}"}))
+}
+
+func TestLogfmtParser(t *testing.T) {
+	initialize.Do(initMetrics)
+	pp, _ := NewParserPool("logfmt", nil, "", "", timeUnit, `{"env":"prod"}`)
+	parser, err := pp.Get()
+	require.Nil(t, err)
+	metric, err := parser.Parse([]byte(`level=info msg="hello \"world\"" status=200 debug  ts=2000-10-10T13:55:36Z`))
+	require.Nil(t, err)
+	require.Equal(t, "info", metric.GetString("level", false))
+	require.Equal(t, `hello "world"`, metric.GetString("msg", false))
+	require.Equal(t, int64(200), metric.GetInt64("status", false))
+	require.Equal(t, "", metric.GetString("debug", false))
+	require.Equal(t, time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC), metric.GetDateTime("ts", false))
+	require.Equal(t, "prod", metric.GetString("env", false))
+
+	for _, msg := range []string{`msg="unterminated`, `=value`} {
+		_, err = parser.Parse([]byte(msg))
+		require.NotNil(t, err, msg)
+	}
+}
+
+func TestSyslogParser(t *testing.T) {
+	initialize.Do(initMetrics)
+	pp, _ := NewParserPool("syslog", nil, "", "", timeUnit, "")
+	parser, err := pp.Get()
+	require.Nil(t, err)
+
+	// RFC5424
+	msg := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App\]lication"][origin ip="192.0.2.1"] ` + "\xef\xbb\xbf" + `An application event`
+	metric, err := parser.Parse([]byte(msg))
+	require.Nil(t, err)
+	require.Equal(t, int64(165), metric.GetInt64("priority", false))
+	require.Equal(t, int64(20), metric.GetInt64("facility", false))
+	require.Equal(t, int64(5), metric.GetInt64("severity", false))
+	require.Equal(t, int64(1), metric.GetInt64("version", false))
+	require.Equal(t, time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC), metric.GetDateTime("timestamp", false))
+	require.Equal(t, "mymachine.example.com", metric.GetString("hostname", false))
+	require.Equal(t, "evntslog", metric.GetString("appname", false))
+	require.Equal(t, nil, metric.GetString("procid", true))
+	require.Equal(t, "ID47", metric.GetString("msgid", false))
+	require.Equal(t, "App]lication", metric.GetString("structured_data.exampleSDID@32473.eventSource", false))
+	require.Equal(t, "192.0.2.1", metric.GetString("structured_data.origin.ip", false))
+	require.Equal(t, "An application event", metric.GetString("message", false))
+
+	metric, err = parser.Parse([]byte(`<34>1 - - su - - -`))
+	require.Nil(t, err)
+	require.Equal(t, "su", metric.GetString("appname", false))
+	require.Equal(t, nil, metric.GetString("message", true))
+
+	// RFC3164
+	metric, err = parser.Parse([]byte("<34>Oct  1 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8\n"))
+	require.Nil(t, err)
+	require.Equal(t, int64(4), metric.GetInt64("facility", false))
+	require.Equal(t, int64(2), metric.GetInt64("severity", false))
+	ts := metric.GetDateTime("timestamp", false).(time.Time)
+	require.Equal(t, time.October, ts.Month())
+	require.Equal(t, 1, ts.Day())
+	require.Equal(t, "mymachine", metric.GetString("hostname", false))
+	require.Equal(t, "su", metric.GetString("appname", false))
+	require.Equal(t, "230", metric.GetString("procid", false))
+	require.Equal(t, "'su root' failed for lonvick on /dev/pts/8", metric.GetString("message", false))
+
+	for _, msg := range []string{"no priority", "<999>1 - - - - - -", "<34>1 bad-time h a p m -", "<34>1 - h a p m [unterminated", "<34>Foo 1 22:14:15 h msg"} {
+		_, err = parser.Parse([]byte(msg))
+		require.NotNil(t, err, msg)
+	}
+}
+
 func BenchmarkUnmarshalljson(b *testing.B) {
 	object := map[string]interface{}{}
 	for i := 0; i < b.N; i++ {
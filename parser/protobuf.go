@@ -0,0 +1,233 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"encoding/binary"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var _ Parser = (*ProtobufParser)(nil)
+
+func init() {
+	Register("protobuf", func(pp *Pool) (Parser, error) {
+		if pp.protobuf == nil {
+			return nil, errors.Newf("protobuf parser requires a message type loaded with LoadProtobuf")
+		}
+		fields, err := parseFields(pp.fields)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+			return nil, err
+		}
+		return &ProtobufParser{pp: pp, fields: fields}, nil
+	}, CapDynamicSchema, Validator(func(taskCfg *config.TaskConfig) error {
+		if taskCfg.Protobuf.DescriptorSet == "" || taskCfg.Protobuf.Message == "" {
+			return errors.Newf("Parser %s requires Protobuf.DescriptorSet and Protobuf.Message", taskCfg.Parser)
+		}
+		if taskCfg.Protobuf.SchemaID != 0 && !taskCfg.Protobuf.Confluent {
+			return errors.Newf("Protobuf.SchemaID requires Protobuf.Confluent")
+		}
+		return nil
+	}), Configurer(func(pp *Pool, taskCfg *config.TaskConfig) error {
+		return pp.LoadProtobuf(taskCfg.Protobuf.DescriptorSet, taskCfg.Protobuf.Message, taskCfg.Protobuf.Confluent, taskCfg.Protobuf.SchemaID)
+	}))
+}
+
+// ProtobufParser decodes messages of the type loaded from a compiled FileDescriptorSet.
+// Nested messages are reachable with dotted keys, repeated fields are arrays, and map fields are maps.
+type ProtobufParser struct {
+	pp     *Pool
+	fields map[string]interface{}
+}
+
+// protobufDesc is the message type a Pool decodes
+type protobufDesc struct {
+	md        protoreflect.MessageDescriptor
+	confluent bool
+	schemaID  int32
+	// indexes locate md in its file, as Confluent serializers encode them
+	indexes []int64
+}
+
+// LoadProtobuf loads the message type named message from the FileDescriptorSet file (`protoc --include_imports -o`).
+// If confluent is true, messages are expected to be prefixed with the Confluent magic byte, schema ID and message indexes.
+// The message indexes shall locate the message type, and the schema ID shall be schemaID unless it's 0.
+func (pp *Pool) LoadProtobuf(descriptorSet, message string, confluent bool, schemaID int32) (err error) {
+	var bs []byte
+	if bs, err = os.ReadFile(descriptorSet); err != nil {
+		err = errors.Wrapf(err, "failed to read FileDescriptorSet %s", descriptorSet)
+		return
+	}
+	var fds descriptorpb.FileDescriptorSet
+	if err = proto.Unmarshal(bs, &fds); err != nil {
+		err = errors.Wrapf(err, "failed to parse %s as FileDescriptorSet", descriptorSet)
+		return
+	}
+	var files *protoregistry.Files
+	if files, err = protodesc.NewFiles(&fds); err != nil {
+		err = errors.Wrapf(err, "failed to resolve the files of FileDescriptorSet %s", descriptorSet)
+		return
+	}
+	var desc protoreflect.Descriptor
+	if desc, err = files.FindDescriptorByName(protoreflect.FullName(message)); err != nil {
+		err = errors.Wrapf(err, "message %s", message)
+		return
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		err = errors.Newf("%s isn't a message", message)
+		return
+	}
+	pp.protobuf = &protobufDesc{md: md, confluent: confluent, schemaID: schemaID, indexes: messageIndexes(md)}
+	return
+}
+
+// messageIndexes returns the indexes of md and the messages enclosing it, from the outermost one
+func messageIndexes(md protoreflect.MessageDescriptor) (indexes []int64) {
+	for d := protoreflect.Descriptor(md); ; d = d.Parent() {
+		if _, ok := d.(protoreflect.MessageDescriptor); !ok {
+			break
+		}
+		indexes = append([]int64{int64(d.Index())}, indexes...)
+	}
+	return
+}
+
+func (p *ProtobufParser) Parse(bs []byte) (metric model.Metric, err error) {
+	desc := p.pp.protobuf
+	if desc.confluent {
+		var id int32
+		if id, bs, err = splitConfluent(bs); err != nil {
+			return
+		}
+		if desc.schemaID != 0 && id != desc.schemaID {
+			err = errors.Newf("schema ID %d of the message doesn't match %d of %s", id, desc.schemaID, desc.md.FullName())
+			return
+		}
+		var indexes []int64
+		if indexes, bs, err = readMessageIndexes(bs); err != nil {
+			return
+		}
+		if !slices.Equal(indexes, desc.indexes) {
+			err = errors.Newf("message indexes %v of the message don't locate %s at %v", indexes, desc.md.FullName(), desc.indexes)
+			return
+		}
+	}
+	msg := dynamicpb.NewMessage(desc.md)
+	if err = proto.Unmarshal(bs, msg); err != nil {
+		err = errors.Wrapf(err, "failed to parse protobuf message %s", desc.md.FullName())
+		return
+	}
+	metric = newNativeMetric(p.pp, protoMessageToMap(msg), p.fields)
+	return
+}
+
+// readMessageIndexes reads the zigzag varint array which locates the message type in the schema of a Confluent framed protobuf message.
+// An empty array stands for the first message, i.e. [0].
+func readMessageIndexes(bs []byte) (indexes []int64, payload []byte, err error) {
+	cnt, n := binary.Varint(bs)
+	if n <= 0 || cnt < 0 || cnt > int64(len(bs)) {
+		err = errors.Newf("invalid message indexes of Confluent framed protobuf")
+		return
+	}
+	bs = bs[n:]
+	if cnt == 0 {
+		return []int64{0}, bs, nil
+	}
+	indexes = make([]int64, 0, cnt)
+	for i := int64(0); i < cnt; i++ {
+		var index int64
+		if index, n = binary.Varint(bs); n <= 0 {
+			err = errors.Newf("invalid message indexes of Confluent framed protobuf")
+			return
+		}
+		indexes = append(indexes, index)
+		bs = bs[n:]
+	}
+	return indexes, bs, nil
+}
+
+func protoMessageToMap(msg protoreflect.Message) map[string]interface{} {
+	fds := msg.Descriptor().Fields()
+	m := make(map[string]interface{}, fds.Len())
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		// fields with presence are absent unless set, the others have default values
+		if fd.HasPresence() && !msg.Has(fd) {
+			continue
+		}
+		m[string(fd.Name())] = protoFieldToNative(fd, msg.Get(fd))
+	}
+	return m
+}
+
+func protoFieldToNative(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsList():
+		list := v.List()
+		arr := make([]interface{}, 0, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			arr = append(arr, protoValueToNative(fd, list.Get(i)))
+		}
+		return arr
+	case fd.IsMap():
+		m := make(map[string]interface{}, v.Map().Len())
+		v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+			m[k.String()] = protoValueToNative(fd.MapValue(), mv)
+			return true
+		})
+		return m
+	default:
+		return protoValueToNative(fd, v)
+	}
+}
+
+func protoValueToNative(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int32(v.Enum())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		msg := v.Message()
+		switch msg.Descriptor().FullName() {
+		case "google.protobuf.Timestamp":
+			fds := msg.Descriptor().Fields()
+			return time.Unix(msg.Get(fds.ByName("seconds")).Int(), msg.Get(fds.ByName("nanos")).Int()).UTC()
+		case "google.protobuf.DoubleValue", "google.protobuf.FloatValue", "google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+			"google.protobuf.Int32Value", "google.protobuf.UInt32Value", "google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+			inner := msg.Descriptor().Fields().ByName("value")
+			return protoValueToNative(inner, msg.Get(inner))
+		}
+		return protoMessageToMap(msg)
+	default:
+		// bool, int32, int64, uint32, uint64, float32, float64, string and []byte
+		return v.Interface()
+	}
+}
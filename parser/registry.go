@@ -0,0 +1,149 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// confluentMagic is the first byte of a message framed by Confluent serializers
+	confluentMagic byte = 0
+	// confluentHeaderLen is the length of the magic byte and the big-endian schema ID
+	confluentHeaderLen = 5
+	registryTimeout    = 10 * time.Second
+)
+
+// registryRetryInterval is how long a schema missing in the registry or failing to compile is cached
+var registryRetryInterval = 10 * time.Second
+
+// ErrRegistryUnavailable is wrapped by errors of the schema registry which may succeed later, e.g. network errors and 5xx responses.
+// Messages failing with it aren't bad, they shall be parsed again.
+var ErrRegistryUnavailable = errors.Newf("schema registry unavailable")
+
+// SchemaRegistry fetches schemas by ID from a Confluent Schema Registry, and caches whatever is compiled from them.
+type SchemaRegistry struct {
+	url    string
+	client *http.Client
+	group  singleflight.Group
+	mux    sync.Mutex
+	cache  map[int32]interface{}
+	failed map[int32]registryFailure
+}
+
+type registryFailure struct {
+	err error
+	at  time.Time
+}
+
+// NewSchemaRegistry creates a client of the registry at url. Credentials may be embedded in url as user:password@host.
+func NewSchemaRegistry(url string) *SchemaRegistry {
+	return &SchemaRegistry{
+		url:    strings.TrimRight(url, "/"),
+		client: &http.Client{Timeout: registryTimeout},
+		cache:  make(map[int32]interface{}),
+		failed: make(map[int32]registryFailure),
+	}
+}
+
+// splitConfluent splits a Confluent framed message into the schema ID and the payload
+func splitConfluent(bs []byte) (id int32, payload []byte, err error) {
+	if len(bs) < confluentHeaderLen || bs[0] != confluentMagic {
+		err = errors.Newf("message isn't framed with the Confluent magic byte and schema ID")
+		return
+	}
+	id = int32(binary.BigEndian.Uint32(bs[1:confluentHeaderLen]))
+	payload = bs[confluentHeaderLen:]
+	return
+}
+
+// Get returns the cached value for schema id. On a miss, it fetches the schema text and caches the result of compile.
+// Concurrent misses of the same id share one fetch. A schema missing in the registry or failing to compile is returned
+// as a failure for registryRetryInterval before fetching again, while other failures wrap ErrRegistryUnavailable and aren't cached.
+func (sr *SchemaRegistry) Get(id int32, compile func(schema string) (interface{}, error)) (v interface{}, err error) {
+	sr.mux.Lock()
+	if cached, ok := sr.cache[id]; ok {
+		sr.mux.Unlock()
+		return cached, nil
+	}
+	if f, ok := sr.failed[id]; ok && time.Since(f.at) < registryRetryInterval {
+		sr.mux.Unlock()
+		return nil, f.err
+	}
+	sr.mux.Unlock()
+	v, err, _ = sr.group.Do(strconv.Itoa(int(id)), func() (v interface{}, err error) {
+		var schema string
+		if schema, err = sr.fetch(id); err == nil {
+			if v, err = compile(schema); err != nil {
+				err = errors.Wrapf(err, "schema %d", id)
+			}
+		}
+		sr.mux.Lock()
+		defer sr.mux.Unlock()
+		if errors.Is(err, ErrRegistryUnavailable) {
+			return
+		} else if err != nil {
+			sr.failed[id] = registryFailure{err: err, at: time.Now()}
+			return
+		}
+		sr.cache[id] = v
+		delete(sr.failed, id)
+		return
+	})
+	return
+}
+
+func (sr *SchemaRegistry) fetch(id int32) (schema string, err error) {
+	var resp *http.Response
+	if resp, err = sr.client.Get(fmt.Sprintf("%s/schemas/ids/%d", sr.url, id)); err != nil {
+		err = errors.Wrapf(ErrRegistryUnavailable, "failed to fetch schema %d: %v", id, err)
+		return
+	}
+	defer resp.Body.Close()
+	var body []byte
+	if body, err = io.ReadAll(resp.Body); err != nil {
+		err = errors.Wrapf(ErrRegistryUnavailable, "failed to read schema %d: %v", id, err)
+		return
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		err = errors.Newf("schema registry returned %s for schema %d: %s", resp.Status, id, string(body))
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Wrapf(ErrRegistryUnavailable, "schema registry returned %s for schema %d: %s", resp.Status, id, string(body))
+		return
+	}
+	var res struct {
+		Schema string `json:"schema"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		err = errors.Wrapf(ErrRegistryUnavailable, "failed to decode schema %d: %v", id, err)
+		return
+	}
+	schema = res.Schema
+	return
+}
@@ -0,0 +1,214 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+var _ Parser = (*SyslogParser)(nil)
+
+const syslogNil = "-"
+
+func init() {
+	Register("syslog", func(pp *Pool) (Parser, error) {
+		fields, err := parseFields(pp.fields)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse fields as a valid json object")
+			return nil, err
+		}
+		return &SyslogParser{pp: pp, fields: fields}, nil
+	}, CapDynamicSchema)
+}
+
+// SyslogParser parses RFC5424 and RFC3164 (BSD) syslog messages into the fields
+// priority, facility, severity, version, timestamp, hostname, appname, procid, msgid, structured_data and message.
+// Fields absent in the message, or given as the nil value "-", are omitted.
+// structured_data is a map of SD-ID to its params, e.g. "structured_data.origin.ip" refers to a param.
+// RFC3164 timestamps carry no year and zone, they're interpreted in the task's timezone of the current year.
+type SyslogParser struct {
+	pp     *Pool
+	fields map[string]interface{}
+}
+
+func (p *SyslogParser) Parse(bs []byte) (metric model.Metric, err error) {
+	line := strings.TrimRight(string(bs), "\r\n")
+	values := make(map[string]interface{})
+	if !strings.HasPrefix(line, "<") {
+		err = errors.Newf("syslog: missing priority")
+		return
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		err = errors.Newf("syslog: invalid priority")
+		return
+	}
+	var pri int
+	if pri, err = strconv.Atoi(line[1:end]); err != nil || pri > 191 {
+		err = errors.Newf("syslog: invalid priority %q", line[1:end])
+		return
+	}
+	values["priority"] = int64(pri)
+	values["facility"] = int64(pri / 8)
+	values["severity"] = int64(pri % 8)
+	line = line[end+1:]
+	if len(line) >= 2 && line[0] >= '1' && line[0] <= '9' && line[1] == ' ' {
+		err = p.parse5424(line, values)
+	} else {
+		err = p.parse3164(line, values)
+	}
+	if err != nil {
+		return
+	}
+	metric = newNativeMetric(p.pp, values, p.fields)
+	return
+}
+
+// nextToken splits line at the first space
+func nextToken(line string) (tok, rest string) {
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return line, ""
+}
+
+func (p *SyslogParser) parse5424(line string, values map[string]interface{}) (err error) {
+	var tok string
+	tok, line = nextToken(line)
+	values["version"] = int64(tok[0] - '0')
+	if tok, line = nextToken(line); tok != syslogNil {
+		var ts time.Time
+		if ts, err = time.Parse(time.RFC3339Nano, tok); err != nil {
+			return errors.Wrapf(err, "syslog: invalid timestamp %q", tok)
+		}
+		values["timestamp"] = ts.UTC()
+	}
+	for _, key := range []string{"hostname", "appname", "procid", "msgid"} {
+		if tok, line = nextToken(line); tok == "" {
+			return errors.Newf("syslog: missing %s", key)
+		} else if tok != syslogNil {
+			values[key] = tok
+		}
+	}
+	if strings.HasPrefix(line, syslogNil) {
+		line = strings.TrimPrefix(line[1:], " ")
+	} else if strings.HasPrefix(line, "[") {
+		var sd map[string]interface{}
+		if sd, line, err = parseStructuredData(line); err != nil {
+			return
+		}
+		values["structured_data"] = sd
+		line = strings.TrimPrefix(line, " ")
+	} else {
+		return errors.Newf("syslog: invalid structured data")
+	}
+	if line = strings.TrimPrefix(line, "\xef\xbb\xbf"); line != "" {
+		values["message"] = line
+	}
+	return
+}
+
+// parseStructuredData parses elements such as `[id k="v"][id2 k2="v2"]`
+func parseStructuredData(line string) (sd map[string]interface{}, rest string, err error) {
+	sd = make(map[string]interface{})
+	for strings.HasPrefix(line, "[") {
+		line = line[1:]
+		i := strings.IndexAny(line, " ]")
+		if i <= 0 {
+			err = errors.Newf("syslog: invalid SD-ID")
+			return
+		}
+		id := line[:i]
+		params := make(map[string]interface{})
+		line = line[i:]
+		for strings.HasPrefix(line, " ") {
+			line = line[1:]
+			j := strings.Index(line, `="`)
+			if j <= 0 {
+				err = errors.Newf("syslog: invalid SD-PARAM of %s", id)
+				return
+			}
+			name := line[:j]
+			line = line[j+2:]
+			var val strings.Builder
+			k := 0
+			for ; k < len(line) && line[k] != '"'; k++ {
+				// only '"', '\' and ']' are escaped, a backslash before other chars is kept
+				if line[k] == '\\' && k+1 < len(line) && strings.IndexByte(`"\]`, line[k+1]) >= 0 {
+					k++
+				}
+				val.WriteByte(line[k])
+			}
+			if k >= len(line) {
+				err = errors.Newf("syslog: unterminated SD-PARAM of %s", id)
+				return
+			}
+			params[name] = val.String()
+			line = line[k+1:]
+		}
+		if !strings.HasPrefix(line, "]") {
+			err = errors.Newf("syslog: unterminated SD-ELEMENT %s", id)
+			return
+		}
+		sd[id] = params
+		line = line[1:]
+	}
+	rest = line
+	return
+}
+
+func (p *SyslogParser) parse3164(line string, values map[string]interface{}) (err error) {
+	// Mmm dd hh:mm:ss, the day is padded with a space
+	if len(line) < len(time.Stamp) {
+		return errors.Newf("syslog: missing timestamp")
+	}
+	var ts time.Time
+	if ts, err = time.ParseInLocation(time.Stamp, line[:len(time.Stamp)], p.pp.timeZone); err != nil {
+		return errors.Wrapf(err, "syslog: invalid timestamp %q", line[:len(time.Stamp)])
+	}
+	now := time.Now().In(p.pp.timeZone)
+	ts = ts.AddDate(now.Year(), 0, 0)
+	if ts.After(now.AddDate(0, 1, 0)) {
+		// a message of December received in January
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	values["timestamp"] = ts.UTC()
+	line = strings.TrimPrefix(line[len(time.Stamp):], " ")
+
+	var host string
+	if host, line = nextToken(line); host != "" {
+		values["hostname"] = host
+	}
+	// TAG[PID]: MSG, the tag is optional
+	if i := strings.Index(line, ": "); i > 0 && !strings.ContainsAny(line[:i], " \t") {
+		tag := line[:i]
+		if j := strings.IndexByte(tag, '['); j > 0 && strings.HasSuffix(tag, "]") {
+			values["procid"] = tag[j+1 : len(tag)-1]
+			tag = tag[:j]
+		}
+		values["appname"] = tag
+		line = line[i+2:]
+	}
+	if line != "" {
+		values["message"] = line
+	}
+	return
+}
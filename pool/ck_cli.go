@@ -71,9 +71,23 @@ type Conn struct {
 	c           driver.Conn
 	db          *sql.DB
 	ctx         context.Context
+	settings    clickhouse.Settings // settings carried by ctx
 	poolManager *SQLPoolManager
 }
 
+// insertCtx returns the context for an INSERT, which carries insert_deduplication_token if dedupToken isn't empty
+func (c *Conn) insertCtx(dedupToken string) context.Context {
+	if dedupToken == "" {
+		return c.ctx
+	}
+	settings := clickhouse.Settings{}
+	for k, v := range c.settings {
+		settings[k] = v
+	}
+	settings["insert_deduplication_token"] = dedupToken
+	return clickhouse.Context(c.ctx, clickhouse.WithSettings(settings))
+}
+
 func (c *Conn) Query(query string, args ...any) (*Rows, error) {
 	var rs Rows
 	rs.protocol = c.protocol
@@ -123,8 +137,9 @@ func (c *Conn) Ping() error {
 	}
 }
 
-func (c *Conn) write_v1_isolated(prepareSQL string, rows model.Rows, idxBegin, idxEnd int) (numBad int, err error) {
+func (c *Conn) write_v1_isolated(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, dedupToken string) (numBad int, err error) {
 	var errExec error
+	ctx := c.insertCtx(dedupToken)
 
 	dedicatedDB, err := c.poolManager.Get(prepareSQL)
 	if err != nil {
@@ -133,13 +148,13 @@ func (c *Conn) write_v1_isolated(prepareSQL string, rows model.Rows, idxBegin, i
 
 	var stmt *sql.Stmt
 	var tx *sql.Tx
-	tx, err = dedicatedDB.Begin()
+	tx, err = dedicatedDB.BeginTx(ctx, nil)
 	if err != nil {
 		err = errors.Wrapf(err, "pool.Conn.Begin")
 		return
 	}
 
-	if stmt, err = tx.Prepare(prepareSQL); err != nil {
+	if stmt, err = tx.PrepareContext(ctx, prepareSQL); err != nil {
 		err = errors.Wrapf(err, "tx.Prepare %s", prepareSQL)
 		return
 	}
@@ -161,7 +176,7 @@ func (c *Conn) write_v1_isolated(prepareSQL string, rows model.Rows, idxBegin, i
 		numBad = int(bmBad.GetCardinality())
 		util.Logger.Warn(fmt.Sprintf("writeRows skipped %d rows of %d due to invalid content", numBad, len(rows)), zap.Error(errExec))
 		// write rows again, skip bad ones
-		if stmt, err = tx.Prepare(prepareSQL); err != nil {
+		if stmt, err = tx.PrepareContext(ctx, prepareSQL); err != nil {
 			err = errors.Wrapf(err, "tx.Prepare %s", prepareSQL)
 			return
 		}
@@ -187,10 +202,11 @@ func (c *Conn) write_v1_isolated(prepareSQL string, rows model.Rows, idxBegin, i
 	return
 }
 
-func (c *Conn) write_v2(prepareSQL string, rows model.Rows, idxBegin, idxEnd int) (numBad int, err error) {
+func (c *Conn) write_v2(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, dedupToken string) (numBad int, err error) {
 	var errExec error
 	var batch driver.Batch
-	if batch, err = c.c.PrepareBatch(c.ctx, prepareSQL); err != nil {
+	ctx := c.insertCtx(dedupToken)
+	if batch, err = c.c.PrepareBatch(ctx, prepareSQL); err != nil {
 		err = errors.Wrapf(err, "pool.Conn.PrepareBatch %s", prepareSQL)
 		return
 	}
@@ -209,7 +225,7 @@ func (c *Conn) write_v2(prepareSQL string, rows model.Rows, idxBegin, idxEnd int
 		numBad = int(bmBad.GetCardinality())
 		util.Logger.Warn(fmt.Sprintf("writeRows skipped %d rows of %d due to invalid content", numBad, len(rows)), zap.Error(errExec))
 		// write rows again, skip bad ones
-		if batch, err = c.c.PrepareBatch(c.ctx, prepareSQL); err != nil {
+		if batch, err = c.c.PrepareBatch(ctx, prepareSQL); err != nil {
 			err = errors.Wrapf(err, "pool.Conn.PrepareBatch %s", prepareSQL)
 			return
 		}
@@ -235,12 +251,13 @@ func (c *Conn) write_v2(prepareSQL string, rows model.Rows, idxBegin, idxEnd int
 	return
 }
 
-func (c *Conn) Write(prepareSQL string, rows model.Rows, idxBegin, idxEnd int) (numBad int, err error) {
+// Write inserts rows[idxBegin:idxEnd], ClickHouse discards the insert if dedupToken isn't empty and has been seen recently
+func (c *Conn) Write(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, dedupToken string) (numBad int, err error) {
 	util.Logger.Debug("start write to ck", zap.Int("begin", idxBegin), zap.Int("end", idxEnd))
 	if c.protocol == clickhouse.HTTP {
-		numBad, err = c.write_v1_isolated(prepareSQL, rows, idxBegin, idxEnd)
+		numBad, err = c.write_v1_isolated(prepareSQL, rows, idxBegin, idxEnd, dedupToken)
 	} else {
-		numBad, err = c.write_v2(prepareSQL, rows, idxBegin, idxEnd)
+		numBad, err = c.write_v2(prepareSQL, rows, idxBegin, idxEnd, dedupToken)
 	}
 	util.Logger.Debug("loop write completed", zap.Int("numbad", numBad))
 	return numBad, err
@@ -101,6 +101,7 @@ func (sc *ShardConn) NextGoodReplica(ctx context.Context, failedVer int) (db *Co
 	conn := Conn{
 		protocol: sc.protocol,
 		ctx:      ctx,
+		settings: sc.chCfg.QuerySettings(),
 	}
 	for i := 0; i < len(sc.replicas); i++ {
 		replica := sc.replicas[sc.nextRep]
@@ -135,6 +136,43 @@ func (sc *ShardConn) NextGoodReplica(ctx context.Context, failedVer int) (db *Co
 	return nil, sc.dbVer, err
 }
 
+// EachReplica calls fn with a connection to each replica of the shard in turn, the connection is closed once fn returns.
+// It's for reading what's only visible on some replicas, e.g. the tables which are not replicated.
+// A replica which can't be connected or fails fn doesn't stop the others, the errors of such replicas are returned.
+func (sc *ShardConn) EachReplica(ctx context.Context, fn func(replica string, conn *Conn) error) (errs []error) {
+	sc.lock.Lock()
+	baseOpts := sc.opts
+	replicas := sc.replicas
+	sc.lock.Unlock()
+	for _, replica := range replicas {
+		opts := baseOpts
+		opts.Addr = []string{replica}
+		conn := &Conn{
+			protocol: sc.protocol,
+			ctx:      ctx,
+			settings: sc.chCfg.QuerySettings(),
+		}
+		if sc.protocol == clickhouse.HTTP {
+			conn.db = clickhouse.OpenDB(&opts)
+		} else {
+			opts.Compression = &clickhouse.Compression{
+				Method: clickhouse.CompressionLZ4,
+			}
+			var err error
+			if conn.c, err = clickhouse.Open(&opts); err != nil {
+				errs = append(errs, errors.Wrapf(err, "failed to connect to replica %s", replica))
+				continue
+			}
+		}
+		err := fn(replica, conn)
+		conn.Close()
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "replica %s", replica))
+		}
+	}
+	return
+}
+
 // Each shard has a pool.Conn which connects to one replica inside the shard.
 // We need more control than replica single-point-failure.
 func InitClusterConn(chCfg *config.ClickHouseConfig) (err error) {
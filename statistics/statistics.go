@@ -47,6 +47,13 @@ var (
 		},
 		[]string{"task"},
 	)
+	InvalidValuesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "invalid_values_total",
+			Help: "total num of values violating constraints of column types, the rows are handled as bad rows",
+		},
+		[]string{"task", "column"},
+	)
 	FlushMsgsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: prefix + "flush_msgs_total",
@@ -61,6 +68,48 @@ var (
 		},
 		[]string{"task"},
 	)
+	DeadLetterMsgsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "dead_letter_msgs_total",
+			Help: "total num of msgs produced to the dead letter topic",
+		},
+		[]string{"task", "stage"},
+	)
+	DeadLetterErrorTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "dead_letter_error_total",
+			Help: "total num of msgs failed to produce to the dead letter topic",
+		},
+		[]string{"task"},
+	)
+	WriteFailureRowsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "write_failure_rows_total",
+			Help: "total num of rows failed to write to clickhouse, by write failure policy",
+		},
+		[]string{"task", "policy"},
+	)
+	SkipWrittenMsgsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "skip_written_msgs_total",
+			Help: "total num of replayed msgs skipped since they had been written to clickhouse",
+		},
+		[]string{"task"},
+	)
+	BackpressureBlockedSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "backpressure_blocked_seconds_total",
+			Help: "total seconds the consumer blocked on fetching since the record pool is full",
+		},
+		[]string{"consumer_group"},
+	)
+	TaskCompleted = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "task_completed",
+			Help: "whether all assigned partitions of the task reached StopAt",
+		},
+		[]string{"task"},
+	)
 	ConsumeOffsets = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: prefix + "consume_offsets",
@@ -138,8 +187,15 @@ var (
 func init() {
 	prometheus.MustRegister(ConsumeMsgsTotal)
 	prometheus.MustRegister(ParseMsgsErrorTotal)
+	prometheus.MustRegister(InvalidValuesTotal)
 	prometheus.MustRegister(FlushMsgsTotal)
 	prometheus.MustRegister(FlushMsgsErrorTotal)
+	prometheus.MustRegister(DeadLetterMsgsTotal)
+	prometheus.MustRegister(DeadLetterErrorTotal)
+	prometheus.MustRegister(WriteFailureRowsTotal)
+	prometheus.MustRegister(SkipWrittenMsgsTotal)
+	prometheus.MustRegister(TaskCompleted)
+	prometheus.MustRegister(BackpressureBlockedSeconds)
 	prometheus.MustRegister(ConsumeOffsets)
 	prometheus.MustRegister(ConsumeLags)
 	prometheus.MustRegister(ShardMsgs)
@@ -232,8 +288,15 @@ func (p *Pusher) reconnect() {
 	p.pusher = push.New(p.pgwAddrs[nextAddr], "clickhouse_sinker").
 		Collector(ConsumeMsgsTotal).
 		Collector(ParseMsgsErrorTotal).
+		Collector(InvalidValuesTotal).
 		Collector(FlushMsgsTotal).
 		Collector(FlushMsgsErrorTotal).
+		Collector(DeadLetterMsgsTotal).
+		Collector(DeadLetterErrorTotal).
+		Collector(WriteFailureRowsTotal).
+		Collector(SkipWrittenMsgsTotal).
+		Collector(TaskCompleted).
+		Collector(BackpressureBlockedSeconds).
 		Collector(ConsumeOffsets).
 		Collector(ConsumeLags).
 		Collector(ShardMsgs).
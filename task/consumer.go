@@ -25,7 +25,9 @@ import (
 	"github.com/housepower/clickhouse_sinker/config"
 	"github.com/housepower/clickhouse_sinker/input"
 	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
 	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
 	"go.uber.org/zap"
 
 	_ "github.com/ClickHouse/clickhouse-go/v2"
@@ -40,7 +42,7 @@ type Commit struct {
 
 type Consumer struct {
 	sinker    *Sinker
-	inputer   *input.KafkaFranz
+	inputer   input.Inputer
 	tasks     sync.Map
 	grpConfig *config.GroupConfig
 	fetchesCh chan input.Fetches
@@ -49,10 +51,24 @@ type Consumer struct {
 	cancel    context.CancelFunc
 	state     atomic.Uint32
 	errCommit bool
+	// completed is set once all partitions reached StopAt, the consumer isn't started any more
+	completed atomic.Bool
 
 	numFlying  int32
 	mux        sync.Mutex
 	commitDone *sync.Cond
+	// uncommitted are the offsets whose commits failed, they're committed along with the next commit. Guarded by mux.
+	uncommitted model.RecordMap
+
+	revokeCh chan *revokeReq
+	// rewound partitions are consumed again from the given offsets, messages fetched before rewinding are dropped
+	rewound map[string]map[int32]int64
+}
+
+// revokeReq asks processFetch to flush and commit the buffered rows of partitions which are being revoked
+type revokeReq struct {
+	parts map[string][]int32
+	done  chan struct{}
 }
 
 const (
@@ -67,6 +83,8 @@ func newConsumer(s *Sinker, gCfg *config.GroupConfig) *Consumer {
 		errCommit: false,
 		grpConfig: gCfg,
 		fetchesCh: make(chan input.Fetches),
+		revokeCh:  make(chan *revokeReq),
+		rewound:   make(map[string]map[int32]int64),
 	}
 	c.state.Store(util.StateStopped)
 	c.commitDone = sync.NewCond(&c.mux)
@@ -74,20 +92,58 @@ func newConsumer(s *Sinker, gCfg *config.GroupConfig) *Consumer {
 }
 
 func (c *Consumer) addTask(tsk *Service) {
+	if v, ok := c.tasks.Load(tsk.taskCfg.Name); ok {
+		if old := v.(*Service); old.deadLetter != nil {
+			// batches of the replaced task may still be in flight and fall back to its dead letter
+			go func() {
+				if old.clickhouse != tsk.clickhouse {
+					old.clickhouse.Drain()
+				}
+				old.deadLetter.Close()
+			}()
+		}
+	}
 	c.tasks.Store(tsk.taskCfg.Name, tsk)
 }
 
+// flushDeadLetters makes sure the dead letters are persisted before the offsets get committed
+func (c *Consumer) flushDeadLetters() {
+	c.tasks.Range(func(key, value any) bool {
+		if tsk := value.(*Service); tsk.deadLetter != nil {
+			tsk.deadLetter.Flush()
+		}
+		return true
+	})
+}
+
+// closeDeadLetters releases the dead letters of tasks, it's called once the consumer has been stopped and its tasks are dropped
+func (c *Consumer) closeDeadLetters() {
+	c.tasks.Range(func(key, value any) bool {
+		if tsk := value.(*Service); tsk.deadLetter != nil {
+			tsk.deadLetter.Close()
+		}
+		return true
+	})
+}
+
 func (c *Consumer) start() {
-	if c.state.Load() == util.StateRunning {
+	if c.state.Load() == util.StateRunning || c.completed.Load() {
 		return
 	}
 	c.ctx, c.cancel = context.WithCancel(context.Background())
-	c.inputer = input.NewKafkaFranz()
+	c.inputer = input.NewInputer(c.grpConfig.Input.Type)
 	c.state.Store(util.StateRunning)
 	util.Rs.Reset()
-	if err := c.inputer.Init(c.sinker.curCfg, c.grpConfig, c.fetchesCh, c.cleanupFn); err == nil {
+	var offsetsFn input.OffsetsFn
+	if c.grpConfig.ExactlyOnce {
+		offsetsFn = c.offsetsFn
+	}
+	if err := c.inputer.Init(c.sinker.curCfg, c.grpConfig, c.fetchesCh, c.cleanupFn, offsetsFn); err == nil {
 		go c.inputer.Run()
 		go c.processFetch()
+		if completer, ok := c.inputer.(input.Completer); ok && c.grpConfig.StopAt != "" {
+			go c.finish(c.ctx, completer.Completed())
+		}
 	} else {
 		util.Logger.Fatal("failed to init consumer", zap.String("consumer", c.grpConfig.Name), zap.Error(err))
 	}
@@ -105,12 +161,82 @@ func (c *Consumer) stop() {
 	c.inputer.Stop()
 }
 
+// finish flushes and commits all buffered rows and stops the consumer once all partitions reached StopAt
+func (c *Consumer) finish(ctx context.Context, completed <-chan struct{}) {
+	select {
+	case <-completed:
+	case <-ctx.Done():
+		return
+	}
+	c.cleanupFn(nil)
+	c.completed.Store(true)
+	c.stop()
+	for name := range c.grpConfig.Configs {
+		statistics.TaskCompleted.WithLabelValues(name).Set(1)
+	}
+	util.Logger.Info("consumer completed at StopAt", zap.String("consumer", c.grpConfig.Name), zap.String("stopAt", c.grpConfig.StopAt))
+}
+
+// staysInGroup tells whether the consumer keeps its group membership on commit errors and poll timeouts instead of restarting,
+// that's when the inputer supports pausing partitions and the cooperative-sticky balancer is configured.
+func (c *Consumer) staysInGroup() bool {
+	_, ok := c.inputer.(input.Pauser)
+	return ok && c.sinker.curCfg.Kafka.Properties.PartitionAssignmentStrategy == config.AssignCooperativeSticky
+}
+
+// withUncommitted returns offsets along with the ones whose commits failed before
+func (c *Consumer) withUncommitted(offsets model.RecordMap) model.RecordMap {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.uncommitted) == 0 {
+		return offsets
+	}
+	merged := make(model.RecordMap, len(offsets)+len(c.uncommitted))
+	for _, recMap := range []model.RecordMap{c.uncommitted, offsets} {
+		for topic, parts := range recMap {
+			if merged[topic] == nil {
+				merged[topic] = make(map[int32]*model.BatchRange)
+			}
+			for partition, rng := range parts {
+				if cur, ok := merged[topic][partition]; !ok || rng.End > cur.End {
+					merged[topic][partition] = rng
+				}
+			}
+		}
+	}
+	c.uncommitted = nil
+	return merged
+}
+
+// keepUncommitted records the offset whose commit failed
+func (c *Consumer) keepUncommitted(topic string, partition int32, rng *model.BatchRange) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.uncommitted == nil {
+		c.uncommitted = make(model.RecordMap)
+	}
+	if c.uncommitted[topic] == nil {
+		c.uncommitted[topic] = make(map[int32]*model.BatchRange)
+	}
+	if cur, ok := c.uncommitted[topic][partition]; !ok || rng.End > cur.End {
+		c.uncommitted[topic][partition] = rng
+	}
+}
+
 func (c *Consumer) restart() {
 	c.stop()
 	c.start()
 }
 
-func (c *Consumer) cleanupFn() {
+func (c *Consumer) cleanupFn(revoked map[string][]int32) {
+	// flush and commit buffered rows of the revoked partitions, the others are kept consuming
+	req := &revokeReq{parts: revoked, done: make(chan struct{})}
+	select {
+	case c.revokeCh <- req:
+		<-req.done
+	case <-c.ctx.Done():
+	}
+
 	// ensure the completion of writing to ck
 	var wg sync.WaitGroup
 	c.tasks.Range(func(key, value any) bool {
@@ -130,7 +256,175 @@ func (c *Consumer) cleanupFn() {
 		util.Logger.Debug("draining flying pending commits", zap.String("consumergroup", c.grpConfig.Name), zap.Int32("pending", c.numFlying))
 		c.commitDone.Wait()
 	}
+	// the failed commits of the revoked partitions are retried before releasing them
+	uncommitted := takeRecords(c.uncommitted, revoked)
 	c.mux.Unlock()
+	for topic, parts := range uncommitted {
+		for partition, rng := range parts {
+			if err := c.inputer.CommitMessages(&model.InputMessage{Topic: topic, Partition: int(partition), Offset: rng.End}); err != nil {
+				util.Logger.Warn("failed to commit the revoked partition, its new owner consumes it again from the last committed offset",
+					zap.String("consumer", c.grpConfig.Name), zap.String("topic", topic), zap.Int32("partition", partition), zap.Error(err))
+			}
+		}
+	}
+}
+
+// offsetsFn returns the offsets from which all tasks can resume consuming without writing a message twice,
+// that's the smallest among offsets next to the ones recorded by each task.
+// Partitions unknown to some task are absent, which resume from the committed offsets.
+func (c *Consumer) offsetsFn(assigned map[string][]int32) map[string]map[int32]int64 {
+	next := make(map[string]map[int32]int64)
+	unknown := make(map[string]map[int32]bool)
+	c.tasks.Range(func(key, value any) bool {
+		tsk := value.(*Service)
+		offsets := tsk.loadOffsets()
+		for topic, parts := range assigned {
+			if !tsk.matchTopic(topic) {
+				continue
+			}
+			for _, partition := range parts {
+				off, ok := offsets[topic][partition]
+				if !ok {
+					if unknown[topic] == nil {
+						unknown[topic] = make(map[int32]bool)
+					}
+					unknown[topic][partition] = true
+					continue
+				}
+				if next[topic] == nil {
+					next[topic] = make(map[int32]int64)
+				}
+				if cur, ok := next[topic][partition]; !ok || off < cur {
+					next[topic][partition] = off
+				}
+			}
+		}
+		return true
+	})
+	for topic, parts := range unknown {
+		for partition := range parts {
+			delete(next[topic], partition)
+		}
+	}
+	return next
+}
+
+// applySchemaChange alters the tables of tasks which found new keys. Instead of leaving the consumer group,
+// partitions of the aborted fetch are paused, and consumed again from the beginning of the fetch once the schema is changed.
+func (c *Consumer) applySchemaChange(fetch []*model.InputMessage, flush func()) {
+	from := make(map[string]map[int32]int64)
+	for _, msg := range fetch {
+		if from[msg.Topic] == nil {
+			from[msg.Topic] = make(map[int32]int64)
+		}
+		if off, ok := from[msg.Topic][int32(msg.Partition)]; !ok || msg.Offset < off {
+			from[msg.Topic][int32(msg.Partition)] = msg.Offset
+		}
+	}
+	pauser := c.inputer.(input.Pauser)
+	pauser.Pause(from)
+	c.tasks.Range(func(key, value any) bool {
+		value.(*Service).sharder.Discard(from)
+		return true
+	})
+	flush()
+	c.tasks.Range(func(key, value any) bool {
+		tsk := value.(*Service)
+		if atomic.LoadInt32(&tsk.cntNewKeys) == 0 {
+			return true
+		}
+		util.Logger.Info("new key detected, the consumer pauses partitions to change schema", zap.String("consumer group", c.grpConfig.Name), zap.String("task", tsk.taskCfg.Name))
+		if err := tsk.clickhouse.ChangeSchema(&tsk.newKeys); err != nil {
+			util.Logger.Fatal("clickhouse.ChangeSchema failed", zap.String("task", tsk.taskCfg.Name), zap.Error(err))
+		}
+		cloneTask(tsk, nil)
+		return true
+	})
+	parts := make(map[string][]int32, len(from))
+	for topic, offsets := range from {
+		if c.rewound[topic] == nil {
+			c.rewound[topic] = make(map[int32]int64)
+		}
+		for partition, offset := range offsets {
+			c.rewound[topic][partition] = offset
+			parts[topic] = append(parts[topic], partition)
+		}
+	}
+	pauser.Resume(parts)
+}
+
+// dropStale drops messages of rewound partitions which were fetched before rewinding.
+// Consuming again starts from the rewound offset, and the messages fetched before are beyond it.
+func (c *Consumer) dropStale(fetch []*model.InputMessage) []*model.InputMessage {
+	if len(c.rewound) == 0 {
+		return fetch
+	}
+	msgs := fetch[:0]
+	for _, msg := range fetch {
+		if off, ok := c.rewound[msg.Topic][int32(msg.Partition)]; ok {
+			if msg.Offset > off {
+				util.Rs.Dec(1, int64(len(msg.Value)))
+				continue
+			}
+			delete(c.rewound[msg.Topic], int32(msg.Partition))
+			if len(c.rewound[msg.Topic]) == 0 {
+				delete(c.rewound, msg.Topic)
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// takeRecords moves the offset ranges of the given partitions out of recMap
+func takeRecords(recMap model.RecordMap, parts map[string][]int32) (taken model.RecordMap) {
+	taken = make(model.RecordMap)
+	for topic, partitions := range parts {
+		for _, partition := range partitions {
+			if rng, ok := recMap[topic][partition]; ok {
+				if taken[topic] == nil {
+					taken[topic] = make(map[int32]*model.BatchRange)
+				}
+				taken[topic][partition] = rng
+				delete(recMap[topic], partition)
+			}
+		}
+		if len(recMap[topic]) == 0 {
+			delete(recMap, topic)
+		}
+	}
+	return
+}
+
+// nearBudget tells whether buffered rows shall be flushed since the global or some task's memory budget is nearly reached
+func (c *Consumer) nearBudget() bool {
+	if poolBytes := c.sinker.curCfg.RecordPoolBytes; poolBytes > 0 && util.Rs.GetBytes() >= poolBytes*4/5 {
+		return true
+	}
+	var near bool
+	c.tasks.Range(func(key, value any) bool {
+		tsk := value.(*Service)
+		if tsk.budget != nil && tsk.budget.GetBytes() >= tsk.taskCfg.MemoryBudget*4/5 {
+			near = true
+		}
+		return !near
+	})
+	return near
+}
+
+// waitBudget blocks until every task has room in its memory budget. Buffered rows are flushed before blocking,
+// otherwise the budget will never be released.
+func (c *Consumer) waitBudget(flush func()) {
+	c.tasks.Range(func(key, value any) bool {
+		tsk := value.(*Service)
+		if tsk.budget == nil || tsk.budget.Allow() {
+			return true
+		}
+		flush()
+		blocked, err := tsk.budget.Wait(c.ctx)
+		statistics.BackpressureBlockedSeconds.WithLabelValues(c.grpConfig.Name).Add(blocked.Seconds())
+		return err == nil
+	})
 }
 
 func (c *Consumer) updateGroupConfig(g *config.GroupConfig) {
@@ -152,8 +446,13 @@ func (c *Consumer) processFetch() {
 	recMap := make(model.RecordMap)
 	var bufLength int64
 
-	flushFn := func(traceId, with string) {
-		if len(recMap) == 0 {
+	// flushParts flushes and commits buffered rows of the given partitions, nil parts means all
+	flushParts := func(traceId, with string, parts map[string][]int32) {
+		offsets := recMap
+		if parts != nil {
+			offsets = takeRecords(recMap, parts)
+		}
+		if len(offsets) == 0 {
 			return
 		}
 		if bufLength > 0 {
@@ -163,16 +462,27 @@ func (c *Consumer) processFetch() {
 		c.tasks.Range(func(key, value any) bool {
 			// flush to shard, ck
 			task := value.(*Service)
-			task.sharder.Flush(c.ctx, &wg, recMap[task.taskCfg.Topic], traceId)
+			rmap := make(model.RecordMap)
+			for topic, parts := range offsets {
+				if len(parts) != 0 && task.matchTopic(topic) {
+					rmap[topic] = parts
+				}
+			}
+			task.sharder.Flush(c.ctx, &wg, rmap, parts, traceId)
 			return true
 		})
-		bufLength = 0
+		if parts == nil {
+			bufLength = 0
+			recMap = make(model.RecordMap)
+		}
 
 		c.mux.Lock()
 		c.numFlying++
 		c.mux.Unlock()
-		c.sinker.commitsCh <- &Commit{group: c.grpConfig.Name, offsets: recMap, wg: &wg, consumer: c}
-		recMap = make(model.RecordMap)
+		c.sinker.commitsCh <- &Commit{group: c.grpConfig.Name, offsets: offsets, wg: &wg, consumer: c}
+	}
+	flushFn := func(traceId, with string) {
+		flushParts(traceId, with, nil)
 	}
 
 	bufThreshold := c.grpConfig.BufferSize * len(c.sinker.curCfg.Clickhouse.Hosts) * 4 / 5
@@ -188,9 +498,11 @@ func (c *Consumer) processFetch() {
 		select {
 		case fetches := <-c.fetchesCh:
 			if c.state.Load() == util.StateStopped {
+				util.Rs.Dec(int64(len(fetches.Messages)), input.MessagesBytes(fetches.Messages))
 				continue
 			}
-			fetch := fetches.Fetch.Records()
+			fetch := c.dropStale(fetches.Messages)
+			c.waitBudget(func() { flushFn(traceId, "memory budget reached") })
 			if wait {
 				util.LogTrace(fetches.TraceId,
 					util.TraceKindProcessing,
@@ -211,6 +523,8 @@ func (c *Consumer) processFetch() {
 
 			var wg sync.WaitGroup
 			var err error
+			// messages left unprocessed due to an error or stopping are released after all
+			processed := make([]bool, items)
 			wg.Add(concurrency)
 			for i := 0; i < concurrency; i++ {
 				go func() {
@@ -220,73 +534,67 @@ func (c *Consumer) processFetch() {
 							wg.Done()
 							break
 						}
+						processed[index] = true
 
-						rec := fetch[index]
-						msg := &model.InputMessage{
-							Topic:     rec.Topic,
-							Partition: int(rec.Partition),
-							Key:       rec.Key,
-							Value:     rec.Value,
-							Offset:    rec.Offset,
-							Timestamp: &rec.Timestamp,
-						}
+						msg := fetch[index]
 						tablename := ""
-						for _, it := range rec.Headers {
+						for _, it := range msg.Headers {
 							if it.Key == "__table_name" {
 								tablename = string(it.Value)
 								break
 							}
 						}
 
+						var puts int
 						c.tasks.Range(func(key, value any) bool {
 							tsk := value.(*Service)
-							if (tablename != "" && tsk.clickhouse.TableName == tablename) || tsk.taskCfg.Topic == rec.Topic {
+							if (tablename != "" && tsk.clickhouse.TableName == tablename) || tsk.matchTopic(msg.Topic) {
 								//bufLength++
 								atomic.AddInt64(&bufLength, 1)
-								if e := tsk.Put(msg, traceId, flushFn); e != nil {
+								n, e := tsk.Put(msg, puts, traceId, flushFn)
+								puts += n
+								if e != nil {
 									atomic.StoreInt64(&done, items)
 									err = e
-									// decrise the error record
-									util.Rs.Dec(1)
 									return false
 								}
 							}
 							return true
 						})
+						if puts == 0 {
+							// no row takes over the accounting of the message
+							util.Rs.Dec(1, int64(len(msg.Value)))
+						}
 					}
 				}()
 			}
 			wg.Wait()
+			for i, msg := range fetch {
+				if !processed[i] {
+					util.Rs.Dec(1, int64(len(msg.Value)))
+				}
+			}
+			if errors.Is(err, errNewKeys) {
+				c.applySchemaChange(fetch, func() { flushFn(traceId, "foundNewKeys") })
+			}
 
 			// record the latest offset in order
 			// assume the c.state was reset to stopped when facing error, so that further fetch won't get processed
 			if err == nil {
-				for _, f := range *fetches.Fetch {
-					for i := range f.Topics {
-						ft := &f.Topics[i]
-						if recMap[ft.Topic] == nil {
-							recMap[ft.Topic] = make(map[int32]*model.BatchRange)
-						}
-						for j := range ft.Partitions {
-							fpr := ft.Partitions[j].Records
-							if len(fpr) == 0 {
-								continue
-							}
-							lastOff := fpr[len(fpr)-1].Offset
-							firstOff := fpr[0].Offset
-
-							or, ok := recMap[ft.Topic][ft.Partitions[j].Partition]
-							if !ok {
-								or = &model.BatchRange{Begin: math.MaxInt64, End: -1}
-								recMap[ft.Topic][ft.Partitions[j].Partition] = or
-							}
-							if or.End < lastOff {
-								or.End = lastOff
-							}
-							if or.Begin > firstOff {
-								or.Begin = firstOff
-							}
-						}
+				for _, msg := range fetch {
+					if recMap[msg.Topic] == nil {
+						recMap[msg.Topic] = make(map[int32]*model.BatchRange)
+					}
+					or, ok := recMap[msg.Topic][int32(msg.Partition)]
+					if !ok {
+						or = &model.BatchRange{Begin: math.MaxInt64, End: -1}
+						recMap[msg.Topic][int32(msg.Partition)] = or
+					}
+					if or.End < msg.Offset {
+						or.End = msg.Offset
+					}
+					if or.Begin > msg.Offset {
+						or.Begin = msg.Offset
 					}
 				}
 			}
@@ -295,9 +603,21 @@ func (c *Consumer) processFetch() {
 				flushFn(traceId, "bufLength reached")
 				ticker.Reset(time.Duration(c.grpConfig.FlushInterval) * time.Second)
 				wait = false
+			} else if c.nearBudget() {
+				flushFn(traceId, "memory budget nearly reached")
+				ticker.Reset(time.Duration(c.grpConfig.FlushInterval) * time.Second)
+				wait = false
 			} else {
 				wait = true
 			}
+		case req := <-c.revokeCh:
+			flushParts(traceId, "partitions revoked", req.parts)
+			for topic, parts := range req.parts {
+				for _, partition := range parts {
+					delete(c.rewound[topic], partition)
+				}
+			}
+			close(req.done)
 		case <-ticker.C:
 			flushFn(traceId, "ticker.C triggered")
 		case <-c.ctx.Done():
@@ -0,0 +1,60 @@
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+func TestTakeRecords(t *testing.T) {
+	recMap := model.RecordMap{
+		"topic1": {0: {Begin: 0, End: 9}, 1: {Begin: 5, End: 7}},
+		"topic2": {0: {Begin: 3, End: 4}},
+	}
+	taken := takeRecords(recMap, map[string][]int32{"topic1": {1, 2}, "topic2": {0}})
+	require.Equal(t, model.RecordMap{
+		"topic1": {1: {Begin: 5, End: 7}},
+		"topic2": {0: {Begin: 3, End: 4}},
+	}, taken)
+	require.Equal(t, model.RecordMap{"topic1": {0: {Begin: 0, End: 9}}}, recMap)
+}
+
+func TestDropStale(t *testing.T) {
+	c := &Consumer{rewound: map[string]map[int32]int64{"topic1": {0: 5}}}
+	count, bytes := util.Rs.Get(), util.Rs.GetBytes()
+	var fetch []*model.InputMessage
+	for _, offset := range []int64{8, 9, 5, 6} {
+		fetch = append(fetch, &model.InputMessage{Topic: "topic1", Partition: 0, Offset: offset, Value: []byte("{}")})
+	}
+	fetch = append(fetch, &model.InputMessage{Topic: "topic1", Partition: 1, Offset: 20, Value: []byte("{}")})
+	util.Rs.Inc(int64(len(fetch)), 2*int64(len(fetch)))
+
+	// messages fetched before rewinding are dropped and released, until the rewound offset shows up
+	msgs := c.dropStale(fetch)
+	require.Len(t, msgs, 3)
+	require.Equal(t, []int64{5, 6, 20}, []int64{msgs[0].Offset, msgs[1].Offset, msgs[2].Offset})
+	require.Empty(t, c.rewound)
+	require.Equal(t, count+3, util.Rs.Get())
+	require.Equal(t, bytes+6, util.Rs.GetBytes())
+}
+
+func TestUncommitted(t *testing.T) {
+	c := &Consumer{}
+	offsets := model.RecordMap{"topic1": {0: {Begin: 10, End: 19}}}
+	require.Equal(t, offsets, c.withUncommitted(offsets))
+
+	// failed offsets are committed along with the next commit, unless the partition has advanced since
+	c.keepUncommitted("topic1", 0, &model.BatchRange{Begin: 0, End: 9})
+	c.keepUncommitted("topic1", 1, &model.BatchRange{Begin: 0, End: 4})
+	c.keepUncommitted("topic2", 0, &model.BatchRange{Begin: 0, End: 2})
+	c.keepUncommitted("topic2", 0, &model.BatchRange{Begin: 3, End: 5})
+	require.Equal(t, model.RecordMap{
+		"topic1": {0: {Begin: 10, End: 19}, 1: {Begin: 0, End: 4}},
+		"topic2": {0: {Begin: 3, End: 5}},
+	}, c.withUncommitted(offsets))
+	require.Empty(t, c.uncommitted)
+	require.Equal(t, model.RecordMap{"topic1": {0: {Begin: 10, End: 19}}}, offsets)
+}
@@ -3,6 +3,8 @@ package task
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -123,6 +125,15 @@ type Sharder struct {
 	shards  int
 	mux     sync.Mutex
 	msgBuf  []*model.Rows
+	rowMeta [][]rowMeta // in parallel with msgBuf
+}
+
+// rowMeta tells where a buffered row comes from, and its estimated bytes of message and row
+type rowMeta struct {
+	topic     string
+	partition int32
+	offset    int64
+	size      int64
 }
 
 func NewSharder(service *Service) (sh *Sharder, err error) {
@@ -136,6 +147,7 @@ func NewSharder(service *Service) (sh *Sharder, err error) {
 		policy:  policy,
 		shards:  shards,
 		msgBuf:  make([]*model.Rows, shards),
+		rowMeta: make([][]rowMeta, shards),
 	}
 	for i := 0; i < shards; i++ {
 		rs := make(model.Rows, 0)
@@ -149,14 +161,121 @@ func (sh *Sharder) Calc(row *model.Row, offset int64) (int, error) {
 }
 
 func (sh *Sharder) PutElement(msgRow *model.MsgRow) {
+	// the message has been accounted by util.Rs when fetched, the row is accounted from now on
+	rowSize := msgRow.Row.EstimateSize()
+	meta := rowMeta{
+		topic:     msgRow.Msg.Topic,
+		partition: int32(msgRow.Msg.Partition),
+		offset:    msgRow.Msg.Offset,
+		size:      int64(len(msgRow.Msg.Value)) + rowSize,
+	}
+	if msgRow.Seq == 0 {
+		util.Rs.Inc(0, rowSize)
+	} else {
+		// another row exploded from the same message
+		util.Rs.Inc(1, rowSize)
+		meta.size = rowSize
+	}
+	if budget := sh.service.budget; budget != nil {
+		budget.Inc(1, meta.size)
+	}
 	sh.mux.Lock()
 	defer sh.mux.Unlock()
 	rows := sh.msgBuf[msgRow.Shard]
 	*rows = append(*rows, msgRow.Row)
+	sh.rowMeta[msgRow.Shard] = append(sh.rowMeta[msgRow.Shard], meta)
 	statistics.ShardMsgs.WithLabelValues(sh.service.taskCfg.Name).Inc()
 }
 
-func (sh *Sharder) Flush(c context.Context, wg *sync.WaitGroup, rmap map[int32]*model.BatchRange, traceId string) {
+// split takes the buffered rows of shard i which match fn, the others are kept in the buffer. nil fn matches all rows.
+func (sh *Sharder) split(i int, fn func(meta *rowMeta) bool) (matched *model.Rows, size int64) {
+	rows, metas := *sh.msgBuf[i], sh.rowMeta[i]
+	if fn == nil {
+		for k := range metas {
+			size += metas[k].size
+		}
+		matched = sh.msgBuf[i]
+		rs := make(model.Rows, 0, len(rows))
+		sh.msgBuf[i] = &rs
+		sh.rowMeta[i] = nil
+		return
+	}
+	matchedRows := make(model.Rows, 0)
+	var j int
+	for k := range rows {
+		if fn(&metas[k]) {
+			matchedRows = append(matchedRows, rows[k])
+			size += metas[k].size
+		} else {
+			rows[j], metas[j] = rows[k], metas[k]
+			j++
+		}
+	}
+	if j == 0 {
+		// all rows are taken, don't keep the backing arrays
+		rs := make(model.Rows, 0, len(rows))
+		sh.msgBuf[i] = &rs
+		sh.rowMeta[i] = nil
+	} else {
+		clear(rows[j:])
+		*sh.msgBuf[i] = rows[:j]
+		sh.rowMeta[i] = metas[:j]
+	}
+	return &matchedRows, size
+}
+
+// inParts matches rows of the given partitions
+func inParts(parts map[string][]int32) func(meta *rowMeta) bool {
+	only := make(map[string]map[int32]bool, len(parts))
+	for topic, partitions := range parts {
+		only[topic] = make(map[int32]bool, len(partitions))
+		for _, partition := range partitions {
+			only[topic][partition] = true
+		}
+	}
+	return func(meta *rowMeta) bool { return only[meta.topic][meta.partition] }
+}
+
+// Discard drops the buffered rows whose offsets are not less than the given ones, since those messages will be consumed again
+func (sh *Sharder) Discard(from map[string]map[int32]int64) {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+	var msgCnt int
+	for i := range sh.msgBuf {
+		discarded, size := sh.split(i, func(meta *rowMeta) bool {
+			off, ok := from[meta.topic][meta.partition]
+			return ok && meta.offset >= off
+		})
+		if cnt := len(*discarded); cnt > 0 {
+			msgCnt += cnt
+			batch := &model.Batch{RealSize: cnt, Bytes: size, Budget: sh.service.budget}
+			batch.Release()
+		}
+	}
+	if msgCnt > 0 {
+		util.Logger.Info(fmt.Sprintf("discarded %d buffered messages of task %v which will be consumed again", msgCnt, sh.service.taskCfg.Name))
+		statistics.ShardMsgs.WithLabelValues(sh.service.taskCfg.Name).Sub(float64(msgCnt))
+	}
+}
+
+// dedupToken is deterministic for the same task, shard and offset ranges
+func dedupToken(task string, shard int, rmap model.RecordMap) string {
+	var ranges []string
+	for topic, parts := range rmap {
+		for partition, rng := range parts {
+			ranges = append(ranges, fmt.Sprintf("%s:%d:%d-%d", topic, partition, rng.Begin, rng.End))
+		}
+	}
+	sort.Strings(ranges)
+	return fmt.Sprintf("%s_%d_%016x", task, shard, xxhash.Sum64String(strings.Join(ranges, ",")))
+}
+
+// Flush sends buffered rows to ClickHouse. If parts isn't nil, only rows of the given partitions are flushed.
+func (sh *Sharder) Flush(c context.Context, wg *sync.WaitGroup, rmap model.RecordMap, parts map[string][]int32, traceId string) {
+	var fn func(meta *rowMeta) bool
+	if parts != nil {
+		fn = inParts(parts)
+	}
 	sh.mux.Lock()
 	defer sh.mux.Unlock()
 	select {
@@ -168,21 +287,30 @@ func (sh *Sharder) Flush(c context.Context, wg *sync.WaitGroup, rmap map[int32]*
 		util.Logger.Debug("flush records to ck")
 		taskCfg := sh.service.taskCfg
 		batchId, _ := nanoid.New()
-		for i, rows := range sh.msgBuf {
+		// every shard records the offsets even if it gets no rows, so that its offsets never lag behind
+		exactlyOnce := taskCfg.ExactlyOnce && len(rmap) != 0
+		for i := range sh.msgBuf {
+			rows, size := sh.split(i, fn)
 			realSize := len(*rows)
-			if realSize > 0 {
+			if realSize > 0 || exactlyOnce {
 				msgCnt += realSize
 				batch := &model.Batch{
 					Rows:     rows,
 					BatchIdx: int64(i),
 					GroupId:  batchId,
 					RealSize: realSize,
+					Bytes:    size,
+					Budget:   sh.service.budget,
 					Wg:       wg,
 				}
+				if exactlyOnce {
+					batch.Offsets = rmap
+				}
+				if len(rmap) != 0 {
+					batch.DedupToken = dedupToken(taskCfg.Name, i, rmap)
+				}
 				batch.Wg.Add(1)
 				sh.service.clickhouse.Send(batch, traceId)
-				rs := make(model.Rows, 0, realSize)
-				sh.msgBuf[i] = &rs
 			}
 		}
 		if msgCnt > 0 {
@@ -0,0 +1,64 @@
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+func newTestSharder(shards int) *Sharder {
+	sh := &Sharder{
+		service: &Service{taskCfg: &config.TaskConfig{Name: "test_sharder"}},
+		shards:  shards,
+		msgBuf:  make([]*model.Rows, shards),
+		rowMeta: make([][]rowMeta, shards),
+	}
+	for i := 0; i < shards; i++ {
+		rs := make(model.Rows, 0)
+		sh.msgBuf[i] = &rs
+	}
+	return sh
+}
+
+func TestSharderRevokedRows(t *testing.T) {
+	util.InitLogger([]string{"stdout"})
+	sh := newTestSharder(2)
+	count, bytes := util.Rs.Get(), util.Rs.GetBytes()
+	for partition := 0; partition < 2; partition++ {
+		for offset := int64(0); offset < 4; offset++ {
+			msg := &model.InputMessage{Topic: "topic1", Partition: partition, Offset: offset, Value: []byte("{}")}
+			util.Rs.Inc(1, int64(len(msg.Value)))
+			sh.PutElement(&model.MsgRow{Msg: msg, Row: &model.Row{offset}, Shard: int(offset) % 2})
+		}
+	}
+
+	// only rows of the revoked partition are taken
+	match := inParts(map[string][]int32{"topic1": {1}})
+	var taken int
+	for i := 0; i < 2; i++ {
+		kept := sh.rowMeta[i]
+		rows, size := sh.split(i, match)
+		taken += len(*rows)
+		for _, meta := range sh.rowMeta[i] {
+			require.Equal(t, int32(0), meta.partition)
+		}
+		require.Len(t, sh.rowMeta[i], len(kept)-len(*rows))
+		(&model.Batch{RealSize: len(*rows), Bytes: size}).Release()
+	}
+	require.Equal(t, 4, taken)
+
+	// the rows of partition 0 from offset 2 will be consumed again, the others are kept
+	sh.Discard(map[string]map[int32]int64{"topic1": {0: 2}})
+	require.Len(t, *sh.msgBuf[0], 1)
+	require.Len(t, *sh.msgBuf[1], 1)
+	for i := 0; i < 2; i++ {
+		rows, size := sh.split(i, nil)
+		(&model.Batch{RealSize: len(*rows), Bytes: size}).Release()
+	}
+	require.Equal(t, count, util.Rs.Get())
+	require.Equal(t, bytes, util.Rs.GetBytes())
+}
@@ -147,6 +147,7 @@ func (s *Sinker) Run() {
 						cloneTask(value.(*Service), newGroup)
 						return true
 					})
+					c.closeDeadLetters()
 					newGroup.start()
 					util.Logger.Info("consumer restarted because of previous offset commit error",
 						zap.String("consumer", c.grpConfig.Name))
@@ -169,7 +170,9 @@ func (s *Sinker) Run() {
 			case <-pollTicker.C:
 				consumerName := input.Walk(s.curCfg.Kafka.Properties.MaxPollInterval)
 				if consumerName != "" {
-					if consumer, ok := s.consumers[consumerName]; ok {
+					if consumer, ok := s.consumers[consumerName]; ok && consumer.staysInGroup() {
+						util.Logger.Warn("consumer hasn't polled within max.poll.interval.ms, it's kept in the group", zap.String("consumer", consumerName), zap.Int("max.poll.interval.ms", s.curCfg.Kafka.Properties.MaxPollInterval))
+					} else if ok {
 						util.Logger.Warn("consumer restarted because of max.poll.interval.ms changed", zap.String("consumer", consumerName), zap.Int("max.poll.interval.ms", s.curCfg.Kafka.Properties.MaxPollInterval))
 						go func() {
 							consumer.stop()
@@ -243,6 +246,7 @@ func (s *Sinker) Run() {
 						cloneTask(value.(*Service), newGroup)
 						return true
 					})
+					c.closeDeadLetters()
 					newGroup.start()
 					util.Logger.Info("consumer restarted because of previous offset commit error",
 						zap.String("consumer", c.grpConfig.Name))
@@ -265,7 +269,9 @@ func (s *Sinker) Run() {
 			case <-pollTicker.C:
 				consumerName := input.Walk(curInterval)
 				if consumerName != "" {
-					if consumer, ok := s.consumers[consumerName]; ok {
+					if consumer, ok := s.consumers[consumerName]; ok && consumer.staysInGroup() {
+						util.Logger.Warn("consumer hasn't polled within max.poll.interval.ms, it's kept in the group", zap.String("consumer", consumerName), zap.Int("max.poll.interval.ms", curInterval))
+					} else if ok {
 						util.Logger.Warn("consumer restarted because of max.poll.interval.ms changed", zap.String("consumer", consumerName), zap.Int("max.poll.interval.ms", curInterval))
 						go func() {
 							consumer.stop()
@@ -329,7 +335,8 @@ func (s *Sinker) stopAllTasks() {
 	}
 	util.Logger.Debug("stopped commit session")
 
-	for name := range s.consumers {
+	for name, c := range s.consumers {
+		c.closeDeadLetters()
 		delete(s.consumers, name)
 	}
 
@@ -341,6 +348,7 @@ func (s *Sinker) applyConfig(newCfg *config.Config) (err error) {
 	util.SetLogLevel(newCfg.LogLevel)
 	util.SetLogTrace(newCfg.LogTrace)
 	util.Rs.SetPoolSize(newCfg.RecordPoolSize)
+	util.Rs.SetPoolBytes(newCfg.RecordPoolBytes)
 	util.Rs.Reset()
 	if err := util.Gsypt.Unmarshal(&newCfg.Clickhouse); err != nil {
 		util.Logger.Error("failed to decrypt config password", zap.Error(err))
@@ -455,9 +463,17 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 				} else {
 					sort.Strings(c.grpConfig.Topics)
 					sort.Strings(group.Topics)
+					sort.Strings(c.grpConfig.TopicPatterns)
+					sort.Strings(group.TopicPatterns)
 					if !reflect.DeepEqual(c.grpConfig.Topics, group.Topics) ||
+						!reflect.DeepEqual(c.grpConfig.TopicPatterns, group.TopicPatterns) ||
 						c.grpConfig.BufferSize != group.BufferSize ||
-						c.grpConfig.MaxFetchSize != group.MaxFetchSize {
+						c.grpConfig.MaxFetchSize != group.MaxFetchSize ||
+						c.grpConfig.ExactlyOnce != group.ExactlyOnce ||
+						!reflect.DeepEqual(c.grpConfig.Input, group.Input) ||
+						c.grpConfig.StartFrom != group.StartFrom ||
+						!reflect.DeepEqual(c.grpConfig.StartOffsets, group.StartOffsets) ||
+						c.grpConfig.StopAt != group.StopAt {
 						deleteConsumers = append(deleteConsumers, name)
 					} else {
 						// apply TaskConfig Change
@@ -482,6 +498,7 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 				wg.Add(1)
 				go func(c *Consumer) {
 					c.stop()
+					c.closeDeadLetters()
 					wg.Done()
 				}(c)
 			}
@@ -524,12 +541,26 @@ func (s *Sinker) commitFn() {
 		case com := <-s.commitsCh:
 			com.wg.Wait()
 			c := com.consumer
+			c.flushDeadLetters()
 
 			if !c.errCommit {
+				staysInGroup := c.staysInGroup()
+				offsets := com.offsets
+				if staysInGroup {
+					offsets = c.withUncommitted(offsets)
+				}
 			LOOP:
-				for i, value := range com.offsets {
+				for i, value := range offsets {
 					for k, v := range value {
 						if err := c.inputer.CommitMessages(&model.InputMessage{Topic: i, Partition: int(k), Offset: v.End}); err != nil {
+							if staysInGroup {
+								// the client stays in the group and rejoins by itself, the offset is committed along with the next commit,
+								// or before the partition gets revoked
+								util.Logger.Warn("Batch.Commit failed, will retry with the next commit", zap.String("consumer", c.grpConfig.Name),
+									zap.String("topic", i), zap.Int32("partition", k), zap.Error(err))
+								c.keepUncommitted(i, k, v)
+								continue
+							}
 							c.errCommit = true
 							// restart the consumer when facing commit error, avoid change the s.consumers outside of s.Run
 							// error could be RebalanceInProgress, IllegalGeneration, UnknownMemberID
@@ -27,20 +27,29 @@ import (
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/input"
 	"github.com/housepower/clickhouse_sinker/model"
 	"github.com/housepower/clickhouse_sinker/output"
 	"github.com/housepower/clickhouse_sinker/parser"
 	"github.com/housepower/clickhouse_sinker/statistics"
 	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
 
+// errNewKeys aborts processing the fetch since some task found new keys, see Consumer.applySchemaChange
+var errNewKeys = errors.Newf("new keys found")
+
+// maxRegistryBackoff caps the interval of parsing a message again while the schema registry is unavailable
+const maxRegistryBackoff = 30 * time.Second
+
 // TaskService holds the configuration for each task
 type Service struct {
 	clickhouse *output.ClickHouse
 	pp         *parser.Pool
 	taskCfg    *config.TaskConfig
+	matchTopic func(topic string) bool
 	whiteList  *regexp.Regexp
 	blackList  *regexp.Regexp
 	lblBlkList *regexp.Regexp
@@ -58,10 +67,32 @@ type Service struct {
 	warnKeys   sync.Map
 	cntNewKeys int32 // size of newKeys
 
-	sharder  *Sharder
-	limiter  *rate.Limiter //作用：控制打日志的频率
-	offShift int64
-	consumer *Consumer
+	validator  model.Validator
+	jsonColumn *model.ColumnWithType // DynamicSchema.JSONColumn
+	columns    map[string]struct{}   // source names of columns and members they take, see Metric.GetRest
+
+	sharder    *Sharder
+	limiter    *rate.Limiter //作用：控制打日志的频率
+	offShift   int64
+	consumer   *Consumer
+	deadLetter *output.DeadLetter
+	written    *writtenOffsets
+	budget     *util.RecordSize // bytes of rows buffered or being written, nil if MemoryBudget is unlimited
+	decoders   *parser.ValueDecoders
+}
+
+// writtenOffsets holds the last offset written to each shard per topic partition, it's used by ExactlyOnce tasks
+type writtenOffsets struct {
+	sync.RWMutex
+	m map[string]map[int32][]int64
+}
+
+// covers tells whether the message has already been written to the shard
+func (wo *writtenOffsets) covers(msg *model.InputMessage, shard int) bool {
+	wo.RLock()
+	defer wo.RUnlock()
+	ends, ok := wo.m[msg.Topic][int32(msg.Partition)]
+	return ok && shard < len(ends) && msg.Offset <= ends[shard]
 }
 
 // cloneTask create a new task by stealing members from s instead of creating a new one
@@ -70,10 +101,15 @@ func cloneTask(s *Service, newGroup *Consumer) (service *Service) {
 		clickhouse: s.clickhouse,
 		pp:         s.pp,
 		taskCfg:    s.taskCfg,
+		matchTopic: s.matchTopic,
 		consumer:   s.consumer,
 		whiteList:  s.whiteList,
 		blackList:  s.blackList,
 		lblBlkList: s.lblBlkList,
+		deadLetter: s.deadLetter.Retain(),
+		written:    s.written,
+		budget:     s.budget,
+		decoders:   s.decoders,
 	}
 	if newGroup != nil {
 		service.consumer = newGroup
@@ -89,6 +125,9 @@ func cloneTask(s *Service, newGroup *Consumer) (service *Service) {
 func NewTaskService(cfg *config.Config, taskCfg *config.TaskConfig, c *Consumer) (service *Service) {
 	ck := output.NewClickHouse(cfg, taskCfg)
 	pp, err := parser.NewParserPool(taskCfg.Parser, taskCfg.CsvFormat, taskCfg.Delimiter, taskCfg.TimeZone, taskCfg.TimeUnit, taskCfg.Fields)
+	if err == nil {
+		err = pp.Configure(taskCfg)
+	}
 	if err != nil {
 		util.Logger.Fatal("failed to create task", zap.String("group", c.grpConfig.Name), zap.String("task", taskCfg.Name), zap.Error(err))
 	}
@@ -96,7 +135,15 @@ func NewTaskService(cfg *config.Config, taskCfg *config.TaskConfig, c *Consumer)
 		clickhouse: ck,
 		pp:         pp,
 		taskCfg:    taskCfg,
+		matchTopic: taskCfg.TopicMatcher(),
 		consumer:   c,
+		written:    &writtenOffsets{},
+		decoders:   &parser.ValueDecoders{},
+	}
+	if taskCfg.MemoryBudget > 0 {
+		service.budget = util.NewRecordSize()
+		service.budget.SetPoolSize(math.MaxInt64)
+		service.budget.SetPoolBytes(taskCfg.MemoryBudget)
 	}
 	if taskCfg.DynamicSchema.WhiteList != "" {
 		service.whiteList = regexp.MustCompile(taskCfg.DynamicSchema.WhiteList)
@@ -107,6 +154,12 @@ func NewTaskService(cfg *config.Config, taskCfg *config.TaskConfig, c *Consumer)
 	if taskCfg.PromLabelsBlackList != "" {
 		service.lblBlkList = regexp.MustCompile(taskCfg.PromLabelsBlackList)
 	}
+	if taskCfg.DeadLetter.Topic != "" || taskCfg.DeadLetter.SpoolDir != "" {
+		if service.deadLetter, err = output.NewDeadLetter(cfg, taskCfg); err != nil {
+			util.Logger.Fatal("failed to create dead letter producer", zap.String("group", c.grpConfig.Name), zap.String("task", taskCfg.Name), zap.Error(err))
+		}
+		ck.SetDeadLetter(service.deadLetter)
+	}
 	return
 }
 
@@ -123,6 +176,7 @@ func (service *Service) Init() (err error) {
 	service.idxSerID = service.clickhouse.IdxSerID
 	service.nameKey = service.clickhouse.NameKey
 	service.limiter = rate.NewLimiter(rate.Every(10*time.Second), 1)
+	service.validator = model.Validator{FixedString: taskCfg.FixedStringOverflow, DecimalRounding: taskCfg.DecimalRounding}
 	//service.offShift = int64(util.GetShift(taskCfg.BufferSize))
 	service.offShift = int64(taskCfg.BufferSize)
 
@@ -138,7 +192,11 @@ func (service *Service) Init() (err error) {
 		return
 	}
 
-	if taskCfg.DynamicSchema.Enable {
+	if taskCfg.DynamicSchema.Enable && taskCfg.DynamicSchema.JSONColumn != "" {
+		if err = service.initJSONColumn(); err != nil {
+			return
+		}
+	} else if taskCfg.DynamicSchema.Enable {
 		maxDims := math.MaxInt16
 		if taskCfg.DynamicSchema.MaxDims > 0 {
 			maxDims = taskCfg.DynamicSchema.MaxDims
@@ -163,32 +221,193 @@ func (service *Service) Init() (err error) {
 	return
 }
 
-func (service *Service) Put(msg *model.InputMessage, traceId string, flushFn func(traceId, with string)) error {
+// initJSONColumn prepares routing members which no column takes into DynamicSchema.JSONColumn instead of adding columns
+func (service *Service) initJSONColumn() error {
+	taskCfg := service.taskCfg
+	service.jsonColumn = nil
+	service.columns = make(map[string]struct{})
+	for _, dim := range service.dims {
+		if dim.Name == taskCfg.DynamicSchema.JSONColumn {
+			service.jsonColumn = dim
+		}
+		service.columns[dim.SourceName] = struct{}{}
+		// a flattened column takes the top-level member it's flattened from
+		if i := strings.Index(dim.SourceName, taskCfg.FlattenSeparator); taskCfg.FlattenSeparator != "" && i > 0 {
+			service.columns[dim.SourceName[:i]] = struct{}{}
+		}
+	}
+	for _, name := range taskCfg.ExcludeColumns {
+		service.columns[name] = struct{}{}
+	}
+	if service.jsonColumn == nil || service.jsonColumn.Type.Type != model.JSON || service.jsonColumn.Type.Array {
+		return errors.Newf("DynamicSchema.JSONColumn %s isn't a JSON column of table %s", taskCfg.DynamicSchema.JSONColumn, service.clickhouse.TableName)
+	}
+	return nil
+}
+
+// Put parses msg and puts its rows into the sharder, seq is the number of rows of msg put by other tasks.
+// The first row of msg takes over the accounting of msg from util.Rs, the consumer releases msg if no row is put.
+func (service *Service) Put(msg *model.InputMessage, seq int, traceId string, flushFn func(traceId, with string)) (puts int, err error) {
 	taskCfg := service.taskCfg
 	statistics.ConsumeMsgsTotal.WithLabelValues(taskCfg.Name).Inc()
-	var err error
+	value, err := service.decodeValue(msg)
+	if err != nil {
+		service.parseFailed(msg, err)
+		return 0, nil
+	}
+	values := [][]byte{value}
+	if taskCfg.Explode != "" {
+		values, err = parser.Explode(value, taskCfg.Explode, taskCfg.ExplodeInherit)
+	} else {
+		values, err = service.split(value)
+	}
+	if err != nil {
+		service.parseFailed(msg, err)
+		return 0, nil
+	}
+	// rows exploded from the message share its offset
+	elem := taskCfg.Explode != "" || len(values) != 1
+	for _, value := range values {
+		var put bool
+		if put, err = service.putValue(msg, value, elem, seq+puts, traceId, flushFn); err != nil {
+			return
+		}
+		if put {
+			puts++
+		}
+	}
+	return
+}
+
+// split splits value into rows if the parser is a parser.Splitter
+func (service *Service) split(value []byte) (values [][]byte, err error) {
+	p, err := service.pp.Get()
+	if err != nil {
+		util.Logger.Fatal("error initializing json parser", zap.String("task", service.taskCfg.Name), zap.Error(err))
+	}
+	defer service.pp.Put(p)
+	if s, ok := p.(parser.Splitter); ok {
+		return s.Split(value)
+	}
+	return [][]byte{value}, nil
+}
+
+// decodeValue applies the value encoding specified by the message header, or ValueEncoding of the task
+func (service *Service) decodeValue(msg *model.InputMessage) (value []byte, err error) {
+	taskCfg := service.taskCfg
+	pipeline := taskCfg.ValueEncoding
+	if taskCfg.ValueEncodingHeader != "" {
+		for _, h := range msg.Headers {
+			if strings.EqualFold(h.Key, taskCfg.ValueEncodingHeader) {
+				pipeline = string(h.Value)
+				break
+			}
+		}
+	}
+	if pipeline == "" {
+		return msg.Value, nil
+	}
+	var dec *parser.ValueDecoder
+	if dec, err = service.decoders.Get(pipeline); err != nil {
+		return
+	}
+	return dec.Decode(msg.Value)
+}
+
+func (service *Service) parseFailed(msg *model.InputMessage, err error) {
+	taskCfg := service.taskCfg
+	statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name).Inc()
+	if service.limiter.Allow() {
+		util.Logger.Error(fmt.Sprintf("failed to parse message(topic %v, partition %d, offset %v)",
+			msg.Topic, msg.Partition, msg.Offset), zap.String("message value", string(msg.Value)), zap.String("task", taskCfg.Name), zap.Error(err))
+	}
+	if service.deadLetter != nil {
+		service.deadLetter.Produce(msg, output.StageParse, err)
+	}
+}
+
+// badRow handles a message whose row has values invalid for their columns, it goes to the dead letter if there's one, otherwise it's dropped.
+// Either way it's counted and logged at a rate limit.
+func (service *Service) badRow(msg *model.InputMessage, err error) {
+	taskCfg := service.taskCfg
+	statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name).Inc()
+	if service.limiter.Allow() {
+		util.Logger.Error(fmt.Sprintf("failed to convert message(topic %v, partition %d, offset %v)",
+			msg.Topic, msg.Partition, msg.Offset), zap.String("message value", string(msg.Value)), zap.String("task", taskCfg.Name), zap.Error(err))
+	}
+	if service.deadLetter != nil {
+		service.deadLetter.Produce(msg, output.StageConvert, err)
+	}
+}
+
+// parse parses value with a parser of the pool, which shall be put back once metric isn't used any more.
+// While the schema registry is unavailable, parsing is retried with backoff until the consumer stops, so that the offset isn't committed.
+func (service *Service) parse(msg *model.InputMessage, value []byte) (p parser.Parser, metric model.Metric, err error) {
+	backoff := time.Second
+	for {
+		if p, err = service.pp.Get(); err != nil {
+			util.Logger.Fatal("error initializing json parser", zap.String("task", service.taskCfg.Name), zap.Error(err))
+		}
+		if mp, ok := p.(parser.MessageParser); ok {
+			metric, err = mp.ParseMessage(value, msg)
+		} else {
+			metric, err = p.Parse(value)
+		}
+		if !errors.Is(err, parser.ErrRegistryUnavailable) {
+			return
+		}
+		service.pp.Put(p)
+		if service.limiter.Allow() {
+			util.Logger.Warn(fmt.Sprintf("schema registry is unavailable, will parse message(topic %v, partition %d, offset %v) again",
+				msg.Topic, msg.Partition, msg.Offset), zap.String("task", service.taskCfg.Name), zap.Duration("backoff", backoff), zap.Error(err))
+		}
+		select {
+		case <-time.After(backoff):
+		case <-service.consumer.ctx.Done():
+			// p has been put back
+			return nil, nil, err
+		}
+		if backoff *= 2; backoff > maxRegistryBackoff {
+			backoff = maxRegistryBackoff
+		}
+	}
+}
+
+// putValue parses value, a message or an element exploded from it, and puts the row into the sharder.
+// put is false if the row is dropped, or not buffered due to a schema change or the consumer stopping.
+func (service *Service) putValue(msg *model.InputMessage, value []byte, elem bool, seq int, traceId string, flushFn func(traceId, with string)) (put bool, err error) {
+	taskCfg := service.taskCfg
 	var row *model.Row
 	var foundNewKeys bool
 	var metric model.Metric
 
-	p, err := service.pp.Get()
-	if err != nil {
-		util.Logger.Fatal("error initializing json parser", zap.String("task", taskCfg.Name), zap.Error(err))
+	// dead letters of an exploded message carry the failed element
+	failed := msg
+	if elem {
+		m := *msg
+		m.Value = value
+		failed = &m
 	}
-	if metric, err = p.Parse(msg.Value); err != nil {
+	p, metric, err := service.parse(msg, value)
+	if err != nil {
 		// directly return, ignore the row with parsing errors
-		statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name).Inc()
-		if service.limiter.Allow() {
-			util.Logger.Error(fmt.Sprintf("failed to parse message(topic %v, partition %d, offset %v)",
-				msg.Topic, msg.Partition, msg.Offset), zap.String("message value", string(msg.Value)), zap.String("task", taskCfg.Name), zap.Error(err))
+		service.pp.Put(p)
+		if errors.Is(err, parser.ErrSkipped) {
+			return false, nil
 		}
-		return nil
+		if errors.Is(err, parser.ErrRegistryUnavailable) {
+			// the consumer is stopping, the message will be consumed again
+			return false, err
+		}
+		service.parseFailed(failed, err)
+		return false, nil
 	} else {
-		row = service.metric2Row(metric, msg)
-		if row == nil {
-			return nil
+		if row, err = service.metric2Row(metric, msg); err != nil {
+			service.pp.Put(p)
+			service.badRow(failed, err)
+			return false, nil
 		}
-		if taskCfg.DynamicSchema.Enable {
+		if taskCfg.DynamicSchema.Enable && service.jsonColumn == nil {
 			foundNewKeys = metric.GetNewKeys(&service.knownKeys, &service.newKeys, &service.warnKeys, service.whiteList, service.blackList, msg.Partition, msg.Offset)
 		}
 	}
@@ -198,6 +417,10 @@ func (service *Service) Put(msg *model.InputMessage, traceId string, flushFn fun
 	if foundNewKeys {
 		cntNewKeys := atomic.AddInt32(&service.cntNewKeys, 1)
 		if cntNewKeys == 1 {
+			if _, ok := service.consumer.inputer.(input.Pauser); ok {
+				// the consumer pauses the partitions and applies the schema change, see Consumer.applySchemaChange
+				return false, errNewKeys
+			}
 			// the first message which contains new keys triggers the following:
 			// 1) restart the consumer group
 			// 	 1) stop the consumer to prevent blocking other consumers, stop will process until ChangeSchema completed
@@ -214,12 +437,12 @@ func (service *Service) Put(msg *model.InputMessage, traceId string, flushFn fun
 			}
 			cloneTask(service, nil)
 			util.Rs.Reset()
-			return fmt.Errorf("consumer restart required due to new key")
+			return false, fmt.Errorf("consumer restart required due to new key")
 		}
 	}
 
 	if atomic.LoadInt32(&service.cntNewKeys) == 0 && service.consumer.state.Load() == util.StateRunning {
-		msgRow := model.MsgRow{Msg: msg, Row: row}
+		msgRow := model.MsgRow{Msg: msg, Row: row, Seq: seq}
 		if service.sharder.policy != nil {
 			if msgRow.Shard, err = service.sharder.Calc(msgRow.Row, msg.Offset); err != nil {
 				util.Logger.Fatal("shard number calculation failed", zap.String("task", taskCfg.Name), zap.Error(err))
@@ -227,13 +450,58 @@ func (service *Service) Put(msg *model.InputMessage, traceId string, flushFn fun
 		} else {
 			msgRow.Shard = int(msgRow.Msg.Offset * (int64(msgRow.Msg.Partition + 1)) >> service.offShift % int64(service.sharder.shards))
 		}
+		if taskCfg.ExactlyOnce && service.written.covers(msg, msgRow.Shard) {
+			// replayed after a crash, the row is already in ClickHouse
+			statistics.SkipWrittenMsgsTotal.WithLabelValues(taskCfg.Name).Inc()
+			return false, nil
+		}
 		service.sharder.PutElement(&msgRow)
+		return true, nil
 	}
+	return false, nil
+}
 
-	return nil
+// loadOffsets reloads the offsets written to ClickHouse, and returns the offsets to resume consuming from.
+// A partition is absent if some shard has no record of it, or no replica of the shard can be read.
+func (service *Service) loadOffsets() (next map[string]map[int32]int64) {
+	offsets := service.clickhouse.LoadOffsets()
+	service.written.Lock()
+	service.written.m = offsets
+	service.written.Unlock()
+
+	next = make(map[string]map[int32]int64)
+	for topic, parts := range offsets {
+		next[topic] = make(map[int32]int64)
+	LOOP:
+		for partition, ends := range parts {
+			minEnd := int64(math.MaxInt64)
+			for _, end := range ends {
+				if end < 0 {
+					continue LOOP
+				}
+				if end < minEnd {
+					minEnd = end
+				}
+			}
+			next[topic][partition] = minEnd + 1
+		}
+	}
+	return
 }
 
-func (service *Service) metric2Row(metric model.Metric, msg *model.InputMessage) (r *model.Row) {
+// columnValue returns the value of dim in metric, an error if it violates constraints of the column type
+func (service *Service) columnValue(metric model.Metric, dim *model.ColumnWithType) (val interface{}, err error) {
+	val = model.GetValueByType(metric, dim)
+	if dim.Type.Constrained() {
+		if val, err = service.validator.Validate(val, dim.Type); err != nil {
+			statistics.InvalidValuesTotal.WithLabelValues(service.taskCfg.Name, dim.Name).Inc()
+			err = errors.Wrapf(err, "invalid value of column %s", dim.Name)
+		}
+	}
+	return
+}
+
+func (service *Service) metric2Row(metric model.Metric, msg *model.InputMessage) (r *model.Row, err error) {
 	if service.idxSerID >= 0 {
 		// If some labels are not Prometheus native, ETL shall calculate and pass "__series_id__" and "__mgmt_id__".
 		val := metric.GetInt64(service.clickhouse.DimSerID, false)
@@ -249,7 +517,11 @@ func (service *Service) metric2Row(metric model.Metric, msg *model.InputMessage)
 
 		row := make(model.Row, 0, rowcount)
 		for i := 0; i < service.idxSerID; i++ {
-			row = append(row, model.GetValueByType(metric, service.dims[i]))
+			var val interface{}
+			if val, err = service.columnValue(metric, service.dims[i]); err != nil {
+				return
+			}
+			row = append(row, val)
 		}
 		row = append(row, seriesID) // __series_id__
 		if newSeries {
@@ -257,7 +529,10 @@ func (service *Service) metric2Row(metric model.Metric, msg *model.InputMessage)
 			row = append(row, mgmtID, nil) // __mgmt_id__, labels
 			for i := service.idxSerID + 3; i < service.numDims; i++ {
 				dim := service.dims[i]
-				val := model.GetValueByType(metric, dim)
+				var val interface{}
+				if val, err = service.columnValue(metric, dim); err != nil {
+					return
+				}
 				row = append(row, val)
 				if val != nil && dim.Type.Type == model.String && dim.Name != service.nameKey && dim.Name != "le" && (service.lblBlkList == nil || !service.lblBlkList.MatchString(dim.Name)) {
 					// "labels" JSON excludes "le", so that "labels" can be used as group key for histogram queries.
@@ -269,7 +544,7 @@ func (service *Service) metric2Row(metric model.Metric, msg *model.InputMessage)
 			}
 			row[service.idxSerID+2] = fmt.Sprintf("{%s}", strings.Join(labels, ", "))
 		}
-		return &row
+		return &row, nil
 	} else {
 		var shardingVal uint64
 		if len(service.clickhouse.SortingKeys) > 0 {
@@ -298,8 +573,13 @@ func (service *Service) metric2Row(metric model.Metric, msg *model.InputMessage)
 				}
 			} else if dim.Name == "__shardingkey" {
 				row = append(row, shardingVal)
+			} else if dim == service.jsonColumn {
+				row = append(row, metric.GetRest(service.columns, service.whiteList, service.blackList))
 			} else {
-				val := model.GetValueByType(metric, dim)
+				var val interface{}
+				if val, err = service.columnValue(metric, dim); err != nil {
+					return
+				}
 				if dim.NotNullable && val == nil {
 					// null 不能插入到非 nullbale字段中
 					util.Logger.Warn("null value detected, throw this message",
@@ -310,12 +590,12 @@ func (service *Service) metric2Row(metric model.Metric, msg *model.InputMessage)
 						zap.Int64("offset", msg.Offset),
 						zap.String("key", string(msg.Key)),
 						zap.Time("timestamp", *msg.Timestamp))
-					return nil
+					return nil, errors.Newf("null value for non-nullable column %s", dim.Name)
 				}
 				row = append(row, val)
 			}
 		}
 
-		return &row
+		return &row, nil
 	}
 }
@@ -0,0 +1,43 @@
+package task
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"golang.org/x/time/rate"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/output"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+func TestBadRow(t *testing.T) {
+	util.InitLogger([]string{"stdout"})
+	taskCfg := &config.TaskConfig{Name: "test_bad_row", WriteFailurePolicy: config.WriteFailureFatal}
+	service := &Service{taskCfg: taskCfg, limiter: rate.NewLimiter(rate.Every(10*time.Second), 1)}
+	errors0 := testutil.ToFloat64(statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name))
+	msg := &model.InputMessage{Topic: "topic1", Partition: 0, Offset: 1, Value: []byte(`{"e":"x"}`)}
+
+	// dropped without a dead letter, regardless of WriteFailurePolicy
+	service.badRow(msg, errors.Newf("invalid value of column e"))
+	require.Equal(t, errors0+1, testutil.ToFloat64(statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name)))
+
+	// sent to the dead letter if there's one
+	taskCfg.DeadLetter.SpoolDir = t.TempDir()
+	dl, err := output.NewDeadLetter(&config.Config{}, taskCfg)
+	require.Nil(t, err)
+	defer dl.Close()
+	service.deadLetter = dl
+	service.badRow(msg, errors.Newf("invalid value of column e"))
+	require.Equal(t, errors0+2, testutil.ToFloat64(statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name)))
+	bs, err := os.ReadFile(filepath.Join(taskCfg.DeadLetter.SpoolDir, taskCfg.Name+".ndjson"))
+	require.Nil(t, err)
+	require.Contains(t, string(bs), `"stage":"`+output.StageConvert+`"`)
+}
@@ -1,35 +1,104 @@
 package util
 
-import "sync/atomic"
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
+// RecordSize bounds the records and bytes which have been fetched but not yet written.
+// Fetching blocks in Wait until Dec makes room.
 type RecordSize struct {
-	poolSize int64
-	realSize int64
+	poolSize  int64
+	poolBytes int64 // <=0 means unlimited
+	realSize  int64
+	realBytes int64
+
+	mux     sync.Mutex
+	cond    *sync.Cond
+	waiters int32
+}
+
+func NewRecordSize() *RecordSize {
+	rs := &RecordSize{}
+	rs.cond = sync.NewCond(&rs.mux)
+	return rs
 }
 
 func (rs *RecordSize) SetPoolSize(size int64) {
-	rs.poolSize = size
+	atomic.StoreInt64(&rs.poolSize, size)
+	rs.signal()
 }
 
-func (rs *RecordSize) Inc(size int64) {
+func (rs *RecordSize) SetPoolBytes(bytes int64) {
+	atomic.StoreInt64(&rs.poolBytes, bytes)
+	rs.signal()
+}
+
+func (rs *RecordSize) Inc(size, bytes int64) {
 	atomic.AddInt64(&rs.realSize, size)
+	atomic.AddInt64(&rs.realBytes, bytes)
 }
 
 func (rs *RecordSize) Reset() {
 	atomic.StoreInt64(&rs.realSize, 0)
+	atomic.StoreInt64(&rs.realBytes, 0)
+	rs.signal()
 }
 
-func (rs *RecordSize) Dec(size int64) {
+func (rs *RecordSize) Dec(size, bytes int64) {
 	atomic.AddInt64(&rs.realSize, size*(-1))
+	atomic.AddInt64(&rs.realBytes, bytes*(-1))
+	rs.signal()
 }
 
 func (rs *RecordSize) Get() int64 {
 	return atomic.LoadInt64(&rs.realSize)
 }
 
+func (rs *RecordSize) GetBytes() int64 {
+	return atomic.LoadInt64(&rs.realBytes)
+}
+
 func (rs *RecordSize) Allow() bool {
-	realSize := atomic.LoadInt64(&rs.realSize)
-	return realSize < rs.poolSize
+	if atomic.LoadInt64(&rs.realSize) >= atomic.LoadInt64(&rs.poolSize) {
+		return false
+	}
+	poolBytes := atomic.LoadInt64(&rs.poolBytes)
+	return poolBytes <= 0 || atomic.LoadInt64(&rs.realBytes) < poolBytes
+}
+
+// Wait blocks until Allow or ctx is done, it returns how long it blocked.
+func (rs *RecordSize) Wait(ctx context.Context) (blocked time.Duration, err error) {
+	if rs.Allow() {
+		return
+	}
+	begin := time.Now()
+	stop := context.AfterFunc(ctx, func() {
+		rs.mux.Lock()
+		rs.cond.Broadcast()
+		rs.mux.Unlock()
+	})
+	defer stop()
+	rs.mux.Lock()
+	// waiters is increased before checking Allow, so that a concurrent Dec never misses the signal
+	atomic.AddInt32(&rs.waiters, 1)
+	for !rs.Allow() && ctx.Err() == nil {
+		rs.cond.Wait()
+	}
+	atomic.AddInt32(&rs.waiters, -1)
+	rs.mux.Unlock()
+	return time.Since(begin), ctx.Err()
+}
+
+func (rs *RecordSize) signal() {
+	if atomic.LoadInt32(&rs.waiters) == 0 {
+		return
+	}
+	rs.mux.Lock()
+	rs.cond.Broadcast()
+	rs.mux.Unlock()
 }
 
-var Rs RecordSize
+var Rs = NewRecordSize()
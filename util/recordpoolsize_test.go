@@ -0,0 +1,38 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordSizeWait(t *testing.T) {
+	rs := NewRecordSize()
+	rs.SetPoolSize(10)
+	rs.SetPoolBytes(100)
+
+	rs.Inc(5, 100)
+	require.False(t, rs.Allow())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rs.Dec(1, 10)
+	}()
+	blocked, err := rs.Wait(context.Background())
+	require.Nil(t, err)
+	require.Greater(t, blocked, time.Duration(0))
+	require.True(t, rs.Allow())
+
+	rs.Inc(6, 0)
+	require.False(t, rs.Allow())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = rs.Wait(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	rs.Reset()
+	blocked, err = rs.Wait(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, time.Duration(0), blocked)
+}